@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// First RAM address of variables declared in asm code
+const asmVarBase = 16
+
+var predefinedSymbols = map[string]int{
+	"SP": 0, "LCL": 1, "ARG": 2, "THIS": 3, "THAT": 4,
+	"SCREEN": 16384, "KBD": 24576,
+}
+
+func init() {
+	for i := 0; i < 16; i++ {
+		predefinedSymbols["R"+strconv.Itoa(i)] = i
+	}
+}
+
+// Bits a c1 c2 c3 c4 c5 c6 of the compute field
+var compCodes = map[string]string{
+	"0": "0101010", "1": "0111111", "-1": "0111010",
+	"D": "0001100", "A": "0110000", "!D": "0001101", "!A": "0110001",
+	"-D": "0001111", "-A": "0110011", "D+1": "0011111", "A+1": "0110111",
+	"D-1": "0001110", "A-1": "0110010", "D+A": "0000010", "D-A": "0010011",
+	"A-D": "0000111", "D&A": "0000000", "D|A": "0010101",
+	"M": "1110000", "!M": "1110001", "-M": "1110011", "M+1": "1110111",
+	"M-1": "1110010", "D+M": "1000010", "D-M": "1010011", "M-D": "1000111",
+	"D&M": "1000000", "D|M": "1010101",
+}
+
+// Commutative forms accepted by the course assembler
+var compAliases = map[string]string{
+	"A+D": "D+A", "M+D": "D+M", "A&D": "D&A", "M&D": "D&M",
+	"A|D": "D|A", "M|D": "D|M", "1+D": "D+1", "1+A": "A+1", "1+M": "M+1",
+}
+
+var jumpCodes = map[string]string{
+	"": "000", "JGT": "001", "JEQ": "010", "JGE": "011",
+	"JLT": "100", "JNE": "101", "JLE": "110", "JMP": "111",
+}
+
+// asmLine is a significant line of an asm file without comments and spaces
+type asmLine struct {
+	num  int
+	text string
+}
+
+// Assembler translates Hack assembly into Hack binary code
+type Assembler struct {
+	file    string
+	symbols map[string]int
+	nextVar int
+}
+
+func NewAssembler(file string) *Assembler {
+	symbols := make(map[string]int, len(predefinedSymbols))
+	for k, v := range predefinedSymbols {
+		symbols[k] = v
+	}
+	return &Assembler{file: file, symbols: symbols, nextVar: asmVarBase}
+}
+
+func (a *Assembler) errorf(line int, format string, args ...interface{}) {
+	d := errorDiag(CodeAssemble, format, args...).AtPos(line, 1)
+	d.File = a.file
+	panic(d)
+}
+
+func (a *Assembler) recover(errp *error) {
+	e := recover()
+	if e != nil {
+		d, ok := e.(*Diagnostic)
+		if !ok {
+			panic(e)
+		}
+		*errp = d
+	}
+}
+
+// Assemble returns the binary code as text, one 16-bit instruction per line
+func (a *Assembler) Assemble(src string) (hack string, err error) {
+	defer a.recover(&err)
+
+	lines, err := readAsmLines(src)
+	if err != nil {
+		return "", err
+	}
+
+	// First pass: labels
+	var instrs []asmLine
+	for _, l := range lines {
+		if strings.HasPrefix(l.text, "(") {
+			if !strings.HasSuffix(l.text, ")") {
+				a.errorf(l.num, "Label %s is not closed", l.text)
+			}
+			name := l.text[1 : len(l.text)-1]
+			a.checkSymbol(l.num, name)
+			if _, ok := a.symbols[name]; ok {
+				a.errorf(l.num, "Symbol %s is already defined", name)
+			}
+			a.symbols[name] = len(instrs)
+			continue
+		}
+		instrs = append(instrs, l)
+	}
+	if len(instrs) > 32768 {
+		a.errorf(instrs[32768].num, "The program does not fit into 32K ROM")
+	}
+
+	// Second pass: instructions
+	sb := strings.Builder{}
+	for _, l := range instrs {
+		if strings.HasPrefix(l.text, "@") {
+			sb.WriteString(a.aInstruction(l))
+		} else {
+			sb.WriteString(a.cInstruction(l))
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
+func readAsmLines(src string) ([]asmLine, error) {
+	var lines []asmLine
+	sc := bufio.NewScanner(strings.NewReader(src))
+	for num := 1; sc.Scan(); num++ {
+		text := sc.Text()
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.Join(strings.Fields(text), "")
+		if text != "" {
+			lines = append(lines, asmLine{num, text})
+		}
+	}
+	return lines, sc.Err()
+}
+
+// checkSymbol validates a symbol: letters, digits, _ . $ : and it cannot start with a digit
+func (a *Assembler) checkSymbol(line int, s string) {
+	if s == "" {
+		a.errorf(line, "Empty symbol")
+	}
+	for i, ch := range s {
+		isLetter := ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+		isDigit := ch >= '0' && ch <= '9'
+		if !isLetter && !(isDigit && i > 0) && !strings.ContainsRune("_.$:", ch) {
+			a.errorf(line, "Wrong symbol %s", s)
+		}
+	}
+}
+
+func (a *Assembler) aInstruction(l asmLine) string {
+	val := l.text[1:]
+	var addr int
+	if val != "" && val[0] >= '0' && val[0] <= '9' {
+		var err error
+		addr, err = strconv.Atoi(val)
+		if err != nil || addr > 32767 {
+			a.errorf(l.num, "Wrong constant %s. Expected 0..32767", val)
+		}
+	} else {
+		a.checkSymbol(l.num, val)
+		var ok bool
+		if addr, ok = a.symbols[val]; !ok {
+			addr = a.nextVar
+			a.symbols[val] = addr
+			a.nextVar++
+		}
+	}
+	return "0" + toBinary(addr, 15)
+}
+
+// cInstruction encodes dest=comp;jump
+func (a *Assembler) cInstruction(l asmLine) string {
+	text := l.text
+	var dest, jump string
+	if i := strings.Index(text, ";"); i >= 0 {
+		text, jump = text[:i], text[i+1:]
+	}
+	if i := strings.Index(text, "="); i >= 0 {
+		dest, text = text[:i], text[i+1:]
+	}
+
+	comp := text
+	if alias, ok := compAliases[comp]; ok {
+		comp = alias
+	}
+	compBits, ok := compCodes[comp]
+	if !ok {
+		a.errorf(l.num, "Unknown computation %s", text)
+	}
+	jumpBits, ok := jumpCodes[jump]
+	if !ok {
+		a.errorf(l.num, "Unknown jump %s", jump)
+	}
+
+	destBits := []byte("000")
+	for _, ch := range dest {
+		idx := strings.IndexRune("ADM", ch)
+		if idx < 0 || destBits[idx] == '1' {
+			a.errorf(l.num, "Wrong destination %s", dest)
+		}
+		destBits[idx] = '1'
+	}
+	return "111" + compBits + string(destBits) + jumpBits
+}
+
+func toBinary(val, width int) string {
+	s := strconv.FormatInt(int64(val), 2)
+	return strings.Repeat("0", width-len(s)) + s
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAssembleInstructions(t *testing.T) {
+	testCases := []struct {
+		asm  string
+		want string
+	}{
+		{"@2", "0000000000000010"},
+		{"@32767", "0111111111111111"},
+		{"@SCREEN", "0100000000000000"},
+		{"@KBD", "0110000000000000"},
+		{"@R15", "0000000000001111"},
+		{"@THAT", "0000000000000100"},
+		{"D=A", "1110110000010000"},
+		{"D=D+A", "1110000010010000"},
+		{"M=D", "1110001100001000"},
+		{"AM=M-1", "1111110010101000"},
+		{"0;JMP", "1110101010000111"},
+		{"D;JGT", "1110001100000001"},
+		{"AMD=D|M;JLE", "1111010101111110"},
+		{"D=A+D", "1110000010010000"},
+		{"M=!M // comment", "1111110001001000"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.asm, func(t *testing.T) {
+			got, err := NewAssembler("Test.asm").Assemble(tc.asm)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.want+"\n" {
+				t.Errorf("Got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAssembleSymbols(t *testing.T) {
+	asm := `// Labels and variables
+(LOOP)
+  @i
+  M=M+1
+  @j
+  D=M
+  @LOOP
+  0;JMP
+(END)
+  @END
+  @i
+`
+	want := []string{
+		"0000000000010000", // i = 16
+		"1111110111001000",
+		"0000000000010001", // j = 17
+		"1111110000010000",
+		"0000000000000000", // LOOP = 0
+		"1110101010000111",
+		"0000000000000110", // END = 6
+		"0000000000010000", // i = 16
+	}
+	got, err := NewAssembler("Test.asm").Assemble(asm)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("Got:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		asm  string
+		line int
+	}{
+		{"Big constant", "@0\n@32768", 2},
+		{"Wrong comp", "D=D*A", 1},
+		{"Wrong dest", "X=D", 1},
+		{"Twice dest", "MM=D", 1},
+		{"Wrong jump", "0;JUMP", 1},
+		{"Duplicated label", "(A1)\n(A1)", 2},
+		{"Predefined label", "(SP)", 1},
+		{"Wrong symbol", "@a-b", 1},
+		{"Not closed label", "(LOOP", 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAssembler("Test.asm").Assemble(tc.asm)
+			if err == nil {
+				t.Fatal("Expected error")
+			}
+			if d := AsDiagnostic(err); d.Line != tc.line || d.File != "Test.asm" {
+				t.Errorf("Got %v; want error on line %d", d, tc.line)
+			}
+		})
+	}
+}
+
+// hackCPU executes Hack binary code for end to end tests
+type hackCPU struct {
+	rom  []uint16
+	ram  [32768]int16
+	a, d int16
+	pc   int
+}
+
+func newHackCPU(t *testing.T, hack string) *hackCPU {
+	cpu := &hackCPU{}
+	sc := bufio.NewScanner(strings.NewReader(hack))
+	for sc.Scan() {
+		v, err := strconv.ParseUint(sc.Text(), 2, 16)
+		if err != nil {
+			t.Fatalf("Wrong binary %s", sc.Text())
+		}
+		cpu.rom = append(cpu.rom, uint16(v))
+	}
+	return cpu
+}
+
+func (cpu *hackCPU) run(steps int) {
+	for ; steps > 0 && cpu.pc < len(cpu.rom); steps-- {
+		in := cpu.rom[cpu.pc]
+		if in&0x8000 == 0 {
+			cpu.a = int16(in)
+			cpu.pc++
+			continue
+		}
+		y := cpu.a
+		if in&0x1000 != 0 {
+			y = cpu.ram[uint16(cpu.a)&0x7fff]
+		}
+		x := cpu.d
+		if in&0x0800 != 0 {
+			x = 0
+		}
+		if in&0x0400 != 0 {
+			x = ^x
+		}
+		if in&0x0200 != 0 {
+			y = 0
+		}
+		if in&0x0100 != 0 {
+			y = ^y
+		}
+		out := x & y
+		if in&0x0080 != 0 {
+			out = x + y
+		}
+		if in&0x0040 != 0 {
+			out = ^out
+		}
+
+		addr := uint16(cpu.a) & 0x7fff
+		if in&0x0008 != 0 {
+			cpu.ram[addr] = out
+		}
+		if in&0x0020 != 0 {
+			cpu.a = out
+		}
+		if in&0x0010 != 0 {
+			cpu.d = out
+		}
+		jump := in&0x4 != 0 && out < 0 || in&0x2 != 0 && out == 0 || in&0x1 != 0 && out > 0
+		if jump {
+			cpu.pc = int(uint16(cpu.a))
+		} else {
+			cpu.pc++
+		}
+	}
+}
+
+// Jack code is compiled, translated, assembled and executed on the Hack CPU
+func TestEndToEnd(t *testing.T) {
+	jack := `class Main {
+		static int calls;
+		function int fib(int n) {
+			let calls = calls + 1;
+			if (n < 2) { return n; }
+			return Main.fib(n - 1) + Main.fib(n - 2);
+		}
+		function int sum(int n) {
+			var int i, s;
+			while (i < n) { let i = i + 1; let s = s + i; }
+			return s;
+		}
+	}`
+	sys := `function Sys.init 0
+push constant 10
+call Main.fib 1
+pop static 0
+push constant 100
+call Main.sum 1
+pop static 1
+label END
+goto END
+`
+	comp := NewCompiler()
+	if err := comp.Run(parseClass(t, jack)); err != nil {
+		t.Fatalf("Compilation error: %v", err)
+	}
+
+	vt := NewVmTranslator(true)
+	if err := vt.Translate("Main", comp.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vt.Translate("Sys", sys); err != nil {
+		t.Fatal(err)
+	}
+	hack, err := NewAssembler("Prog.asm").Assemble(vt.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpu := newHackCPU(t, hack)
+	cpu.run(1000000)
+
+	// Statics are allocated from 16 in the order of the first use: Main.0, Sys.0, Sys.1
+	want := map[int]int16{16: 177, 17: 55, 18: 5050}
+	for addr, v := range want {
+		if cpu.ram[addr] != v {
+			t.Errorf("RAM[%d] = %d; want %d", addr, cpu.ram[addr], v)
+		}
+	}
+	// Frame of Sys.init called by bootstrap
+	if cpu.ram[0] != 261 {
+		t.Errorf("SP = %d; want 261", cpu.ram[0])
+	}
+}
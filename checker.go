@@ -0,0 +1,387 @@
+package main
+
+import "sort"
+
+// SbrInfo is a signature of a subroutine collected from a class declaration
+type SbrInfo struct {
+	Kind       string // constructor, function or method
+	ReturnType string
+	Name       string
+	Params     []string // types of the parameters
+}
+
+func (si SbrInfo) IsMethod() bool {
+	return si.Kind == "method"
+}
+
+// ClassInfo holds all subroutine signatures of a class
+type ClassInfo struct {
+	Name string
+	File string // empty for the OS classes
+	Sbrs map[string]SbrInfo
+}
+
+func NewClassInfo(name, file string) *ClassInfo {
+	return &ClassInfo{Name: name, File: file, Sbrs: make(map[string]SbrInfo)}
+}
+
+func (ci *ClassInfo) IsOS() bool {
+	return ci.File == ""
+}
+
+// Standard Jack OS API
+var osClasses = map[string][]SbrInfo{
+	"Math": {
+		{"function", "void", "init", nil},
+		{"function", "int", "abs", []string{"int"}},
+		{"function", "int", "multiply", []string{"int", "int"}},
+		{"function", "int", "divide", []string{"int", "int"}},
+		{"function", "int", "min", []string{"int", "int"}},
+		{"function", "int", "max", []string{"int", "int"}},
+		{"function", "int", "sqrt", []string{"int"}},
+	},
+	"String": {
+		{"constructor", "String", "new", []string{"int"}},
+		{"method", "void", "dispose", nil},
+		{"method", "int", "length", nil},
+		{"method", "char", "charAt", []string{"int"}},
+		{"method", "void", "setCharAt", []string{"int", "char"}},
+		{"method", "String", "appendChar", []string{"char"}},
+		{"method", "void", "eraseLastChar", nil},
+		{"method", "int", "intValue", nil},
+		{"method", "void", "setInt", []string{"int"}},
+		{"function", "char", "backSpace", nil},
+		{"function", "char", "doubleQuote", nil},
+		{"function", "char", "newLine", nil},
+	},
+	"Array": {
+		{"function", "Array", "new", []string{"int"}},
+		{"method", "void", "dispose", nil},
+	},
+	"Output": {
+		{"function", "void", "init", nil},
+		{"function", "void", "moveCursor", []string{"int", "int"}},
+		{"function", "void", "printChar", []string{"char"}},
+		{"function", "void", "printString", []string{"String"}},
+		{"function", "void", "printInt", []string{"int"}},
+		{"function", "void", "println", nil},
+		{"function", "void", "backSpace", nil},
+	},
+	"Screen": {
+		{"function", "void", "init", nil},
+		{"function", "void", "clearScreen", nil},
+		{"function", "void", "setColor", []string{"boolean"}},
+		{"function", "void", "drawPixel", []string{"int", "int"}},
+		{"function", "void", "drawLine", []string{"int", "int", "int", "int"}},
+		{"function", "void", "drawRectangle", []string{"int", "int", "int", "int"}},
+		{"function", "void", "drawCircle", []string{"int", "int", "int"}},
+	},
+	"Keyboard": {
+		{"function", "void", "init", nil},
+		{"function", "char", "keyPressed", nil},
+		{"function", "char", "readChar", nil},
+		{"function", "String", "readLine", []string{"String"}},
+		{"function", "int", "readInt", []string{"String"}},
+	},
+	"Memory": {
+		{"function", "void", "init", nil},
+		{"function", "int", "peek", []string{"int"}},
+		{"function", "void", "poke", []string{"int", "int"}},
+		{"function", "Array", "alloc", []string{"int"}},
+		{"function", "void", "deAlloc", []string{"Array"}},
+	},
+	"Sys": {
+		{"function", "void", "init", nil},
+		{"function", "void", "halt", nil},
+		{"function", "void", "error", []string{"int"}},
+		{"function", "void", "wait", []string{"int"}},
+	},
+}
+
+// ProgramInfo contains signatures of all classes of a program including OS classes
+type ProgramInfo struct {
+	classes map[string]*ClassInfo
+}
+
+func NewProgramInfo() *ProgramInfo {
+	pi := &ProgramInfo{classes: make(map[string]*ClassInfo)}
+	for name, sbrs := range osClasses {
+		ci := NewClassInfo(name, "")
+		for _, s := range sbrs {
+			ci.Sbrs[s.Name] = s
+		}
+		pi.classes[name] = ci
+	}
+	return pi
+}
+
+// AddClass collects signatures of the class. A user class replaces an OS class with the same name
+func (pi *ProgramInfo) AddClass(file string, cn *ClassNode) *Diagnostic {
+	name := cn.Name.GetValue()
+	if ci, ok := pi.classes[name]; ok && !ci.IsOS() {
+		d := errorDiag(CodeDuplicateClass, "Class %s is already declared in the file \"%s\"", name, ci.File).At(cn.Name)
+		d.File = file
+		return d
+	}
+
+	ci := NewClassInfo(name, file)
+	for _, sbr := range cn.SbrDec {
+		si := sbr.Signature()
+		if _, ok := ci.Sbrs[si.Name]; ok {
+			// A duplicate is skipped, the first one wins. DeclChecker reports it
+			continue
+		}
+		ci.Sbrs[si.Name] = si
+	}
+	pi.classes[name] = ci
+	return nil
+}
+
+func (pi *ProgramInfo) Class(name string) (*ClassInfo, bool) {
+	ci, ok := pi.classes[name]
+	return ci, ok
+}
+
+// ClassNames returns sorted names of all known classes
+func (pi *ProgramInfo) ClassNames() []string {
+	names := make([]string, 0, len(pi.classes))
+	for n := range pi.classes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checker validates subroutine calls of a class against the whole program
+type Checker struct {
+	prog  *ProgramInfo
+	Tbl   *SymbolTableList
+	file  string
+	class *ClassInfo
+	sbr   *SubroutineDecNode
+	errs  DiagnosticList
+}
+
+func NewChecker(prog *ProgramInfo) *Checker {
+	return &Checker{prog: prog}
+}
+
+func (c *Checker) errorf(tk Token, code string, format string, args ...interface{}) {
+	d := errorDiag(code, format, args...).At(tk)
+	d.File = c.file
+	c.errs = append(c.errs, d)
+}
+
+// Check returns all the errors found in the class
+func (c *Checker) Check(file string, cn *ClassNode) DiagnosticList {
+	c.file = file
+	c.errs = nil
+	c.Tbl = NewSymbolTableList()
+	c.class, _ = c.prog.Class(cn.Name.GetValue())
+
+	c.Tbl.CreateTable(cn.Name.GetValue())
+	defer c.Tbl.CloseTable()
+	declareClassVars(c.Tbl, cn)
+
+	for _, sbr := range cn.SbrDec {
+		c.checkSubroutine(sbr)
+	}
+	return c.errs
+}
+
+func (c *Checker) checkSubroutine(sbr *SubroutineDecNode) {
+	c.Tbl.CreateTable(c.class.Name + "." + sbr.Name.GetValue())
+	defer c.Tbl.CloseTable()
+	declareSubroutineVars(c.Tbl, c.class.Name, sbr)
+	c.sbr = sbr
+
+	Inspect(sbr.Body, func(n Node) bool {
+		switch nd := n.(type) {
+		case *SubroutineCallNode:
+			c.checkCall(nd)
+		case *LetStatementNode:
+			c.checkVar(nd.VarName)
+		case *TermNode:
+			switch nd.termType {
+			case termNodeVar, termNodeArray:
+				c.checkVar(nd.val)
+			case termNodeThis:
+				c.checkThis(nd.val, "this")
+			}
+		}
+		return true
+	})
+}
+
+// checkThis reports the token that needs this inside a function
+func (c *Checker) checkThis(tk Token, what string) {
+	if c.sbr.SbrKind.GetValue() == "function" {
+		c.errorf(tk, CodeNoThis, "%s cannot be used in the function %s.%s", what, c.class.Name, c.sbr.Name.GetValue())
+	}
+}
+
+func (c *Checker) checkVar(name Token) {
+	if vi, ok := c.Tbl.Lookup(name.GetValue()); ok && vi.Kind == Field {
+		c.checkThis(name, "Field "+name.GetValue())
+	}
+}
+
+// declareClassVars adds fields and statics of the class into the current table.
+// Redeclarations are skipped, the first declaration wins. DeclChecker reports them
+func declareClassVars(tbl *SymbolTableList, cn *ClassNode) {
+	for _, vd := range cn.VarDec {
+		vk := Static
+		if vd.Kind.GetValue() == "field" {
+			vk = Field
+		}
+		for _, n := range vd.Names {
+			tbl.Current().AddVar(vk, vd.VarType.GetValue(), n.GetValue())
+		}
+	}
+}
+
+// declareSubroutineVars adds this, parameters and locals of the subroutine into the current table
+func declareSubroutineVars(tbl *SymbolTableList, className string, sbr *SubroutineDecNode) {
+	if sbr.SbrKind.GetValue() == "method" {
+		tbl.Current().AddVar(Arg, className, "this")
+	}
+	for i, vt := range sbr.ParamList.varTypes {
+		tbl.Current().AddVar(Arg, vt.GetValue(), sbr.ParamList.varNames[i].GetValue())
+	}
+	for _, vd := range sbr.Body.VarDec {
+		for _, id := range vd.Ids {
+			tbl.Current().AddVar(Local, vd.VarType.GetValue(), id.GetValue())
+		}
+	}
+}
+
+// lookupCall finds the signature of the called subroutine without reporting errors
+func lookupCall(prog *ProgramInfo, tbl *SymbolTableList, class *ClassInfo, call *SubroutineCallNode) (SbrInfo, bool) {
+	ci := class
+	if call.Prefix != nil {
+		prefix := call.Prefix.GetValue()
+		if vi, ok := tbl.Lookup(prefix); ok {
+			prefix = vi.Type
+		}
+		var ok bool
+		if ci, ok = prog.Class(prefix); !ok {
+			return SbrInfo{}, false
+		}
+	}
+	si, ok := ci.Sbrs[call.SubroutineName.GetValue()]
+	return si, ok
+}
+
+// checkCall validates the call target and the count of arguments
+func (c *Checker) checkCall(call *SubroutineCallNode) {
+	sbrName := call.SubroutineName.GetValue()
+	argCount := call.Params.Len()
+
+	if call.Prefix == nil {
+		si, ok := c.class.Sbrs[sbrName]
+		if !ok {
+			c.errorf(call.SubroutineName, CodeUndeclaredSbr, "Subroutine %s.%s is not declared", c.class.Name, sbrName)
+			return
+		}
+		if !si.IsMethod() {
+			c.errorf(call.SubroutineName, CodeWrongCallKind, "%s.%s is a %s and must be called as %s.%s", c.class.Name, sbrName, si.Kind, c.class.Name, sbrName)
+			return
+		}
+		c.checkThis(call.SubroutineName, "Method "+c.class.Name+"."+sbrName)
+		c.checkArgCount(call, c.class.Name, si, argCount)
+		return
+	}
+
+	prefix := call.Prefix.GetValue()
+	if vi, ok := c.Tbl.Lookup(prefix); ok {
+		c.checkVar(call.Prefix)
+		ci, ok := c.prog.Class(vi.Type)
+		if !ok {
+			c.errorf(call.Prefix, CodeUnknownTarget, "Cannot call %s on the variable %s of type %s", sbrName, prefix, vi.Type)
+			return
+		}
+		si, ok := ci.Sbrs[sbrName]
+		if !ok {
+			c.errorf(call.SubroutineName, CodeUndeclaredSbr, "Subroutine %s.%s is not declared", ci.Name, sbrName)
+			return
+		}
+		if !si.IsMethod() {
+			c.errorf(call.SubroutineName, CodeWrongCallKind, "%s.%s is a %s and cannot be called on the variable %s", ci.Name, sbrName, si.Kind, prefix)
+			return
+		}
+		c.checkArgCount(call, ci.Name, si, argCount)
+		return
+	}
+
+	ci, ok := c.prog.Class(prefix)
+	if !ok {
+		c.errorf(call.Prefix, CodeUnknownTarget, "%s is neither a variable nor a known class", prefix)
+		return
+	}
+	si, ok := ci.Sbrs[sbrName]
+	if !ok {
+		c.errorf(call.SubroutineName, CodeUndeclaredSbr, "Subroutine %s.%s is not declared", ci.Name, sbrName)
+		return
+	}
+	if si.IsMethod() {
+		c.errorf(call.SubroutineName, CodeWrongCallKind, "Method %s.%s cannot be called without an object", ci.Name, sbrName)
+		return
+	}
+	c.checkArgCount(call, ci.Name, si, argCount)
+}
+
+func (c *Checker) checkArgCount(call *SubroutineCallNode, className string, si SbrInfo, argCount int) {
+	if len(si.Params) != argCount {
+		c.errorf(call.SubroutineName, CodeArgCount, "%s.%s expects %d arguments; got %d", className, si.Name, len(si.Params), argCount)
+	}
+}
+
+// CheckOptions configures analysis passes run by CheckProgram
+type CheckOptions struct {
+	Types    TypeStrictness
+	DeadCode DeadCodeMode
+	Unused   bool // variables that are never read
+	Uninit   bool // locals read before they are assigned
+}
+
+// CheckProgram collects signatures of all the classes and validates every class.
+// The keys of units are file names
+func CheckProgram(units map[string]*ClassNode, opts CheckOptions) DiagnosticList {
+	prog := NewProgramInfo()
+	var errs DiagnosticList
+
+	files := make([]string, 0, len(units))
+	for f := range units {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	// Only declarations of a redeclared class are checked: other checks would use the first declaration
+	redeclared := make(map[string]bool)
+	for _, f := range files {
+		if err := prog.AddClass(f, units[f]); err != nil {
+			errs = append(errs, err)
+			redeclared[f] = true
+		}
+	}
+
+	dc := NewDeclChecker(prog)
+	ch := NewChecker(prog)
+	tc := NewTypeChecker(prog, opts.Types)
+	fc := NewFlowChecker()
+	vc := NewVarChecker(opts.Unused, opts.Uninit)
+	for _, f := range files {
+		errs = append(errs, dc.Check(f, units[f])...)
+		if redeclared[f] {
+			continue
+		}
+		errs = append(errs, ch.Check(f, units[f])...)
+		errs = append(errs, tc.Check(f, units[f])...)
+		errs = append(errs, fc.Check(f, units[f])...)
+		errs = append(errs, vc.Check(f, units[f])...)
+	}
+	if opts.DeadCode != DeadCodeOff {
+		errs = append(errs, FindDeadCode(units, false)...)
+	}
+	return errs
+}
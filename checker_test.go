@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func parseClass(t *testing.T, code string) *ClassNode {
+	t.Helper()
+	reader := bufio.NewReader(strings.NewReader(code))
+	pt := NewPasreTree(NewTokenizer(reader))
+	root, err := pt.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected parse error: %v", err)
+	}
+	return root.(*ClassNode)
+}
+
+func TestCheckProgram(t *testing.T) {
+	point := `class Point {
+		field int x, y;
+		constructor Point new(int ax, int ay) { let x = ax; let y = ay; return this; }
+		method int getX() { return x; }
+		function int zero() { return 0; }
+	}`
+
+	testCases := []struct {
+		name    string
+		code    string
+		errsLen int
+	}{
+		{"Valid calls", `class Main {
+			function void main() {
+				var Point p;
+				let p = Point.new(1, 2);
+				do Output.printInt(p.getX() + Point.zero());
+				do Main.helper();
+				return;
+			}
+			function void helper() { return; }
+		}`, 0},
+		{"Unknown subroutine", `class Main {
+			function void main() { do Main.foo(); return; }
+		}`, 1},
+		{"Unknown unqualified subroutine", `class Main {
+			method void main() { do foo(); return; }
+		}`, 1},
+		{"Wrong arg count", `class Main {
+			function void main() { do Point.new(1); do Math.abs(1, 2); return; }
+		}`, 2},
+		{"Unknown class", `class Main {
+			function void main() { do Foo.bar(); return; }
+		}`, 1},
+		{"Method through class name", `class Main {
+			function void main() { do Output.printInt(Point.getX()); return; }
+		}`, 1},
+		{"Function through variable", `class Main {
+			function void main() { var Point p; do p.zero(); return; }
+		}`, 1},
+		{"Call on primitive", `class Main {
+			function void main() { var int a; do a.foo(); return; }
+		}`, 1},
+		{"Fields and this in methods", `class Main {
+			field Point p;
+			constructor Main new() { let p = Point.new(1, 2); do run(); return this; }
+			method void run() { do Output.printInt(p.getX()); do Main.helper(this); return; }
+			function void helper(Main m) { return; }
+		}`, 0},
+		{"Fields in function", `class Main {
+			field int a;
+			field Point p;
+			function void main() { let a = 1; do Output.printInt(a + p.getX()); return; }
+		}`, 3},
+		{"This in function", `class Main {
+			function Main main() { return this; }
+		}`, 1},
+		{"Method without object in function", `class Main {
+			method void run() { return; }
+			function void main() { do run(); return; }
+		}`, 1},
+		{"Unqualified function call", `class Main {
+			function void helper() { return; }
+			method void run() { do helper(); return; }
+		}`, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			units := map[string]*ClassNode{
+				"Point.jack": parseClass(t, point),
+				"Main.jack":  parseClass(t, tc.code),
+			}
+			errs := CheckProgram(units, CheckOptions{})
+			if len(errs) != tc.errsLen {
+				t.Errorf("Got %d errors %v; want %d", len(errs), errs, tc.errsLen)
+			}
+		})
+	}
+}
+
+func TestCheckRedeclaredClass(t *testing.T) {
+	units := map[string]*ClassNode{
+		"Main.jack":  parseClass(t, "class Main { function void main() { return; } }"),
+		"Other.jack": parseClass(t, "class Main {\n function void bar() { do Main.bar(); return; } }"),
+	}
+	errs := CheckProgram(units, CheckOptions{})
+	// Only the declarations of Other.jack are checked
+	if len(errs) != 2 || errs[0].Code != CodeDuplicateClass || errs[1].Code != CodeClassFileName {
+		t.Errorf("Got errors %v; want the duplicate class and the wrong file name", errs)
+	}
+}
+
+func TestCheckErrorPosition(t *testing.T) {
+	code := "class Main {\n  function void main() {\n    do Foo.bar();\n    return;\n  }\n}"
+	errs := CheckProgram(map[string]*ClassNode{"Main.jack": parseClass(t, code)}, CheckOptions{})
+	if len(errs) != 1 {
+		t.Fatalf("Got %d errors; want 1", len(errs))
+	}
+	d := errs[0]
+	if d.File != "Main.jack" || d.Line != 3 || d.Col != 8 || d.EndCol != 11 || d.Code != CodeUnknownTarget {
+		t.Errorf("Got %s; want Main.jack:3:8 with end col 11 and code %s", d, CodeUnknownTarget)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"runtime"
 	"strconv"
-	"strings"
 )
 
 type MemSegment string
@@ -31,14 +30,14 @@ func GetSegment(vk VarKind) MemSegment {
 	return vKinds[vk]
 }
 
-var binaryOps = map[string]string{
-	"+": "add",
-	"-": "sub",
-	"&": "and",
-	"|": "or",
-	"=": "eq",
-	">": "gt",
-	"<": "lt",
+var binaryOps = map[string]VmOpcode{
+	"+": VmAdd,
+	"-": VmSub,
+	"&": VmAnd,
+	"|": VmOr,
+	"=": VmEq,
+	">": VmGt,
+	"<": VmLt,
 }
 
 // Operations that should use OS functions
@@ -47,30 +46,75 @@ var sysBinaryOps = map[string]string{
 	"/": "Math.divide",
 }
 
-var unaryOps = map[string]string{
-	"~": "not",
-	"-": "neg",
+var unaryOps = map[string]VmOpcode{
+	"~": VmNot,
+	"-": VmNeg,
+}
+
+// CompatMode sets whose vm code the compiler reproduces
+type CompatMode int
+
+const (
+	CompatNone CompatMode = iota
+	// labels, counters and the order of instructions are the same as the official nand2tetris JackCompiler has
+	CompatReference
+)
+
+func ParseCompatMode(s string) (CompatMode, error) {
+	switch s {
+	case "none":
+		return CompatNone, nil
+	case "reference":
+		return CompatReference, nil
+	}
+	return CompatNone, fmt.Errorf("Unknown compatibility mode \"%s\". Expected none or reference", s)
 }
 
 type Compiler struct {
-	sb         *strings.Builder
+	code       []VmInstr
 	whileCount int
 	ifCount    int
 	Tbl        *SymbolTableList
+	Peephole   *Peephole // optimizes the code after compilation if it is set
+	Compat     CompatMode
+	sbrKind    string            // kind of the compiled subroutine
+	sbrKinds   map[string]string // kinds of the subroutines of the class by their names
 }
 
 func NewCompiler() *Compiler {
 	tblList := NewSymbolTableList()
-	sb := &strings.Builder{}
-	return &Compiler{sb: sb, Tbl: tblList}
+	return &Compiler{Tbl: tblList}
 }
 
-func (c *Compiler) errorf(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args...))
+// errorf stops compilation with an error at the token. The token can be nil
+func (c *Compiler) errorf(tk Token, code string, format string, args ...interface{}) {
+	panic(errorDiag(code, format, args...).At(tk))
 }
 
-func (c *Compiler) error(msg string) {
-	c.errorf("%s", msg)
+// lookup returns the info of the declared variable
+func (c *Compiler) lookup(name Token) VarInfo {
+	vi, ok := c.Tbl.Lookup(name.GetValue())
+	if !ok {
+		c.errorf(name, CodeUndeclaredVar, "A variable named \"%s\" was not declared", name.GetValue())
+	}
+	if vi.Kind == Field {
+		c.needThis(name, "Field "+name.GetValue())
+	}
+	return vi
+}
+
+// needThis stops compilation if the compiled subroutine is a function, as it has no this
+func (c *Compiler) needThis(tk Token, what string) {
+	if c.sbrKind == "function" {
+		c.errorf(tk, CodeNoThis, "%s cannot be used in the function %s", what, c.Tbl.Name())
+	}
+}
+
+// declare adds the variable into the current symbol table
+func (c *Compiler) declare(kind VarKind, vType Token, name Token) {
+	if err := c.Tbl.Current().AddVar(kind, vType.GetValue(), name.GetValue()); err != nil {
+		panic(AsDiagnostic(err).At(name))
+	}
 }
 
 func (c *Compiler) recover(errp *error) {
@@ -86,71 +130,126 @@ func (c *Compiler) recover(errp *error) {
 func (c *Compiler) Run(root Node) (err error) {
 	defer c.recover(&err)
 	root.Compile(c)
+	if c.Peephole != nil {
+		c.code = c.Peephole.Optimize(c.code)
+	}
 	return
 }
 
+// Code returns the compiled instructions
+func (c *Compiler) Code() []VmInstr {
+	return c.code
+}
+
 func (c *Compiler) String() string {
-	return c.sb.String()
+	return FormatVm(c.code)
 }
 
-func (c *Compiler) Push(segm MemSegment, offset string) {
-	c.sb.WriteString("push " + string(segm) + " " + offset + "\n")
+func (c *Compiler) emit(vi VmInstr) {
+	c.code = append(c.code, vi)
 }
 
-func (c *Compiler) Pop(segm MemSegment, offset string) {
-	c.sb.WriteString("pop " + string(segm) + " " + offset + "\n")
+// intConst returns the value of the integer constant
+func (c *Compiler) intConst(tk Token) int {
+	v, err := strconv.Atoi(tk.GetValue())
+	if err != nil {
+		c.errorf(tk, CodeCompile, "Wrong integer constant %s", tk.GetValue())
+	}
+	return v
 }
 
-func (c *Compiler) Function(name string, localVarCount int) {
-	c.sb.WriteString("function " + name + " " + strconv.Itoa(localVarCount) + "\n")
+func (c *Compiler) Push(segm MemSegment, index int) {
+	c.emit(VmInstr{Op: VmPush, Segm: segm, Index: index})
+}
+
+func (c *Compiler) Pop(segm MemSegment, index int) {
+	c.emit(VmInstr{Op: VmPop, Segm: segm, Index: index})
+}
+
+// Function starts the function of the subroutine kind: constructor, function or method
+func (c *Compiler) Function(name string, kind string, localVarCount int) {
+	c.emit(VmInstr{Op: VmFunction, Name: name, Kind: kind, Index: localVarCount})
 }
 
 func (c *Compiler) Call(name string, argsCount int) {
-	c.sb.WriteString("call " + name + " " + strconv.Itoa(argsCount) + "\n")
+	c.emit(VmInstr{Op: VmCall, Name: name, Index: argsCount})
 }
 
 func (c *Compiler) Return() {
-	c.sb.WriteString("return\n")
+	c.emit(VmInstr{Op: VmReturn})
 }
 
 func (c *Compiler) BinaryOp(symbol string) {
-	if cmd, ok := binaryOps[symbol]; ok {
-		c.sb.WriteString(cmd + "\n")
+	if op, ok := binaryOps[symbol]; ok {
+		c.emit(VmInstr{Op: op})
 	} else if sf, ok := sysBinaryOps[symbol]; ok {
 		c.Call(sf, 2)
 	} else {
-		c.error("Undefined binary op")
+		c.errorf(nil, CodeCompile, "Undefined binary op %s", symbol)
 	}
 }
 
+// arrayAddress pushes the address of the array element. The reference compiler pushes the index first
+func (c *Compiler) arrayAddress(arr VarInfo, idx *ExpressionNode) {
+	if c.Compat == CompatReference {
+		idx.Compile(c)
+		c.Push(GetSegment(arr.Kind), arr.Offset)
+	} else {
+		c.Push(GetSegment(arr.Kind), arr.Offset)
+		idx.Compile(c)
+	}
+	c.BinaryOp("+")
+}
+
 func (c *Compiler) UnaryOp(symbol string) {
-	if cmd, ok := unaryOps[symbol]; ok {
-		c.sb.WriteString(cmd + "\n")
+	if op, ok := unaryOps[symbol]; ok {
+		c.emit(VmInstr{Op: op})
 	} else {
-		c.error("Undefined unary op")
+		c.errorf(nil, CodeCompile, "Undefined unary op %s", symbol)
 	}
 }
 
 func (c *Compiler) Label(name string) {
-	c.sb.WriteString("label " + name + "\n")
+	c.emit(VmInstr{Op: VmLabel, Name: name})
 }
 
 func (c *Compiler) Goto(label string) {
-	c.sb.WriteString("goto " + label + "\n")
+	c.emit(VmInstr{Op: VmGoto, Name: label})
 }
 
 func (c *Compiler) IfGoto(label string) {
-	c.sb.WriteString("if-goto " + label + "\n")
+	c.emit(VmInstr{Op: VmIfGoto, Name: label})
 }
 
 // OpenWhile returns 2 label names for beginWhile and endWhile
 func (c *Compiler) OpenWhile() (begin, end string) {
+	if c.Compat == CompatReference {
+		begin = "WHILE_EXP" + strconv.Itoa(c.whileCount)
+		end = "WHILE_END" + strconv.Itoa(c.whileCount)
+		c.whileCount++
+		return
+	}
 	begin = "WHILE_BEGIN_" + strconv.Itoa(c.whileCount)
 	end = "WHILE_END_" + strconv.Itoa(c.whileCount)
 	c.whileCount++
 	return
 }
 
+// OpenReferenceIf returns the labels of the reference compiler for the true and false branches and the end
+func (c *Compiler) OpenReferenceIf() (tru, fls, end string) {
+	n := strconv.Itoa(c.ifCount)
+	c.ifCount++
+	return "IF_TRUE" + n, "IF_FALSE" + n, "IF_END" + n
+}
+
+// resetLabels starts label counters of a new subroutine. The reference compiler counts labels per subroutine
+func (c *Compiler) resetLabels() {
+	if c.Compat == CompatReference {
+		c.whileCount = 0
+		c.ifCount = 0
+	}
+}
+
 func (c *Compiler) OpenIf() (els, end string) {
 	els = "ELSE_" + strconv.Itoa(c.ifCount)
 	end = "IF_END_" + strconv.Itoa(c.ifCount)
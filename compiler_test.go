@@ -0,0 +1,270 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompilerCode(t *testing.T) {
+	class := `class Point {
+		field int x;
+		static Array all;
+		constructor Point new(int ax) {
+			let x = ax;
+			return this;
+		}
+		method void set(int i) {
+			let all[i] = x;
+			if (x) { do Output.printInt(-x); }
+			return;
+		}
+	}`
+	comp := NewCompiler()
+	if err := comp.Run(parseClass(t, class)); err != nil {
+		t.Fatalf("Compilation error: %v", err)
+	}
+
+	want := []VmInstr{
+		{Op: VmFunction, Name: "Point.new", Kind: "constructor", Index: 0},
+		{Op: VmPush, Segm: ConstSegm, Index: 1},
+		{Op: VmCall, Name: "Memory.alloc", Index: 1},
+		{Op: VmPop, Segm: PointerSegm, Index: 0},
+		{Op: VmPush, Segm: ArgSegm, Index: 0},
+		{Op: VmPop, Segm: ThisSegm, Index: 0},
+		{Op: VmPush, Segm: PointerSegm, Index: 0},
+		{Op: VmReturn},
+
+		{Op: VmFunction, Name: "Point.set", Kind: "method", Index: 0},
+		{Op: VmPush, Segm: ArgSegm, Index: 0},
+		{Op: VmPop, Segm: PointerSegm, Index: 0},
+		{Op: VmPush, Segm: StaticSegm, Index: 0},
+		{Op: VmPush, Segm: ArgSegm, Index: 1},
+		{Op: VmAdd},
+		{Op: VmPush, Segm: ThisSegm, Index: 0},
+		{Op: VmPop, Segm: TempSegm, Index: 0},
+		{Op: VmPop, Segm: PointerSegm, Index: 1},
+		{Op: VmPush, Segm: TempSegm, Index: 0},
+		{Op: VmPop, Segm: ThatSegm, Index: 0},
+		{Op: VmPush, Segm: ThisSegm, Index: 0},
+		{Op: VmNot},
+		{Op: VmIfGoto, Name: "IF_END_0"},
+		{Op: VmPush, Segm: ThisSegm, Index: 0},
+		{Op: VmNeg},
+		{Op: VmCall, Name: "Output.printInt", Index: 1},
+		{Op: VmPop, Segm: TempSegm, Index: 0},
+		{Op: VmLabel, Name: "IF_END_0"},
+		{Op: VmPush, Segm: ConstSegm, Index: 0},
+		{Op: VmReturn},
+	}
+	if got := comp.Code(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got:\n%s\nwant:\n%s", FormatVm(got), FormatVm(want))
+	}
+}
+
+func TestWriteVm(t *testing.T) {
+	code := []VmInstr{
+		{Op: VmFunction, Name: "Main.main", Kind: "function", Index: 2},
+		{Op: VmPush, Segm: LocalSegm, Index: 1},
+		{Op: VmLabel, Name: "L"},
+		{Op: VmIfGoto, Name: "L"},
+		{Op: VmCall, Name: "Math.abs", Index: 1},
+		{Op: VmLt},
+		{Op: VmReturn},
+	}
+	text := FormatVm(code)
+	want := "function Main.main 2\npush local 1\nlabel L\nif-goto L\ncall Math.abs 1\nlt\nreturn\n"
+	if text != want {
+		t.Fatalf("Got:\n%s\nwant:\n%s", text, want)
+	}
+
+	// The text is parsed back into the same code without the metadata of the compiler
+	parsed, err := ParseVm("Main", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range parsed {
+		parsed[i].File, parsed[i].Line = "", 0
+	}
+	code[0].Kind = ""
+	if !reflect.DeepEqual(parsed, code) {
+		t.Errorf("Got %v; want %v", parsed, code)
+	}
+}
+
+func TestTranslateCompiledCode(t *testing.T) {
+	comp := NewCompiler()
+	class := "class Main { function int main() { var int i; while (i < 3) { let i = i + 1; } return i; } }"
+	if err := comp.Run(parseClass(t, class)); err != nil {
+		t.Fatalf("Compilation error: %v", err)
+	}
+
+	fromText, fromCode := NewVmTranslator(false), NewVmTranslator(false)
+	if err := fromText.Translate("Main", comp.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := fromCode.TranslateInstrs("Main", comp.Code()); err != nil {
+		t.Fatal(err)
+	}
+	if fromCode.String() != fromText.String() || !strings.Contains(fromCode.String(), "(Main.main$WHILE_END_0)") {
+		t.Errorf("Got asm:\n%s", fromCode.String())
+	}
+
+	bad := []VmInstr{{Op: VmPop, Segm: ConstSegm, Index: 0, Line: 7}}
+	if err := NewVmTranslator(false).TranslateInstrs("Main", bad); err == nil {
+		t.Error("Expected error for pop constant")
+	}
+}
+
+func TestCompilerContextErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"Field in function", `class Main {
+			field int a;
+			function int main() { return a; }
+		}`, "3:33: error[E0306]: Field a cannot be used in the function Main.main"},
+		{"Field assigned in function", `class Main {
+			field int a;
+			function void main() { let a = 1; return; }
+		}`, "3:31: error[E0306]: Field a cannot be used in the function Main.main"},
+		{"Method on field in function", `class Main {
+			field Main m;
+			function void main() { do m.run(); return; }
+			method void run() { return; }
+		}`, "3:30: error[E0306]: Field m cannot be used in the function Main.main"},
+		{"This in function", `class Main {
+			function Main main() { return this; }
+		}`, "2:34: error[E0306]: this cannot be used in the function Main.main"},
+		{"Method in function", `class Main {
+			function void main() { do run(); return; }
+			method void run() { return; }
+		}`, "2:30: error[E0306]: Method Main.run cannot be used in the function Main.main"},
+		{"Unqualified function", `class Main {
+			method void run() { do helper(); return; }
+			function void helper() { return; }
+		}`, "2:27: error[E0304]: Main.helper is a function and must be called as Main.helper"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewCompiler().Run(parseClass(t, tc.code))
+			if err == nil {
+				t.Fatalf("Got no error; want %s", tc.want)
+			}
+			if err.Error() != tc.want {
+				t.Errorf("Got %s; want %s", err.Error(), tc.want)
+			}
+		})
+	}
+}
+
+func TestCompilerReferenceCompat(t *testing.T) {
+	class := `class Main {
+		function void main() {
+			var Array a;
+			var int i;
+			let a = Array.new(2);
+			let a[i] = a[1];
+			if (i) {
+				while (i < 2) {
+					if (i = 1) { do Output.printString("ok"); }
+					let i = i + 1;
+				}
+			} else {
+				let i = -1;
+			}
+			return;
+		}
+		function int one() {
+			while (true) { if (false) { return 0; } }
+			return 1;
+		}
+	}`
+	want := `function Main.main 2
+push constant 2
+call Array.new 1
+pop local 0
+push local 1
+push local 0
+add
+push constant 1
+push local 0
+add
+pop pointer 1
+push that 0
+pop temp 0
+pop pointer 1
+push temp 0
+pop that 0
+push local 1
+if-goto IF_TRUE0
+goto IF_FALSE0
+label IF_TRUE0
+label WHILE_EXP0
+push local 1
+push constant 2
+lt
+not
+if-goto WHILE_END0
+push local 1
+push constant 1
+eq
+if-goto IF_TRUE1
+goto IF_FALSE1
+label IF_TRUE1
+push constant 2
+call String.new 1
+push constant 111
+call String.appendChar 2
+push constant 107
+call String.appendChar 2
+call Output.printString 1
+pop temp 0
+label IF_FALSE1
+push local 1
+push constant 1
+add
+pop local 1
+goto WHILE_EXP0
+label WHILE_END0
+goto IF_END0
+label IF_FALSE0
+push constant 1
+neg
+pop local 1
+label IF_END0
+push constant 0
+return
+function Main.one 0
+label WHILE_EXP0
+push constant 0
+not
+not
+if-goto WHILE_END0
+push constant 0
+if-goto IF_TRUE0
+goto IF_FALSE0
+label IF_TRUE0
+push constant 0
+return
+label IF_FALSE0
+goto WHILE_EXP0
+label WHILE_END0
+push constant 1
+return
+`
+	comp := NewCompiler()
+	comp.Compat = CompatReference
+	if err := comp.Run(parseClass(t, class)); err != nil {
+		t.Fatalf("Compilation error: %v", err)
+	}
+	if got := comp.String(); got != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := ParseCompatMode("official"); err == nil {
+		t.Error("Got no error for an unknown mode")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeadCodeMode sets what is done with the code that is never executed
+type DeadCodeMode int
+
+const (
+	DeadCodeOff DeadCodeMode = iota
+	// unreachable statements and uncalled subroutines are reported
+	DeadCodeWarn
+	// they are also removed from the generated code
+	DeadCodeStrip
+)
+
+func ParseDeadCodeMode(s string) (DeadCodeMode, error) {
+	switch s {
+	case "off":
+		return DeadCodeOff, nil
+	case "warn":
+		return DeadCodeWarn, nil
+	case "strip":
+		return DeadCodeStrip, nil
+	}
+	return DeadCodeOff, fmt.Errorf("Unknown dead code mode \"%s\". Expected off, warn or strip", s)
+}
+
+// Entry points of a program
+var programRoots = []string{"Main.main", "Sys.init"}
+
+// deadCode finds the code that is never executed. Jack has no break, so the statements after
+// return or while (true) are unreachable. Subroutines are reachable from the program roots
+type deadCode struct {
+	strip bool
+	Tbl   *SymbolTableList
+	file  string
+	class string
+	calls map[string][]string // called subroutines by the caller, e.g. Main.main: [Output.printInt]
+	sbrs  map[string]bool     // all the subroutines of the user classes
+	warns DiagnosticList
+}
+
+func newDeadCode(strip bool) *deadCode {
+	return &deadCode{strip: strip, calls: make(map[string][]string), sbrs: make(map[string]bool)}
+}
+
+func (dc *deadCode) warnf(tk Token, code string, format string, args ...interface{}) {
+	d := NewDiagnostic(SeverityWarning, code, format, args...).At(tk)
+	d.File = dc.file
+	dc.warns = append(dc.warns, d)
+}
+
+// FindDeadCode reports unreachable statements and subroutines that are never called from
+// Main.main or Sys.init. If strip is set, they are removed from the trees.
+// The keys of units are file names
+func FindDeadCode(units map[string]*ClassNode, strip bool) DiagnosticList {
+	files := make([]string, 0, len(units))
+	for f := range units {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	dc := newDeadCode(strip)
+	for _, f := range files {
+		dc.visitClass(f, units[f])
+	}
+
+	called := dc.reachable()
+	if called == nil {
+		return dc.warns
+	}
+	for _, f := range files {
+		cn := units[f]
+		if _, isOS := osClasses[cn.Name.GetValue()]; isOS {
+			continue
+		}
+		dc.file = f
+		var live []*SubroutineDecNode
+		for _, sbr := range cn.SbrDec {
+			name := cn.Name.GetValue() + "." + sbr.Name.GetValue()
+			if called[name] {
+				live = append(live, sbr)
+				continue
+			}
+			dc.warnf(sbr.Name, CodeUncalledSbr, "Subroutine %s is never called", name)
+		}
+		if strip {
+			cn.SbrDec = live
+		}
+	}
+	return dc.warns
+}
+
+// StripDeadCode removes unreachable statements and uncalled subroutines from the trees
+func StripDeadCode(units map[string]*ClassNode) {
+	FindDeadCode(units, true)
+}
+
+func (dc *deadCode) visitClass(file string, cn *ClassNode) {
+	dc.file = file
+	dc.class = cn.Name.GetValue()
+	dc.Tbl = NewSymbolTableList()
+	dc.Tbl.CreateTable(dc.class)
+	defer dc.Tbl.CloseTable()
+	declareClassVars(dc.Tbl, cn)
+
+	for _, sbr := range cn.SbrDec {
+		name := dc.class + "." + sbr.Name.GetValue()
+		dc.sbrs[name] = true
+		dc.Tbl.CreateTable(name)
+		declareSubroutineVars(dc.Tbl, dc.class, sbr)
+		dc.block(name, sbr.Body.Statm)
+		dc.Tbl.CloseTable()
+	}
+}
+
+// reachable returns the subroutines called from the roots. Subroutines of classes named as
+// OS classes are roots too as OS code can call them. Nil is returned if there are no roots
+func (dc *deadCode) reachable() map[string]bool {
+	var queue []string
+	for name := range dc.sbrs {
+		if _, isOS := osClasses[className(name)]; isOS {
+			queue = append(queue, name)
+		}
+	}
+	for _, r := range programRoots {
+		if dc.sbrs[r] {
+			queue = append(queue, r)
+		}
+	}
+	if len(queue) == 0 {
+		return nil
+	}
+
+	called := make(map[string]bool)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if called[name] {
+			continue
+		}
+		called[name] = true
+		queue = append(queue, dc.calls[name]...)
+	}
+	return called
+}
+
+// className returns the class of the full subroutine name, e.g. Main of Main.main
+func className(sbrName string) string {
+	if i := strings.Index(sbrName, "."); i >= 0 {
+		return sbrName[:i]
+	}
+	return sbrName
+}
+
+// block analyses the statements and removes the dead ones if strip is set
+func (dc *deadCode) block(caller string, sn *StatementsNode) bool {
+	if sn == nil {
+		return false
+	}
+	live, terminated := dc.statements(caller, sn)
+	if dc.strip {
+		sn.StList = live
+	}
+	return terminated
+}
+
+// statements returns the reachable statements of the list and reports whether
+// the control never goes past them. Branches with constant conditions are inlined
+func (dc *deadCode) statements(caller string, sn *StatementsNode) (live []Node, terminated bool) {
+	for _, st := range sn.StList {
+		if terminated {
+			dc.warnf(statementToken(st), CodeUnreachable, "Unreachable code")
+			break
+		}
+
+		switch nd := st.(type) {
+		case *IfStatementNode:
+			dc.collectCalls(caller, nd.IfExpr)
+			cond, isConst := nd.IfExpr.constValue()
+			if !isConst {
+				thenEnds := dc.block(caller, nd.IfStat)
+				elseEnds := dc.block(caller, nd.ElseStat)
+				live = append(live, st)
+				terminated = nd.ElseStat != nil && thenEnds && elseEnds
+				continue
+			}
+
+			taken, dead := nd.IfStat, nd.ElseStat
+			if cond == 0 {
+				taken, dead = dead, taken
+			}
+			if dead != nil && len(dead.StList) > 0 {
+				dc.warnf(statementToken(dead.StList[0]), CodeUnreachable,
+					"Unreachable code: the condition of if is always %t", cond != 0)
+			}
+			if taken != nil {
+				var sub []Node
+				sub, terminated = dc.statements(caller, taken)
+				live = append(live, sub...)
+			}
+		case *WhileStatementNode:
+			dc.collectCalls(caller, nd.Expr)
+			cond, isConst := nd.Expr.constValue()
+			if isConst && cond == 0 {
+				if len(nd.Stat.StList) > 0 {
+					dc.warnf(statementToken(nd.Stat.StList[0]), CodeUnreachable,
+						"Unreachable code: the condition of while is always false")
+				}
+				continue
+			}
+			dc.block(caller, nd.Stat)
+			live = append(live, st)
+			terminated = isConst
+		default:
+			dc.collectCalls(caller, st)
+			live = append(live, st)
+			_, terminated = st.(*ReturnStatementNode)
+		}
+	}
+	return live, terminated
+}
+
+// constValue returns the value of the expression if it is a constant
+func (en *ExpressionNode) constValue() (int16, bool) {
+	if len(en.ops) > 0 {
+		return 0, false
+	}
+	return en.term.constValue()
+}
+
+// collectCalls adds the subroutines called in the node to the calls of the caller
+func (dc *deadCode) collectCalls(caller string, n Node) {
+	Inspect(n, func(n Node) bool {
+		call, ok := n.(*SubroutineCallNode)
+		if !ok {
+			return true
+		}
+		target := dc.class
+		if call.Prefix != nil {
+			target = call.Prefix.GetValue()
+			if vi, ok := dc.Tbl.Lookup(target); ok {
+				target = vi.Type
+			}
+		}
+		dc.calls[caller] = append(dc.calls[caller], target+"."+call.SubroutineName.GetValue())
+		return true
+	})
+}
+
+// statementToken returns the token to report the statement at
+func statementToken(st Node) Token {
+	switch nd := st.(type) {
+	case *LetStatementNode:
+		return nd.VarName
+	case *IfStatementNode:
+		return nd.IfExpr.firstToken()
+	case *WhileStatementNode:
+		return nd.Expr.firstToken()
+	case *DoStatementNode:
+		return nd.Call.firstToken()
+	case *ReturnStatementNode:
+		return nd.Keyword
+	}
+	return nil
+}
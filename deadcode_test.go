@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const deadMain = `class Main {
+    function void main() {
+        var Helper h;
+        let h = Helper.new();
+        do h.run();
+        if (false) {
+            do Main.never();
+        }
+        while (false) {
+            do Output.printInt(11);
+        }
+        if (true) {
+            do Output.printInt(2);
+        } else {
+            do Output.printInt(3);
+        }
+        while (true) {
+            do Output.printInt(4);
+            return;
+        }
+        do Output.printInt(5);
+        return;
+    }
+
+    function void never() {
+        return;
+    }
+}
+`
+
+const deadHelper = `class Helper {
+    field int n;
+    constructor Helper new() { return this; }
+
+    method void run() {
+        if (Helper.check()) {
+            return;
+        } else {
+            do Output.printInt(6);
+            return;
+        }
+        do Output.printInt(7);
+        return;
+    }
+
+    function boolean check() { return false; }
+
+    function void unused() { do Helper.alsoUnused(); return; }
+
+    function void alsoUnused() { return; }
+}
+`
+
+func TestFindDeadCode(t *testing.T) {
+	units := map[string]*ClassNode{
+		"Main.jack":   parseClass(t, deadMain),
+		"Helper.jack": parseClass(t, deadHelper),
+		// OS classes written in jack are called by the OS vm code
+		"Memory.jack": parseClass(t, "class Memory { function void init() { return; } }"),
+	}
+	diags := CheckProgram(units, CheckOptions{DeadCode: DeadCodeWarn})
+
+	want := []string{
+		"Helper.jack:12:12: warning[E0901]: Unreachable code",
+		"Main.jack:7:16: warning[E0901]: Unreachable code: the condition of if is always false",
+		"Main.jack:10:16: warning[E0901]: Unreachable code: the condition of while is always false",
+		"Main.jack:15:16: warning[E0901]: Unreachable code: the condition of if is always true",
+		"Main.jack:21:12: warning[E0901]: Unreachable code",
+		"Helper.jack:18:19: warning[E0902]: Subroutine Helper.unused is never called",
+		"Helper.jack:20:19: warning[E0902]: Subroutine Helper.alsoUnused is never called",
+		"Main.jack:25:19: warning[E0902]: Subroutine Main.never is never called",
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("Got %d diagnostics %v; want %d", len(diags), diags, len(want))
+	}
+	for i, d := range diags {
+		if d.Error() != want[i] {
+			t.Errorf("Got %s; want %s", d.Error(), want[i])
+		}
+	}
+
+	if diags := CheckProgram(units, CheckOptions{}); len(diags) != 0 {
+		t.Errorf("Got %v; want no diagnostics if the analysis is off", diags)
+	}
+}
+
+func TestFindDeadCodeWithoutRoots(t *testing.T) {
+	units := map[string]*ClassNode{"Lib.jack": parseClass(t, `class Lib {
+		function int f() { return 1; let x = 2; }
+		function int g() { return 2; }
+	}`)}
+	diags := FindDeadCode(units, false)
+	if len(diags) != 1 || diags[0].Code != CodeUnreachable {
+		t.Errorf("Got %v; want only unreachable code for a library", diags)
+	}
+}
+
+func TestStripDeadCode(t *testing.T) {
+	compile := func(strip bool) (string, string) {
+		units := map[string]*ClassNode{
+			"Main.jack":   parseClass(t, deadMain),
+			"Helper.jack": parseClass(t, deadHelper),
+		}
+		if strip {
+			StripDeadCode(units)
+		}
+
+		emu := NewVmEmulator()
+		jos := NewJackOS(emu)
+		var vm strings.Builder
+		for _, cn := range units {
+			comp := NewCompiler()
+			if err := comp.Run(cn); err != nil {
+				t.Fatalf("Compilation error: %v", err)
+			}
+			vm.WriteString(comp.String())
+			if err := emu.Load(cn.Name.GetValue(), comp.String()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := jos.Boot(); err != nil {
+			t.Fatal(err)
+		}
+		if err := emu.Run(100000); err != nil {
+			t.Fatal(err)
+		}
+		return jos.Text(), vm.String()
+	}
+
+	want, fullVm := compile(false)
+	got, vm := compile(true)
+	if got != want || want != "624" {
+		t.Errorf("Got output %q; want %q", got, want)
+	}
+	for _, dead := range []string{"Main.never", "Helper.unused", "Helper.alsoUnused", "push constant 11\n",
+		"push constant 3\n", "push constant 5\n", "push constant 7\n"} {
+		if !strings.Contains(fullVm, dead) {
+			t.Fatalf("The full code has no %q", dead)
+		}
+		if strings.Contains(vm, dead) {
+			t.Errorf("The stripped code has %q", dead)
+		}
+	}
+	if len(vm) >= len(fullVm) {
+		t.Errorf("The stripped code has %d bytes; want less than %d", len(vm), len(fullVm))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// DeclChecker validates declarations of a class: its name, subroutine signatures
+// and variables. Declared types must be primitive or known classes of the program
+type DeclChecker struct {
+	prog  *ProgramInfo
+	file  string
+	class string
+	errs  DiagnosticList
+}
+
+func NewDeclChecker(prog *ProgramInfo) *DeclChecker {
+	return &DeclChecker{prog: prog}
+}
+
+func (dc *DeclChecker) report(sev Severity, tk Token, code string, format string, args ...interface{}) {
+	d := NewDiagnostic(sev, code, format, args...).At(tk)
+	d.File = dc.file
+	dc.errs = append(dc.errs, d)
+}
+
+// Check returns the declaration errors and warnings of the class
+func (dc *DeclChecker) Check(file string, cn *ClassNode) DiagnosticList {
+	dc.file = file
+	dc.class = cn.Name.GetValue()
+	dc.errs = nil
+
+	if base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)); base != dc.class {
+		dc.report(SeverityError, cn.Name, CodeClassFileName, "Class %s must be declared in the file %s.jack", dc.class, dc.class)
+	}
+
+	classVars := make(map[string]bool)
+	for _, vd := range cn.VarDec {
+		dc.checkType(vd.VarType)
+		for _, n := range vd.Names {
+			dc.declare(classVars, n, "class "+dc.class)
+		}
+	}
+
+	sbrs := make(map[string]bool)
+	for _, sbr := range cn.SbrDec {
+		name := sbr.Name.GetValue()
+		if sbrs[name] {
+			dc.report(SeverityError, sbr.Name, CodeDuplicateSbr, "Subroutine %s.%s is already declared", dc.class, name)
+		}
+		sbrs[name] = true
+		dc.checkSubroutine(sbr, classVars)
+	}
+	return dc.errs
+}
+
+func (dc *DeclChecker) checkSubroutine(sbr *SubroutineDecNode, classVars map[string]bool) {
+	fullName := dc.class + "." + sbr.Name.GetValue()
+	if sbr.SbrKind.GetValue() == "constructor" && sbr.ReturnType.GetValue() != dc.class {
+		dc.report(SeverityError, sbr.ReturnType, CodeConstructorType, "Constructor %s must return %s; got %s",
+			fullName, dc.class, sbr.ReturnType.GetValue())
+	} else if sbr.ReturnType.GetValue() != typeVoid {
+		dc.checkType(sbr.ReturnType)
+	}
+
+	vars := make(map[string]bool)
+	for i, vt := range sbr.ParamList.varTypes {
+		dc.checkType(vt)
+		dc.declare(vars, sbr.ParamList.varNames[i], fullName)
+	}
+	for _, vd := range sbr.Body.VarDec {
+		dc.checkType(vd.VarType)
+		for _, id := range vd.Ids {
+			dc.declare(vars, id, fullName)
+			if classVars[id.GetValue()] {
+				dc.report(SeverityWarning, id, CodeShadowedVar, "Local %s of %s shadows the class variable", id.GetValue(), fullName)
+			}
+		}
+	}
+}
+
+// declare adds the name into the scope and reports it if it is already there
+func (dc *DeclChecker) declare(scope map[string]bool, name Token, scopeName string) {
+	if scope[name.GetValue()] {
+		dc.report(SeverityError, name, CodeRedeclared, "Variable %s is already declared in %s", name.GetValue(), scopeName)
+	}
+	scope[name.GetValue()] = true
+}
+
+func (dc *DeclChecker) checkType(tk Token) {
+	t := tk.GetValue()
+	if isPrimitiveType(t) {
+		return
+	}
+	if _, ok := dc.prog.Class(t); !ok {
+		dc.report(SeverityError, tk, CodeUnknownType, "Unknown type %s", t)
+	}
+}
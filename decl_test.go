@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestDeclCheck(t *testing.T) {
+	code := `class Main {
+		field int a, a;
+		static Foo f;
+		constructor Point new() { return this; }
+		function void run(int x, int x) {
+			var int a, x;
+			var Bar b;
+			return;
+		}
+		method Baz run() { return null; }
+		method String text(Array arr) { return null; }
+	}`
+	root := parseClass(t, code)
+	prog := NewProgramInfo()
+	prog.AddClass("src/Game.jack", root)
+	errs := NewDeclChecker(prog).Check("src/Game.jack", root)
+
+	want := []string{
+		"src/Game.jack:1:7: error[E1001]: Class Main must be declared in the file Main.jack",
+		"src/Game.jack:2:16: error[E0501]: Variable a is already declared in class Main",
+		"src/Game.jack:3:10: error[E1004]: Unknown type Foo",
+		"src/Game.jack:4:15: error[E1003]: Constructor Main.new must return Main; got Point",
+		"src/Game.jack:5:32: error[E0501]: Variable x is already declared in Main.run",
+		"src/Game.jack:6:12: warning[E1005]: Local a of Main.run shadows the class variable",
+		"src/Game.jack:6:15: error[E0501]: Variable x is already declared in Main.run",
+		"src/Game.jack:7:8: error[E1004]: Unknown type Bar",
+		"src/Game.jack:10:14: error[E1002]: Subroutine Main.run is already declared",
+		"src/Game.jack:10:10: error[E1004]: Unknown type Baz",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Got %d diagnostics %v; want %d", len(errs), errs, len(want))
+	}
+	for i, d := range errs {
+		if d.Error() != want[i] {
+			t.Errorf("Got %s; want %s", d.Error(), want[i])
+		}
+	}
+}
+
+func TestDeclCheckValid(t *testing.T) {
+	units := map[string]*ClassNode{
+		"dir/Main.jack": parseClass(t, `class Main {
+			static Point origin;
+			function void main() { var Array a; var String s; let origin = Point.new(0); return; }
+		}`),
+		"dir/Point.jack": parseClass(t, `class Point {
+			field int x;
+			constructor Point new(int x) { return this; }
+			method boolean same(Point other, char c) { return true; }
+		}`),
+	}
+	if errs := CheckProgram(units, CheckOptions{}); len(errs) != 0 {
+		t.Errorf("Got %v; want no diagnostics", errs)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote
+)
+
+var severityNames = map[Severity]string{
+	SeverityError:   "error",
+	SeverityWarning: "warning",
+	SeverityNote:    "note",
+}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+// MarshalText is used to write the severity as a string into json
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Diagnostic codes. The first two digits are the stage that reports the diagnostic
+const (
+	// Tokenizer
+	CodeUndefinedToken  = "E0101"
+	CodeInvalidIdent    = "E0102"
+	CodeInvalidInt      = "E0103"
+	CodeIntRange        = "E0104"
+	CodeUnterminatedStr = "E0105"
+
+	// Parser
+	CodeUnexpectedToken = "E0201"
+	CodeUnexpectedEOF   = "E0202"
+	CodeWrongType       = "E0203"
+	CodeDeclOrder       = "E0204"
+
+	// Whole program checks
+	CodeDuplicateClass = "E0301"
+	CodeUndeclaredSbr  = "E0302"
+	CodeUnknownTarget  = "E0303"
+	CodeWrongCallKind  = "E0304"
+	CodeArgCount       = "E0305"
+	CodeNoThis         = "E0306"
+
+	// Type checks
+	CodeTypeMismatch   = "E0401"
+	CodeVoidValue      = "E0402"
+	CodeReturnMismatch = "E0403"
+
+	// Symbol table
+	CodeRedeclared    = "E0501"
+	CodeUndeclaredVar = "E0502"
+
+	// Compiler
+	CodeCompile = "E0601"
+
+	// Backends
+	CodeVmTranslate = "E0701"
+	CodeAssemble    = "E0702"
+
+	// VM emulator
+	CodeVmParse   = "E0801"
+	CodeVmRuntime = "E0802"
+
+	// Flow analysis
+	CodeUnreachable       = "E0901"
+	CodeUncalledSbr       = "E0902"
+	CodeMissingReturn     = "E0903"
+	CodeConstructorReturn = "E0904"
+	CodeUnusedVar         = "E0905"
+	CodeUninitVar         = "E0906"
+
+	// Declaration checks
+	CodeClassFileName   = "E1001"
+	CodeDuplicateSbr    = "E1002"
+	CodeConstructorType = "E1003"
+	CodeUnknownType     = "E1004"
+	CodeShadowedVar     = "E1005"
+)
+
+// Diagnostic is a positioned message of any compilation stage.
+// Lines and columns start from 1, the end column is exclusive
+type Diagnostic struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Col      int      `json:"column"`
+	EndLine  int      `json:"endLine"`
+	EndCol   int      `json:"endColumn"`
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Msg      string   `json:"message"`
+	Notes    []string `json:"notes,omitempty"`
+}
+
+func NewDiagnostic(sev Severity, code string, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{Severity: sev, Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func errorDiag(code string, format string, args ...interface{}) *Diagnostic {
+	return NewDiagnostic(SeverityError, code, format, args...)
+}
+
+// At sets the span of the diagnostic to the token. Nil token is ignored
+func (d *Diagnostic) At(tk Token) *Diagnostic {
+	if tk == nil {
+		return d
+	}
+	d.Line, d.Col = tk.Line(), tk.Pos()
+	d.EndLine, d.EndCol = d.Line, d.Col+tokenWidth(tk)
+	return d
+}
+
+// AtPos sets the span of the diagnostic to one column
+func (d *Diagnostic) AtPos(line, col int) *Diagnostic {
+	d.Line, d.Col = line, col
+	d.EndLine, d.EndCol = line, col+1
+	return d
+}
+
+func (d *Diagnostic) AddNote(format string, args ...interface{}) *Diagnostic {
+	d.Notes = append(d.Notes, fmt.Sprintf(format, args...))
+	return d
+}
+
+// Error returns the gcc-like form: file:line:col: severity[code]: message
+func (d *Diagnostic) Error() string {
+	sb := strings.Builder{}
+	if d.File != "" {
+		sb.WriteString(d.File)
+		sb.WriteByte(':')
+	}
+	if d.Line > 0 {
+		sb.WriteString(strconv.Itoa(d.Line))
+		sb.WriteByte(':')
+		sb.WriteString(strconv.Itoa(d.Col))
+		sb.WriteByte(':')
+	}
+	if sb.Len() > 0 {
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(d.Severity.String())
+	if d.Code != "" {
+		sb.WriteString("[" + d.Code + "]")
+	}
+	sb.WriteString(": ")
+	sb.WriteString(d.Msg)
+	return sb.String()
+}
+
+// tokenWidth returns the count of source columns of the token
+func tokenWidth(tk Token) int {
+	w := len(tk.GetValue())
+	if tk.Type() == TokenStringConst {
+		w += 2 // quotes
+	}
+	if w == 0 {
+		w = 1
+	}
+	return w
+}
+
+// DiagnosticList is a list of diagnostics found in one pass
+type DiagnosticList []*Diagnostic
+
+func (dl DiagnosticList) Error() string {
+	msgs := make([]string, len(dl))
+	for i, d := range dl {
+		msgs[i] = d.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns nil if there are no errors in the list
+func (dl DiagnosticList) Err() error {
+	if !dl.HasErrors() {
+		return nil
+	}
+	return dl
+}
+
+func (dl DiagnosticList) HasErrors() bool {
+	for _, d := range dl {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFile sets the file for diagnostics that do not have it
+func (dl DiagnosticList) SetFile(file string) {
+	for _, d := range dl {
+		if d.File == "" {
+			d.File = file
+		}
+	}
+}
+
+// AsDiagnostic converts any error into a diagnostic
+func AsDiagnostic(err error) *Diagnostic {
+	if d, ok := err.(*Diagnostic); ok {
+		return d
+	}
+	return errorDiag("", "%v", err)
+}
+
+// DiagnosticRenderer prints diagnostics with the source line and a caret underline
+type DiagnosticRenderer struct {
+	sources map[string][]string
+}
+
+func NewDiagnosticRenderer() *DiagnosticRenderer {
+	return &DiagnosticRenderer{sources: make(map[string][]string)}
+}
+
+// AddSource registers the text of a file. Files not registered are read from the disk
+func (dr *DiagnosticRenderer) AddSource(file, src string) {
+	dr.sources[file] = strings.Split(src, "\n")
+}
+
+func (dr *DiagnosticRenderer) line(file string, n int) (string, bool) {
+	lines, ok := dr.sources[file]
+	if !ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", false
+		}
+		dr.AddSource(file, string(data))
+		lines = dr.sources[file]
+	}
+	if n < 1 || n > len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[n-1], "\r"), true
+}
+
+// Render writes the diagnostic in the form:
+//
+//	Main.jack:3:8: error[E0303]: Foo is neither a variable nor a known class
+//	    3 |     do Foo.bar();
+//	      |        ^^^
+//	      = note: ...
+func (dr *DiagnosticRenderer) Render(w io.Writer, d *Diagnostic) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	bw.WriteString(d.Error())
+	bw.WriteByte('\n')
+
+	lineNum := strconv.Itoa(d.Line)
+	gutter := strings.Repeat(" ", len(lineNum))
+	if src, ok := dr.line(d.File, d.Line); ok && d.Line > 0 {
+		bw.WriteString(" " + lineNum + " | " + src + "\n")
+		bw.WriteString(" " + gutter + " | " + caretLine(src, d) + "\n")
+	}
+	for _, n := range d.Notes {
+		bw.WriteString(" " + gutter + " = note: " + n + "\n")
+	}
+}
+
+// caretLine underlines the span of the diagnostic. Tabs of the source are kept for alignment
+func caretLine(src string, d *Diagnostic) string {
+	start := d.Col - 1
+	end := d.EndCol - 1
+	if d.EndLine != d.Line || end <= start {
+		end = start + 1
+	}
+	if start > len(src) {
+		start = len(src)
+	}
+
+	sb := strings.Builder{}
+	for i := 0; i < start; i++ {
+		if src[i] == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteString(strings.Repeat("^", end-start))
+	return sb.String()
+}
+
+// DiagnosticPrinter writes diagnostics in some output format
+type DiagnosticPrinter interface {
+	Print(d *Diagnostic)
+}
+
+// TextPrinter writes diagnostics for humans with source lines
+type TextPrinter struct {
+	w  io.Writer
+	dr *DiagnosticRenderer
+}
+
+func NewTextPrinter(w io.Writer) *TextPrinter {
+	return &TextPrinter{w, NewDiagnosticRenderer()}
+}
+
+func (tp *TextPrinter) Print(d *Diagnostic) {
+	tp.dr.Render(tp.w, d)
+}
+
+// JSONPrinter writes every diagnostic as a json object on its own line
+type JSONPrinter struct {
+	enc *json.Encoder
+}
+
+func NewJSONPrinter(w io.Writer) *JSONPrinter {
+	return &JSONPrinter{json.NewEncoder(w)}
+}
+
+func (jp *JSONPrinter) Print(d *Diagnostic) {
+	jp.enc.Encode(d)
+}
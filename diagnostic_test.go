@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnosticError(t *testing.T) {
+	testCases := []struct {
+		name string
+		d    *Diagnostic
+		want string
+	}{
+		{
+			"Full",
+			&Diagnostic{File: "Main.jack", Line: 3, Col: 8, Code: CodeUnknownTarget, Msg: "msg"},
+			"Main.jack:3:8: error[E0303]: msg",
+		},
+		{
+			"Warning without code",
+			&Diagnostic{File: "Main.jack", Line: 1, Col: 1, Severity: SeverityWarning, Msg: "msg"},
+			"Main.jack:1:1: warning: msg",
+		},
+		{"No position", &Diagnostic{Msg: "msg"}, "error: msg"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.d.Error(); got != tc.want {
+				t.Errorf("Got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiagnosticSpan(t *testing.T) {
+	d := errorDiag(CodeUnexpectedToken, "msg").At(NewStringConstantToken("abc", 2, 5))
+	if d.Line != 2 || d.Col != 5 || d.EndLine != 2 || d.EndCol != 10 {
+		t.Errorf("Got span %d:%d-%d:%d; want 2:5-2:10", d.Line, d.Col, d.EndLine, d.EndCol)
+	}
+}
+
+func TestRender(t *testing.T) {
+	dr := NewDiagnosticRenderer()
+	dr.AddSource("Main.jack", "class Main {\n\tdo Foo.bar();\n}")
+
+	d := errorDiag(CodeUnknownTarget, "Foo is unknown").At(NewIdentifierToken("Foo", 2, 5))
+	d.File = "Main.jack"
+	d.AddNote("declare the class Foo")
+
+	sb := &strings.Builder{}
+	dr.Render(sb, d)
+	want := "Main.jack:2:5: error[E0303]: Foo is unknown\n" +
+		" 2 | \tdo Foo.bar();\n" +
+		"   | \t   ^^^\n" +
+		"   = note: declare the class Foo\n"
+	if got := sb.String(); got != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestJSONPrinter(t *testing.T) {
+	d := errorDiag(CodeUnknownTarget, "Foo is unknown").At(NewIdentifierToken("Foo", 2, 5))
+	d.File = "Main.jack"
+
+	sb := &strings.Builder{}
+	NewJSONPrinter(sb).Print(d)
+	NewJSONPrinter(sb).Print(&Diagnostic{Severity: SeverityWarning, Msg: "w"})
+
+	want := `{"file":"Main.jack","line":2,"column":5,"endLine":2,"endColumn":8,"severity":"error","code":"E0303","message":"Foo is unknown"}` + "\n" +
+		`{"file":"","line":0,"column":0,"endLine":0,"endColumn":0,"severity":"warning","message":"w"}` + "\n"
+	if got := sb.String(); got != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+// docComment returns the text of the /** */ comment right before the token.
+// The tokenizer must keep trivia, otherwise there are no comments
+func docComment(tk Token) string {
+	if tk == nil || tk.Trivia() == nil {
+		return ""
+	}
+	lead := strings.TrimSpace(tk.Trivia().Leading)
+	start := strings.LastIndex(lead, "/**")
+	if start < 0 || !strings.HasSuffix(lead, "*/") || len(lead)-start < len("/***/") {
+		return ""
+	}
+	body := lead[start+len("/**") : len(lead)-len("*/")]
+	if strings.Contains(body, "*/") {
+		return ""
+	}
+
+	var lines []string
+	for _, l := range strings.Split(body, "\n") {
+		l = strings.TrimSpace(l)
+		l = strings.TrimPrefix(l, "*")
+		lines = append(lines, strings.TrimPrefix(l, " "))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// docVar is a field or a static variable of the class
+type docVar struct {
+	varType string
+	name    string
+}
+
+type docSbr struct {
+	signature string
+	doc       string
+}
+
+// docClass is the API of a class in the order of the source
+type docClass struct {
+	name    string
+	doc     string
+	fields  []docVar
+	statics []docVar
+	sbrs    []docSbr
+}
+
+type docVarGroup struct {
+	title string
+	list  []docVar
+}
+
+func (dc docClass) varGroups() []docVarGroup {
+	return []docVarGroup{{"Fields", dc.fields}, {"Statics", dc.statics}}
+}
+
+func newDocClass(cn *ClassNode) docClass {
+	dc := docClass{name: cn.Name.GetValue(), doc: cn.Doc}
+	for _, vd := range cn.VarDec {
+		for _, name := range vd.Names {
+			v := docVar{vd.VarType.GetValue(), name.GetValue()}
+			if vd.Kind.GetValue() == "field" {
+				dc.fields = append(dc.fields, v)
+			} else {
+				dc.statics = append(dc.statics, v)
+			}
+		}
+	}
+	for _, sdn := range cn.SbrDec {
+		dc.sbrs = append(dc.sbrs, docSbr{docSignature(sdn), sdn.Doc})
+	}
+	return dc
+}
+
+// docSignature returns the declaration of the subroutine with the parameter names,
+// e.g. "function int max(int a, int b)"
+func docSignature(sdn *SubroutineDecNode) string {
+	params := make([]string, len(sdn.ParamList.varTypes))
+	for i, vt := range sdn.ParamList.varTypes {
+		params[i] = vt.GetValue() + " " + sdn.ParamList.varNames[i].GetValue()
+	}
+	return fmt.Sprintf("%s %s %s(%s)", sdn.SbrKind.GetValue(), sdn.ReturnType.GetValue(),
+		sdn.Name.GetValue(), strings.Join(params, ", "))
+}
+
+func docClasses(classes []*ClassNode) []docClass {
+	dcs := make([]docClass, len(classes))
+	for i, cn := range classes {
+		dcs[i] = newDocClass(cn)
+	}
+	sort.Slice(dcs, func(i, j int) bool { return dcs[i].name < dcs[j].name })
+	return dcs
+}
+
+// WriteMarkdownDoc writes the API of the classes sorted by name
+func WriteMarkdownDoc(w io.Writer, classes []*ClassNode) error {
+	sb := strings.Builder{}
+	sb.WriteString("# API\n")
+	for _, dc := range docClasses(classes) {
+		fmt.Fprintf(&sb, "\n## %s\n", dc.name)
+		if dc.doc != "" {
+			fmt.Fprintf(&sb, "\n%s\n", dc.doc)
+		}
+		for _, vars := range dc.varGroups() {
+			if len(vars.list) == 0 {
+				continue
+			}
+			fmt.Fprintf(&sb, "\n### %s\n\n", vars.title)
+			for _, v := range vars.list {
+				fmt.Fprintf(&sb, "- `%s %s`\n", v.varType, v.name)
+			}
+		}
+		if len(dc.sbrs) > 0 {
+			sb.WriteString("\n### Subroutines\n")
+		}
+		for _, s := range dc.sbrs {
+			fmt.Fprintf(&sb, "\n#### `%s`\n", s.signature)
+			if s.doc != "" {
+				fmt.Fprintf(&sb, "\n%s\n", s.doc)
+			}
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteHTMLDoc writes the API of the classes sorted by name as a html page
+func WriteHTMLDoc(w io.Writer, classes []*ClassNode) error {
+	dcs := docClasses(classes)
+	sb := strings.Builder{}
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>API</title>\n</head>\n<body>\n<h1>API</h1>\n<ul>\n")
+	for _, dc := range dcs {
+		fmt.Fprintf(&sb, "<li><a href=\"#%[1]s\">%[1]s</a></li>\n", html.EscapeString(dc.name))
+	}
+	sb.WriteString("</ul>\n")
+
+	for _, dc := range dcs {
+		fmt.Fprintf(&sb, "<h2 id=\"%[1]s\">%[1]s</h2>\n", html.EscapeString(dc.name))
+		writeHTMLText(&sb, dc.doc)
+		for _, vars := range dc.varGroups() {
+			if len(vars.list) == 0 {
+				continue
+			}
+			fmt.Fprintf(&sb, "<h3>%s</h3>\n<ul>\n", vars.title)
+			for _, v := range vars.list {
+				fmt.Fprintf(&sb, "<li><code>%s %s</code></li>\n", html.EscapeString(v.varType), html.EscapeString(v.name))
+			}
+			sb.WriteString("</ul>\n")
+		}
+		if len(dc.sbrs) > 0 {
+			sb.WriteString("<h3>Subroutines</h3>\n")
+		}
+		for _, s := range dc.sbrs {
+			fmt.Fprintf(&sb, "<h4><code>%s</code></h4>\n", html.EscapeString(s.signature))
+			writeHTMLText(&sb, s.doc)
+		}
+	}
+	sb.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeHTMLText writes the paragraphs of the doc comment. They are separated by empty lines
+func writeHTMLText(sb *strings.Builder, doc string) {
+	if doc == "" {
+		return
+	}
+	for _, p := range strings.Split(doc, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			fmt.Fprintf(sb, "<p>%s</p>\n", html.EscapeString(p))
+		}
+	}
+}
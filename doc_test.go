@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+const docPoint = `// Point.jack
+/**
+ * A point on the screen.
+ *
+ * Coordinates are in pixels.
+ */
+class Point {
+    field int x, y;
+    static int count;
+
+    /** Creates the point <x, y>. */
+    constructor Point new(int ax, int ay) {
+        let x = ax;
+        let y = ay;
+        return this;
+    }
+
+    /* not a doc comment */
+    method int getX() { return x; }
+
+    /** Disposes
+      * the point. */
+    // note
+    method void dispose() { return; }
+
+    /** Returns the count */ function int count() { return count; }
+}
+`
+
+func parseDocClass(t *testing.T, src string) *ClassNode {
+	t.Helper()
+	tz := NewTokenizer(bufio.NewReader(strings.NewReader(src)))
+	tz.KeepTrivia = true
+	pt := NewPasreTree(tz)
+	root, err := pt.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return root.(*ClassNode)
+}
+
+func TestDocComments(t *testing.T) {
+	cn := parseDocClass(t, docPoint)
+	if want := "A point on the screen.\n\nCoordinates are in pixels."; cn.Doc != want {
+		t.Errorf("Got class doc %q; want %q", cn.Doc, want)
+	}
+
+	want := []string{"Creates the point <x, y>.", "", "", "Returns the count"}
+	for i, sdn := range cn.SbrDec {
+		if sdn.Doc != want[i] {
+			t.Errorf("%s: got doc %q; want %q", sdn.Name.GetValue(), sdn.Doc, want[i])
+		}
+	}
+
+	// Without trivia the comments are lost
+	pt := NewPasreTree(NewTokenizer(bufio.NewReader(strings.NewReader(docPoint))))
+	root, _ := pt.Parse()
+	if doc := root.(*ClassNode).Doc; doc != "" {
+		t.Errorf("Got doc %q; want none", doc)
+	}
+}
+
+func TestMarkdownDoc(t *testing.T) {
+	main := parseDocClass(t, "class Main { function void main() { return; } }")
+	sb := &strings.Builder{}
+	if err := WriteMarkdownDoc(sb, []*ClassNode{parseDocClass(t, docPoint), main}); err != nil {
+		t.Fatal(err)
+	}
+	want := "# API\n" +
+		"\n## Main\n" +
+		"\n### Subroutines\n" +
+		"\n#### `function void main()`\n" +
+		"\n## Point\n" +
+		"\nA point on the screen.\n\nCoordinates are in pixels.\n" +
+		"\n### Fields\n\n- `int x`\n- `int y`\n" +
+		"\n### Statics\n\n- `int count`\n" +
+		"\n### Subroutines\n" +
+		"\n#### `constructor Point new(int ax, int ay)`\n\nCreates the point <x, y>.\n" +
+		"\n#### `method int getX()`\n" +
+		"\n#### `method void dispose()`\n" +
+		"\n#### `function int count()`\n\nReturns the count\n"
+	if sb.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestHTMLDoc(t *testing.T) {
+	sb := &strings.Builder{}
+	if err := WriteHTMLDoc(sb, []*ClassNode{parseDocClass(t, docPoint)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<li><a href="#Point">Point</a></li>`,
+		`<h2 id="Point">Point</h2>`,
+		"<p>A point on the screen.</p>\n<p>Coordinates are in pixels.</p>",
+		"<h3>Fields</h3>\n<ul>\n<li><code>int x</code></li>\n<li><code>int y</code></li>\n</ul>",
+		"<h4><code>constructor Point new(int ax, int ay)</code></h4>\n<p>Creates the point &lt;x, y&gt;.</p>",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("Html has no %q:\n%s", want, sb.String())
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+// FlowChecker reports subroutines whose control can reach the end of the body.
+// The compiled function has no return there, so the VM runs into the next function
+type FlowChecker struct {
+	file  string
+	class string
+	errs  DiagnosticList
+}
+
+func NewFlowChecker() *FlowChecker {
+	return &FlowChecker{}
+}
+
+func (fc *FlowChecker) report(sev Severity, tk Token, code string, format string, args ...interface{}) {
+	d := NewDiagnostic(sev, code, format, args...).At(tk)
+	d.File = fc.file
+	fc.errs = append(fc.errs, d)
+}
+
+// Check returns the control flow errors and warnings of the class
+func (fc *FlowChecker) Check(file string, cn *ClassNode) DiagnosticList {
+	fc.file = file
+	fc.class = cn.Name.GetValue()
+	fc.errs = nil
+	for _, sbr := range cn.SbrDec {
+		fc.checkSubroutine(sbr)
+	}
+	return fc.errs
+}
+
+func (fc *FlowChecker) checkSubroutine(sbr *SubroutineDecNode) {
+	name := fc.class + "." + sbr.Name.GetValue()
+	if !terminates(sbr.Body.Statm) {
+		if sbr.ReturnType.GetValue() == "void" {
+			fc.report(SeverityWarning, sbr.Name, CodeMissingReturn, "Void subroutine %s has no return at the end", name)
+		} else {
+			fc.report(SeverityError, sbr.Name, CodeMissingReturn, "Not all paths of %s return a value", name)
+		}
+	}
+
+	if sbr.SbrKind.GetValue() != "constructor" {
+		return
+	}
+	Inspect(sbr.Body, func(n Node) bool {
+		rsn, ok := n.(*ReturnStatementNode)
+		if !ok {
+			return true
+		}
+		if rsn.Expr == nil || len(rsn.Expr.ops) > 0 || rsn.Expr.term.termType != termNodeThis {
+			fc.report(SeverityWarning, rsn.Keyword, CodeConstructorReturn, "Constructor %s must return this", name)
+		}
+		return false
+	})
+}
+
+// terminates reports that the control never reaches the end of the statements.
+// Every path returns or loops forever, as Jack has no break
+func terminates(sn *StatementsNode) bool {
+	if sn == nil {
+		return false
+	}
+	for _, st := range sn.StList {
+		if statementTerminates(st) {
+			return true
+		}
+	}
+	return false
+}
+
+func statementTerminates(st Node) bool {
+	switch nd := st.(type) {
+	case *ReturnStatementNode:
+		return true
+	case *IfStatementNode:
+		if v, ok := nd.IfExpr.constValue(); ok {
+			if v != 0 {
+				return terminates(nd.IfStat)
+			}
+			return terminates(nd.ElseStat)
+		}
+		return terminates(nd.IfStat) && terminates(nd.ElseStat)
+	case *WhileStatementNode:
+		v, ok := nd.Expr.constValue()
+		return ok && v != 0
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestFlowCheck(t *testing.T) {
+	code := `class Main {
+		function int a(int x) {
+			if (x > 0) {
+				return 1;
+			}
+		}
+		function int b(int x) {
+			if (x > 0) {
+				return 1;
+			} else {
+				return 2;
+			}
+		}
+		function int c() {
+			while (true) {
+				do Main.b(1);
+			}
+		}
+		function int d() {
+			if (true) {
+				return 1;
+			}
+		}
+		function void e() {
+			do Main.b(1);
+		}
+		constructor Main new() {
+			return 0;
+		}
+		constructor Main make() {
+			let x = 1;
+		}
+		method Main self() {
+			return this;
+		}
+	}`
+	errs := NewFlowChecker().Check("Main.jack", parseClass(t, code))
+
+	want := []string{
+		"Main.jack:2:16: error[E0903]: Not all paths of Main.a return a value",
+		"Main.jack:24:17: warning[E0903]: Void subroutine Main.e has no return at the end",
+		"Main.jack:28:4: warning[E0904]: Constructor Main.new must return this",
+		"Main.jack:30:20: error[E0903]: Not all paths of Main.make return a value",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Got %d diagnostics %v; want %d", len(errs), errs, len(want))
+	}
+	for i, d := range errs {
+		if d.Error() != want[i] {
+			t.Errorf("Got %s; want %s", d.Error(), want[i])
+		}
+	}
+}
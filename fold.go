@@ -0,0 +1,255 @@
+package main
+
+import "strconv"
+
+// FoldConstants simplifies the expressions of the tree. Jack evaluates operators
+// from left to right, so only the start of an expression can be computed, e.g. 2 * 8 + x
+// becomes 16 + x. Constants are computed in 16 bits with wraparound like on the Hack computer.
+// The tree must be checked before, as the folded one can not be checked or printed as source.
+//
+// A rewrite never makes the code longer: x * 2 becomes x + x, but x * 4 still calls
+// Math.multiply as the vm has no dup and every doubling of a computed value costs 4 commands.
+// Division by 2^k is kept: Jack rounds it toward zero and the vm has no shift right
+func FoldConstants(root Node) {
+	Inspect(root, func(n Node) bool {
+		if en, ok := n.(*ExpressionNode); ok {
+			foldExpr(en)
+			return false
+		}
+		return true
+	})
+}
+
+// constValue returns the value of the term if it is known at compile time
+func (tn *TermNode) constValue() (int16, bool) {
+	switch tn.termType {
+	case termNodeIntConst:
+		v, err := strconv.Atoi(tn.val.GetValue())
+		return int16(v), err == nil
+	case termNodeKeyWordConst:
+		if tn.val.GetValue() == "true" {
+			return -1, true
+		}
+		return 0, true
+	case termNodeUnary:
+		if v, ok := tn.unaryTerm.constValue(); ok {
+			return foldUnary(tn.unaryOp.GetValue(), v), true
+		}
+	case termNodeExpr:
+		if len(tn.exp.ops) == 0 {
+			return tn.exp.term.constValue()
+		}
+	}
+	return 0, false
+}
+
+// isPure reports that the term has no calls, so it can be dropped. Division calls
+// Math.divide that fails on zero, so only division by a non-zero constant is pure
+func (tn *TermNode) isPure() bool {
+	pure := true
+	Inspect(tn, func(n Node) bool {
+		switch nd := n.(type) {
+		case *SubroutineCallNode:
+			pure = false
+		case *ExpressionNode:
+			pure = pure && hasSafeDivisors(nd.ops, nd.opTerms)
+		case *TermNode:
+			pure = pure && nd.termType != termNodeStrConst
+		}
+		return pure
+	})
+	return pure
+}
+
+func foldUnary(op string, v int16) int16 {
+	if op == "-" {
+		return -v
+	}
+	return ^v
+}
+
+func boolValue(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// foldBinary computes a op b. Division by zero is left for the runtime
+func foldBinary(op string, a, b int16) (int16, bool) {
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		if b == 0 {
+			return 0, false
+		}
+		return a / b, true
+	case "&":
+		return a & b, true
+	case "|":
+		return a | b, true
+	case "=":
+		return boolValue(a == b), true
+	case "<":
+		return boolValue(a < b), true
+	case ">":
+		return boolValue(a > b), true
+	}
+	return 0, false
+}
+
+// newConstTerm returns the term of the value at the position of the token.
+// Negative values are written with a unary operator as Jack has no negative constants
+func newConstTerm(v int16, at Token) *TermNode {
+	switch {
+	case v >= 0:
+		return NewIntConstTermNode(NewIntegerConstantToken(strconv.Itoa(int(v)), at.Line(), at.Pos()))
+	case v == -32768:
+		return NewUnaryTermNode(NewSymbolToken("~", at.Line(), at.Pos()), newConstTerm(^v, at))
+	}
+	return NewUnaryTermNode(NewSymbolToken("-", at.Line(), at.Pos()), newConstTerm(-v, at))
+}
+
+// isDouble reports that x * v can be written as x + x: the term is pushed
+// by one instruction like the constant of the call
+func isDouble(op string, v int16, x *TermNode) bool {
+	return op == "*" && v == 2 && x.termType == termNodeVar
+}
+
+func foldTerm(tn *TermNode) {
+	switch tn.termType {
+	case termNodeArray:
+		foldExpr(tn.arrayIdx)
+	case termNodeCall:
+		for _, e := range tn.call.Params.Exprs {
+			foldExpr(e)
+		}
+	case termNodeExpr:
+		foldExpr(tn.exp)
+		if len(tn.exp.ops) == 0 {
+			// (x) is x
+			*tn = *tn.exp.term
+		}
+	case termNodeUnary:
+		foldTerm(tn.unaryTerm)
+		ut := tn.unaryTerm
+		if v, ok := ut.constValue(); ok {
+			if ut.termType != termNodeIntConst {
+				*tn = *newConstTerm(foldUnary(tn.unaryOp.GetValue(), v), tn.unaryOp)
+			}
+		} else if ut.termType == termNodeUnary && ut.unaryOp.GetValue() == tn.unaryOp.GetValue() {
+			// ~~x and --x are x
+			*tn = *ut.unaryTerm
+		}
+	}
+}
+
+func foldExpr(en *ExpressionNode) {
+	if en == nil {
+		return
+	}
+	foldTerm(en.term)
+	for _, tn := range en.opTerms {
+		foldTerm(tn)
+	}
+
+	term, ops, terms := en.term, en.ops[:0:0], en.opTerms[:0:0]
+	for i, op := range en.ops {
+		next := en.opTerms[i]
+		a, aConst := term.constValue()
+		b, bConst := next.constValue()
+		aConst = aConst && len(ops) == 0
+		at := term.firstToken()
+		if len(ops) > 0 {
+			at = en.term.firstToken()
+		}
+
+		if aConst && bConst {
+			if v, ok := foldBinary(op.GetValue(), a, b); ok {
+				term = newConstTerm(v, at)
+				continue
+			}
+		}
+		if bConst {
+			if drop, zero := identity(op.GetValue(), b); drop {
+				continue
+			} else if zero && isPureExpr(term, ops, terms) {
+				term, ops, terms = newConstTerm(b, at), ops[:0], terms[:0]
+				continue
+			}
+			if len(ops) == 0 && isDouble(op.GetValue(), b, term) {
+				ops = append(ops, NewSymbolToken("+", op.Line(), op.Pos()))
+				terms = append(terms, term)
+				continue
+			}
+		}
+		if aConst && isCommutative(op.GetValue()) {
+			if drop, zero := identity(op.GetValue(), a); drop {
+				term = next
+				continue
+			} else if zero && next.isPure() {
+				continue
+			}
+			if isDouble(op.GetValue(), a, next) {
+				term = next
+				ops = append(ops, NewSymbolToken("+", op.Line(), op.Pos()))
+				terms = append(terms, next)
+				continue
+			}
+		}
+		ops = append(ops, op)
+		terms = append(terms, next)
+	}
+	en.term, en.ops, en.opTerms = term, ops, terms
+}
+
+// identity reports that x op v is x or that it is v for any x
+func identity(op string, v int16) (drop, zero bool) {
+	switch op {
+	case "+", "|":
+		return v == 0, op == "|" && v == -1
+	case "-":
+		return v == 0, false
+	case "*":
+		return v == 1, v == 0
+	case "/":
+		return v == 1, false
+	case "&":
+		return v == -1, v == 0
+	}
+	return false, false
+}
+
+func isCommutative(op string) bool {
+	return op == "+" || op == "*" || op == "&" || op == "|"
+}
+
+// hasSafeDivisors reports that every divisor of the expression is a non-zero constant
+func hasSafeDivisors(ops []Token, terms []*TermNode) bool {
+	for i, op := range ops {
+		if op.GetValue() != "/" {
+			continue
+		}
+		if v, ok := terms[i].constValue(); !ok || v == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func isPureExpr(term *TermNode, ops []Token, terms []*TermNode) bool {
+	if !term.isPure() || !hasSafeDivisors(ops, terms) {
+		return false
+	}
+	for _, tn := range terms {
+		if !tn.isPure() {
+			return false
+		}
+	}
+	return true
+}
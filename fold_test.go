@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func foldClass(expr string) string {
+	return fmt.Sprintf(`class Main {
+		function int f(int x) { return %s; }
+		function int g() { return 3; }
+	}`, expr)
+}
+
+func TestFoldConstants(t *testing.T) {
+	testCases := []struct {
+		expr string
+		want string
+	}{
+		{"2 * 8 + x", "push constant 16; push argument 0; add"},
+		{"x + (2 * 8)", "push argument 0; push constant 16; add"},
+		{"x + 2 * 3", "push argument 0; push constant 2; add; push constant 3; call Math.multiply 2"},
+		{"32767 + 1", "push constant 32767; not"},
+		{"~32767 - 1", "push constant 32767"},
+		{"300 * 300", "push constant 24464"},
+		{"-7 / 2", "push constant 3; neg"},
+		{"1 / 0", "push constant 1; push constant 0; call Math.divide 2"},
+		{"(1 < 2) & ~false", "push constant 1; neg"},
+		{"-(2 + 3)", "push constant 5; neg"},
+		{"~~x", "push argument 0"},
+		{"x + 0 - 0 | 0", "push argument 0"},
+		{"0 + x", "push argument 0"},
+		{"0 - x", "push constant 0; push argument 0; sub"},
+		{"x * 1 / 1 & true", "push argument 0"},
+		{"1 * x", "push argument 0"},
+		{"1 / x", "push constant 1; push argument 0; call Math.divide 2"},
+		{"x * 0", "push constant 0"},
+		{"(x + 1) * 0 + 5", "push constant 5"},
+		{"0 & x", "push constant 0"},
+		{"x | true", "push constant 1; neg"},
+		{"Main.g() * 0", "call Main.g 0; push constant 0; call Math.multiply 2"},
+		{"(x / 2 + 1) * 0", "push constant 0"},
+		{"(1 / x) * 0", "push constant 1; push argument 0; call Math.divide 2; push constant 0; call Math.multiply 2"},
+		{"x / 0 * 0", "push argument 0; push constant 0; call Math.divide 2; push constant 0; call Math.multiply 2"},
+		{"0 & (x / (x - x))", "push constant 0; push argument 0; push argument 0; push argument 0; sub; call Math.divide 2; and"},
+		{"x * 2", "push argument 0; push argument 0; add"},
+		{"2 * x", "push argument 0; push argument 0; add"},
+		{"x * 4", "push argument 0; push constant 4; call Math.multiply 2"},
+		{"(x + 1) * 2", "push argument 0; push constant 1; add; push constant 2; call Math.multiply 2"},
+		{"-x * 2", "push argument 0; neg; push constant 2; call Math.multiply 2"},
+		{"x / 4", "push argument 0; push constant 4; call Math.divide 2"},
+		{"x = 0", "push argument 0; push constant 0; eq"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			body := compileFolded(t, tc.expr, true)
+			if got := vmLines(body); got != tc.want {
+				t.Errorf("Got %s; want %s", got, tc.want)
+			}
+			if n := len(compileFolded(t, tc.expr, false)); len(body) > n {
+				t.Errorf("Got %d commands; want at most %d of the code without folding", len(body), n)
+			}
+		})
+	}
+}
+
+// compileFolded returns the code of the expression in f without function and return
+func compileFolded(t *testing.T, expr string, fold bool) []VmInstr {
+	t.Helper()
+	root := parseClass(t, foldClass(expr))
+	if fold {
+		FoldConstants(root)
+	}
+	comp := NewCompiler()
+	if err := comp.Run(root); err != nil {
+		t.Fatalf("Compilation error: %v", err)
+	}
+	body := comp.Code()[1:]
+	for i, vi := range body {
+		if vi.Op == VmReturn {
+			return body[:i]
+		}
+	}
+	return body
+}
+
+func TestFoldSemantics(t *testing.T) {
+	exprs := []string{
+		"x * 2 * 8 + 3",
+		"4 * x - (1 - 2)",
+		"x * 16384",
+		"x * 2 + 2 * x",
+		"-(x * 32) / 2 / 1",
+		"(x = 1) | (x > 0) & true",
+		"~~x + --x",
+		"((x + 0) * 1 + 0) * 0 + x",
+		"(7 - 10) * x + (100 * 1000)",
+		"x / -1 + (-32767 - 1)",
+	}
+	args := []int16{0, 1, -1, 3, -300, 1000, 32767, -32768}
+
+	run := func(expr string, fold bool) []int16 {
+		root := parseClass(t, foldClass(expr))
+		if fold {
+			FoldConstants(root)
+		}
+		comp := NewCompiler()
+		if err := comp.Run(root); err != nil {
+			t.Fatalf("Compilation error: %v", err)
+		}
+		emu := NewVmEmulator()
+		NewJackOS(emu)
+		if err := emu.Load("Main", comp.String()); err != nil {
+			t.Fatal(err)
+		}
+		var res []int16
+		for _, x := range args {
+			if err := emu.Call("Main.f", x); err != nil {
+				t.Fatal(err)
+			}
+			if err := emu.Run(100000); err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, emu.Result())
+		}
+		return res
+	}
+
+	for _, expr := range exprs {
+		want, got := run(expr, false), run(expr, true)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v; want %v", expr, got, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const formatIndent = "    "
+
+// Formatter prints the tree in the canonical form. It walks the tokens of the source
+// in step with the printed ones, so comments are put back next to their tokens:
+// comments on their own lines go before the line of the next token, comments
+// after a token stay at the end of its line
+type Formatter struct {
+	sb        strings.Builder
+	tokens    []Token // tokens of the source
+	ti        int     // next source token
+	comments  []Comment
+	ci        int // next comment
+	indent    int
+	lastLine  int  // source line of the last printed token or comment
+	blank     bool // blank line is requested before the next line
+	afterOpen bool // the last printed token is "{"
+}
+
+func NewFormatter(tokens []Token, comments []Comment) *Formatter {
+	return &Formatter{tokens: tokens, comments: comments}
+}
+
+// FormatJack parses the source and returns it formatted. Sources with errors are not formatted
+func FormatJack(src string) (string, error) {
+	tz := NewTokenizer(bufio.NewReader(strings.NewReader(src)))
+	tz.KeepComments = true
+	var tokens []Token
+	for {
+		tk, err := tz.ReadToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		tokens = append(tokens, tk)
+	}
+
+	pt := NewPasreTree(NewTokenizer(bufio.NewReader(strings.NewReader(src))))
+	root, err := pt.Parse()
+	if err != nil {
+		return "", err
+	}
+
+	f := NewFormatter(tokens, tz.Comments)
+	root.Format(f)
+	return f.String(), nil
+}
+
+// String finishes the output with the comments after the last token
+func (f *Formatter) String() string {
+	f.trailingComments()
+	for ; f.ci < len(f.comments); f.ci++ {
+		f.sb.WriteByte('\n')
+		f.writeComment(f.comments[f.ci])
+	}
+	if f.sb.Len() > 0 {
+		f.sb.WriteByte('\n')
+	}
+	return f.sb.String()
+}
+
+func (f *Formatter) Indent() {
+	f.indent++
+}
+
+func (f *Formatter) Dedent() {
+	f.indent--
+}
+
+// BlankLine requests an empty line before the next line
+func (f *Formatter) BlankLine() {
+	f.blank = true
+}
+
+func (f *Formatter) Space() {
+	f.sb.WriteByte(' ')
+}
+
+// commentFirst reports that the next comment goes before the next source token
+func (f *Formatter) commentFirst() bool {
+	if f.ci >= len(f.comments) {
+		return false
+	}
+	if f.ti >= len(f.tokens) {
+		return true
+	}
+	c, tk := f.comments[f.ci], f.tokens[f.ti]
+	return c.Line < tk.Line() || c.Line == tk.Line() && c.Pos < tk.Pos()
+}
+
+func (f *Formatter) trailingComments() {
+	for f.commentFirst() && f.comments[f.ci].Line == f.lastLine && f.sb.Len() > 0 {
+		f.sb.WriteByte(' ')
+		f.writeComment(f.comments[f.ci])
+		f.lastLine = f.comments[f.ci].EndLine
+		f.ci++
+	}
+}
+
+// nextLine returns the source line of the next comment or token
+func (f *Formatter) nextLine() int {
+	if f.commentFirst() {
+		return f.comments[f.ci].Line
+	}
+	if f.ti < len(f.tokens) {
+		return f.tokens[f.ti].Line()
+	}
+	return f.lastLine
+}
+
+// nextIsClose reports that the next source token closes a block
+func (f *Formatter) nextIsClose() bool {
+	return f.ti < len(f.tokens) && isTokenOne(f.tokens[f.ti], TokenSymbol, "}")
+}
+
+// Line starts a new line. A blank line of the source between statements is kept
+func (f *Formatter) Line() {
+	f.trailingComments()
+	if f.sb.Len() > 0 {
+		f.sb.WriteByte('\n')
+		keep := f.lastLine > 0 && f.nextLine() > f.lastLine+1 && !f.afterOpen && !f.nextIsClose()
+		if f.blank || keep {
+			f.sb.WriteByte('\n')
+		}
+	}
+	f.blank = false
+
+	// Comments before "}" belong to the body of the block
+	inner := 0
+	if f.nextIsClose() {
+		inner = 1
+	}
+	f.indent += inner
+	for f.commentFirst() {
+		c := f.comments[f.ci]
+		f.ci++
+		f.writeIndent()
+		f.writeComment(c)
+		f.sb.WriteByte('\n')
+		f.lastLine = c.EndLine
+		if f.nextLine() > f.lastLine+1 && !f.nextIsClose() {
+			f.sb.WriteByte('\n')
+		}
+	}
+	f.indent -= inner
+	f.writeIndent()
+}
+
+func (f *Formatter) writeIndent() {
+	f.sb.WriteString(strings.Repeat(formatIndent, f.indent))
+}
+
+// writeComment re-indents the lines of block comments
+func (f *Formatter) writeComment(c Comment) {
+	lines := strings.Split(c.Text, "\n")
+	f.sb.WriteString(strings.TrimRight(lines[0], " \t\r"))
+	for _, l := range lines[1:] {
+		l = strings.TrimSpace(l)
+		f.sb.WriteByte('\n')
+		f.writeIndent()
+		if strings.HasPrefix(l, "*") {
+			f.sb.WriteByte(' ')
+		}
+		f.sb.WriteString(l)
+	}
+}
+
+// Word prints the next token of the source, e.g. a keyword or a symbol that is not kept in the tree
+func (f *Formatter) Word(s string) {
+	// Comments inside a line. A comment before a separator stays after the previous token
+	for f.commentFirst() {
+		c := f.comments[f.ci]
+		f.ci++
+		if b := f.lastByte(); b != 0 && strings.IndexByte(" \n([", b) < 0 {
+			f.sb.WriteByte(' ')
+		}
+		f.writeComment(c)
+		if c.IsBlock() {
+			if !isSeparator(s) {
+				f.sb.WriteByte(' ')
+			}
+		} else {
+			f.sb.WriteByte('\n')
+			f.writeIndent()
+			f.sb.WriteString(formatIndent)
+		}
+	}
+
+	f.sb.WriteString(s)
+	if f.ti < len(f.tokens) {
+		f.lastLine = f.tokens[f.ti].Line()
+		f.ti++
+	}
+	f.afterOpen = s == "{"
+}
+
+func (f *Formatter) lastByte() byte {
+	s := f.sb.String()
+	if s == "" {
+		return 0
+	}
+	return s[len(s)-1]
+}
+
+// isSeparator reports that the word is written right after the previous token
+func isSeparator(s string) bool {
+	switch s {
+	case ",", ";", ")", "]", ".":
+		return true
+	}
+	return false
+}
+
+// Token prints the token of the tree
+func (f *Formatter) Token(tk Token) {
+	if tk.Type() == TokenStringConst {
+		f.Word("\"" + tk.GetValue() + "\"")
+	} else {
+		f.Word(tk.GetValue())
+	}
+}
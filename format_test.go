@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFormatJack(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			"layout",
+			"class A{field int x,y;static boolean b;method int f(int a,char c){var int i;let i=a+1*(2-x);return i;}function void g(){return;}}",
+			`class A {
+    field int x, y;
+    static boolean b;
+
+    method int f(int a, char c) {
+        var int i;
+
+        let i = a + 1 * (2 - x);
+        return i;
+    }
+
+    function void g() {
+        return;
+    }
+}
+`,
+		},
+		{
+			"statements",
+			"class A{function void f(){var Array a;while(~(a[0]=1)){let a[0]=-a[1];}if(a){do Output.printString(\"a b\");}else{do A.g(a,0);}return;}}",
+			`class A {
+    function void f() {
+        var Array a;
+
+        while (~(a[0] = 1)) {
+            let a[0] = -a[1];
+        }
+        if (a) {
+            do Output.printString("a b");
+        } else {
+            do A.g(a, 0);
+        }
+        return;
+    }
+}
+`,
+		},
+		{
+			"comments",
+			`// header
+/** The class
+  * doc */
+class A {
+  field int x; // trailing
+    /** f doc */
+  function void f() {
+      let x = 1; /* inline */ let x = 2;
+
+
+      // before return
+      return;
+  }
+}
+// footer`,
+			`// header
+/** The class
+ * doc */
+class A {
+    field int x; // trailing
+
+    /** f doc */
+    function void f() {
+        let x = 1; /* inline */
+        let x = 2;
+
+        // before return
+        return;
+    }
+}
+// footer
+`,
+		},
+		{
+			"comments before separators and closing braces",
+			`class A {
+  function void f(int a /* first */, int b) {
+    do A.g(a /* x */);
+    return;
+    // after return
+  }
+  // last member
+}`,
+			`class A {
+    function void f(int a /* first */, int b) {
+        do A.g(a /* x */);
+        return;
+        // after return
+    }
+    // last member
+}
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := FormatJack(tc.src)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, tc.want)
+			}
+			again, err := FormatJack(got)
+			if err != nil || again != got {
+				t.Errorf("The format is not stable:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestFormatJackErrors(t *testing.T) {
+	for _, src := range []string{
+		"class A { function void f() { let x = ; } }",
+		"class A { /* unterminated",
+	} {
+		if _, err := FormatJack(src); err == nil {
+			t.Errorf("Expected error for %q", src)
+		}
+	}
+}
+
+func TestTokenizerComments(t *testing.T) {
+	src := "// one\nlet /** two\n **/ x; /*/ three */"
+	tz := NewTokenizer(bufio.NewReader(strings.NewReader(src)))
+	tz.KeepComments = true
+	count := 0
+	for {
+		if _, err := tz.ReadToken(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Errorf("Got %d tokens; want 3", count)
+	}
+
+	want := []Comment{
+		{"// one", 1, 1, 1},
+		{"/** two\n **/", 2, 5, 3},
+		{"/*/ three */", 3, 9, 3},
+	}
+	if len(tz.Comments) != len(want) {
+		t.Fatalf("Got comments %q; want %q", tz.Comments, want)
+	}
+	for i, c := range tz.Comments {
+		if c != want[i] {
+			t.Errorf("Got %+v; want %+v", c, want[i])
+		}
+	}
+	if want[0].IsBlock() || !want[1].IsBlock() {
+		t.Error("Wrong comment kind")
+	}
+}
@@ -5,9 +5,9 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -17,15 +17,58 @@ const (
 	argFail = iota + 1
 	fsFail
 	compFail
+	runFail
 )
 
-func parseArgs() (inPath string, isXml bool, err error) {
-	flag.StringVar(&inPath, "in", "", "Input folder with *.jack files")
-	flag.BoolVar(&isXml, "xml", false, "Generate output as xml files for testing purposes")
+type cliArgs struct {
+	inPath  string
+	isXml   bool
+	format  string
+	asm     bool
+	opt     bool
+	symbols string
+	compat  CompatMode
+	check   CheckOptions
+}
+
+func parseArgs() (args cliArgs, err error) {
+	var types, deadCode, compat string
+	flag.StringVar(&args.inPath, "in", "", "Input folder with *.jack files")
+	flag.BoolVar(&args.isXml, "xml", false, "Generate output as xml files for testing purposes")
+	flag.StringVar(&types, "types", "loose", "Type check level: off, loose or strict")
+	flag.StringVar(&deadCode, "deadcode", "warn", "Unreachable code and uncalled subroutines: off, warn or strip")
+	flag.BoolVar(&args.check.Unused, "unused", true, "Warn about variables that are never used")
+	flag.BoolVar(&args.check.Uninit, "uninit", true, "Warn about locals read before they are assigned")
+	flag.StringVar(&args.format, "format", "text", "Diagnostics format: text or json")
+	flag.BoolVar(&args.asm, "asm", false, "Translate all vm files of the folder into one Hack asm file with bootstrap code")
+	flag.BoolVar(&args.opt, "O", false, "Optimize the vm code")
+	flag.StringVar(&args.symbols, "symbols", "", "Write symbol tables of every file as text or json")
+	flag.StringVar(&compat, "compat", "none", "Reproduce the vm code of another compiler: none or reference")
 	flag.Parse()
 
-	if inPath == "" {
-		if inPath = flag.Arg(0); inPath == "" {
+	if args.check.Types, err = ParseTypeStrictness(types); err != nil {
+		return
+	}
+	if args.check.DeadCode, err = ParseDeadCodeMode(deadCode); err != nil {
+		return
+	}
+	if err = setDiagPrinter(args.format); err != nil {
+		return
+	}
+	if args.compat, err = ParseCompatMode(compat); err != nil {
+		return
+	}
+	if args.compat == CompatReference && (args.opt || args.check.DeadCode == DeadCodeStrip) {
+		err = errors.New("The reference compatible code cannot be optimized or stripped")
+		return
+	}
+	if args.symbols != "" && args.symbols != "text" && args.symbols != "json" {
+		err = fmt.Errorf("Unknown symbols format \"%s\". Expected text or json", args.symbols)
+		return
+	}
+
+	if args.inPath == "" {
+		if args.inPath = flag.Arg(0); args.inPath == "" {
 			err = errors.New("The input Path is not set")
 			return
 		}
@@ -35,6 +78,11 @@ func parseArgs() (inPath string, isXml bool, err error) {
 
 // getJackFiles returns all jack files in the folder
 func getJackFiles(dir string) ([]string, error) {
+	return getFilesByMask(dir, "*.jack")
+}
+
+// getFilesByMask returns all files in the folder whose names match the mask
+func getFilesByMask(dir, mask string) ([]string, error) {
 	dirPathInfo, err := os.Stat(dir)
 	if err != nil {
 		return nil, err
@@ -52,7 +100,7 @@ func getJackFiles(dir string) ([]string, error) {
 		if info.IsDir() {
 			return nil
 		}
-		if m, err := filepath.Match("*.jack", filepath.Base(path)); err != nil {
+		if m, err := filepath.Match(mask, filepath.Base(path)); err != nil {
 			return err
 		} else if m {
 			matched = append(matched, path)
@@ -100,7 +148,50 @@ func writeVmFile(vmF string, comp *Compiler) (err error) {
 	return
 }
 
-func processJackFile(wg *sync.WaitGroup, errCh chan<- error, inF, xmlTkF, xmlTreeF string) {
+func writeSymbolsFile(symF string, tables []*SymbolTable, format string) (err error) {
+	var symFile *os.File
+	symFile, err = os.Create(symF)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errClose := symFile.Close()
+		if errClose != nil {
+			err = errClose
+		}
+	}()
+
+	symFileWriter := bufio.NewWriter(symFile)
+	if err = WriteSymbols(symFileWriter, tables, format); err != nil {
+		return err
+	}
+	return symFileWriter.Flush()
+}
+
+// jackUnits stores parsed classes and compiled vm code by their file names
+type jackUnits struct {
+	mu    sync.Mutex
+	roots map[string]*ClassNode
+	vm    map[string][]VmInstr
+}
+
+func newJackUnits() *jackUnits {
+	return &jackUnits{roots: make(map[string]*ClassNode), vm: make(map[string][]VmInstr)}
+}
+
+func (ju *jackUnits) add(inF string, root *ClassNode) {
+	ju.mu.Lock()
+	defer ju.mu.Unlock()
+	ju.roots[inF] = root
+}
+
+func (ju *jackUnits) addVm(inF string, code []VmInstr) {
+	ju.mu.Lock()
+	defer ju.mu.Unlock()
+	ju.vm[inF] = code
+}
+
+func parseJackFile(wg *sync.WaitGroup, errCh chan<- *Diagnostic, units *jackUnits, inF, xmlTkF, xmlTreeF string) {
 	defer func() {
 		wg.Done()
 	}()
@@ -109,16 +200,19 @@ func processJackFile(wg *sync.WaitGroup, errCh chan<- error, inF, xmlTkF, xmlTre
 
 	inFile, err := os.Open(inF)
 	if err != nil {
-		errCh <- err
+		errCh <- AsDiagnostic(err)
 		return
 	}
 	defer inFile.Close()
 
 	tokenizer := NewTokenizer(bufio.NewReader(inFile))
 	parser := NewPasreTree(tokenizer)
-	rootTree, err := parser.Parse()
-	if err != nil && !errors.Is(err, io.EOF) {
-		errCh <- fmt.Errorf("File \"%s\" failed during parsing: %w", inF, err)
+	rootTree, _ := parser.Parse()
+	if errs := parser.Errors(); len(errs) > 0 {
+		errs.SetFile(inF)
+		for _, d := range errs {
+			errCh <- d
+		}
 		return
 	}
 
@@ -126,15 +220,104 @@ func processJackFile(wg *sync.WaitGroup, errCh chan<- error, inF, xmlTkF, xmlTre
 		writeXmlFile(xmlTkF, tokenizer)
 		writeXmlFile(xmlTreeF, parser)
 	}
+	units.add(inF, rootTree.(*ClassNode))
+}
+
+func compileJackFile(wg *sync.WaitGroup, errCh chan<- *Diagnostic, units *jackUnits, inF string, rootTree *ClassNode, ph *Peephole, compat CompatMode, symbols string) {
+	defer func() {
+		wg.Done()
+	}()
 
 	compiler := NewCompiler()
-	err = compiler.Run(rootTree)
+	compiler.Peephole = ph
+	compiler.Compat = compat
+	compiler.Tbl.Keep = symbols != ""
+	err := compiler.Run(rootTree)
 	if err != nil {
-		errCh <- fmt.Errorf("File \"%s\" failed during compilation: %w", inF, err)
+		d := AsDiagnostic(err)
+		d.File = inF
+		errCh <- d
+		return
 	}
 	vmFileName := getVmFileName(inF)
 	fmt.Printf("Saving the vm file \"%s\"\n", vmFileName)
 	writeVmFile(vmFileName, compiler)
+	units.addVm(vmFileName, compiler.Code())
+
+	if symbols != "" {
+		symFileName := getSymbolsFileName(inF, symbols)
+		fmt.Printf("Saving the symbol tables \"%s\"\n", symFileName)
+		if err := writeSymbolsFile(symFileName, compiler.Tbl.Created, symbols); err != nil {
+			errCh <- AsDiagnostic(err)
+		}
+	}
+}
+
+// translateToAsm writes all vm code of the folder into one asm file. Vm files
+// that are not compiled from jack files, e.g. OS classes, are read from the folder
+func translateToAsm(dir string, units *jackUnits) DiagnosticList {
+	vmFiles, err := getFilesByMask(dir, "*.vm")
+	if err != nil {
+		return DiagnosticList{AsDiagnostic(err)}
+	}
+	var diags DiagnosticList
+	for _, vmF := range vmFiles {
+		if _, ok := units.vm[vmF]; ok {
+			continue
+		}
+		data, err := os.ReadFile(vmF)
+		if err != nil {
+			return DiagnosticList{AsDiagnostic(err)}
+		}
+		className := strings.TrimSuffix(filepath.Base(vmF), filepath.Ext(vmF))
+		code, err := ParseVm(className, string(data))
+		if err != nil {
+			for _, d := range translateErrors(err) {
+				d.File = vmF
+				diags = append(diags, d)
+			}
+			continue
+		}
+		units.vm[vmF] = code
+	}
+
+	files := make([]string, 0, len(units.vm))
+	for f := range units.vm {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	vt := NewVmTranslator(true)
+	hasSysInit := false
+	for _, f := range files {
+		className := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		if err := vt.TranslateInstrs(className, units.vm[f]); err != nil {
+			d := AsDiagnostic(err)
+			d.File = f
+			diags = append(diags, d)
+		}
+		for _, vi := range units.vm[f] {
+			hasSysInit = hasSysInit || vi.Op == VmFunction && vi.Name == "Sys.init"
+		}
+	}
+	if !hasSysInit {
+		diags = append(diags, NewDiagnostic(SeverityWarning, CodeVmTranslate,
+			"Function Sys.init is not found. Copy the OS vm files into \"%s\"", dir))
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return append(diags, AsDiagnostic(err))
+	}
+	asmF := filepath.Join(dir, filepath.Base(absDir)+".asm")
+	fmt.Printf("Saving the asm file \"%s\"\n", asmF)
+	if err := os.WriteFile(asmF, []byte(vt.String()), 0644); err != nil {
+		diags = append(diags, AsDiagnostic(err))
+	}
+	return diags
 }
 
 func getTokenXmlFileName(inF string) string {
@@ -152,8 +335,17 @@ func getVmFileName(inF string) string {
 	return fn + ".vm"
 }
 
-func gatherErrs(wg *sync.WaitGroup, errCh <-chan error) []error {
-	errs := make([]error, 0)
+// getSymbolsFileName returns Main.sym for text tables and Main.sym.json for json ones
+func getSymbolsFileName(inF, format string) string {
+	fn := strings.TrimSuffix(inF, filepath.Ext(inF)) + ".sym"
+	if format == "json" {
+		fn += ".json"
+	}
+	return fn
+}
+
+func gatherErrs(wg *sync.WaitGroup, errCh <-chan *Diagnostic) DiagnosticList {
+	errs := make(DiagnosticList, 0)
 	done := make(chan bool)
 
 	go func() {
@@ -171,40 +363,349 @@ func gatherErrs(wg *sync.WaitGroup, errCh <-chan error) []error {
 	}
 }
 
+// diagPrinter is set up by main according to the format flag
+var diagPrinter DiagnosticPrinter = NewTextPrinter(os.Stderr)
+
+// setDiagPrinter sets up the diagnostics output for the format flag
+func setDiagPrinter(format string) error {
+	switch format {
+	case "text":
+		diagPrinter = NewTextPrinter(os.Stderr)
+	case "json":
+		diagPrinter = NewJSONPrinter(os.Stderr)
+	default:
+		return fmt.Errorf("Unknown format \"%s\". Expected text or json", format)
+	}
+	return nil
+}
+
+// getInputFiles returns the files of the paths. Directories are searched by the mask
+func getInputFiles(paths []string, mask string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		matched, err := getFilesByMask(p, mask)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matched...)
+	}
+	return files, nil
+}
+
+func getHackFileName(asmF string) string {
+	fn := strings.TrimSuffix(asmF, filepath.Ext(asmF))
+	return fn + ".hack"
+}
+
+// runAssembler is the asm subcommand: hackcompiler asm [-format json] file.asm|folder...
+func runAssembler(argv []string) {
+	fs := flag.NewFlagSet("asm", flag.ExitOnError)
+	format := fs.String("format", "text", "Diagnostics format: text or json")
+	fs.Parse(argv)
+
+	if err := setDiagPrinter(*format); err != nil || fs.NArg() == 0 {
+		if err == nil {
+			err = errors.New("The input asm files are not set")
+		}
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Argument Error: %v", err))
+		os.Exit(argFail)
+	}
+
+	asmFiles, err := getInputFiles(fs.Args(), "*.asm")
+	if err != nil {
+		diagPrinter.Print(errorDiag("", "File system error: %v", err))
+		os.Exit(fsFail)
+	}
+
+	var diags DiagnosticList
+	for _, asmF := range asmFiles {
+		fmt.Printf("Reading the file \"%s\"\n", asmF)
+		src, err := os.ReadFile(asmF)
+		if err != nil {
+			diags = append(diags, AsDiagnostic(err))
+			continue
+		}
+		hack, err := NewAssembler(asmF).Assemble(string(src))
+		if err != nil {
+			diags = append(diags, AsDiagnostic(err))
+			continue
+		}
+		hackF := getHackFileName(asmF)
+		fmt.Printf("Saving the hack file \"%s\"\n", hackF)
+		if err := os.WriteFile(hackF, []byte(hack), 0644); err != nil {
+			diags = append(diags, AsDiagnostic(err))
+		}
+	}
+	exitOnErrs(diags)
+}
+
+// runFormatter prints jack files in the canonical form or rewrites them
+func runFormatter(argv []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	format := fs.String("format", "text", "Diagnostics format: text or json")
+	write := fs.Bool("w", false, "Write the result into the source files")
+	list := fs.Bool("l", false, "List the files whose formatting differs")
+	fs.Parse(argv)
+
+	if err := setDiagPrinter(*format); err != nil || fs.NArg() == 0 {
+		if err == nil {
+			err = errors.New("The input jack files are not set")
+		}
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Argument Error: %v", err))
+		os.Exit(argFail)
+	}
+
+	jackFiles, err := getInputFiles(fs.Args(), "*.jack")
+	if err != nil {
+		diagPrinter.Print(errorDiag("", "File system error: %v", err))
+		os.Exit(fsFail)
+	}
+
+	var diags DiagnosticList
+	for _, jackF := range jackFiles {
+		src, err := os.ReadFile(jackF)
+		if err != nil {
+			diags = append(diags, AsDiagnostic(err))
+			continue
+		}
+		res, err := FormatJack(string(src))
+		if err != nil {
+			var dl DiagnosticList
+			if !errors.As(err, &dl) {
+				dl = DiagnosticList{AsDiagnostic(err)}
+			}
+			dl.SetFile(jackF)
+			diags = append(diags, dl...)
+			continue
+		}
+
+		if *list && res != string(src) {
+			fmt.Println(jackF)
+		}
+		if *write {
+			if res != string(src) {
+				err = os.WriteFile(jackF, []byte(res), 0644)
+			}
+		} else if !*list {
+			_, err = os.Stdout.WriteString(res)
+		}
+		if err != nil {
+			diags = append(diags, AsDiagnostic(err))
+		}
+	}
+	exitOnErrs(diags)
+}
+
+// runDoc writes the API documentation of jack files from their /** */ comments
+func runDoc(argv []string) {
+	fs := flag.NewFlagSet("doc", flag.ExitOnError)
+	format := fs.String("format", "text", "Diagnostics format: text or json")
+	docType := fs.String("type", "md", "Documentation format: md or html")
+	out := fs.String("o", "", "Output file. The documentation is printed if it is not set")
+	fs.Parse(argv)
+
+	err := setDiagPrinter(*format)
+	if err == nil && *docType != "md" && *docType != "html" {
+		err = fmt.Errorf("Unknown documentation format \"%s\". Expected md or html", *docType)
+	}
+	if err == nil && fs.NArg() == 0 {
+		err = errors.New("The input jack files are not set")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Argument Error: %v", err))
+		os.Exit(argFail)
+	}
+
+	jackFiles, err := getInputFiles(fs.Args(), "*.jack")
+	if err != nil {
+		diagPrinter.Print(errorDiag("", "File system error: %v", err))
+		os.Exit(fsFail)
+	}
+
+	var diags DiagnosticList
+	var classes []*ClassNode
+	for _, jackF := range jackFiles {
+		src, err := os.ReadFile(jackF)
+		if err != nil {
+			diags = append(diags, AsDiagnostic(err))
+			continue
+		}
+		tz := NewTokenizer(bufio.NewReader(strings.NewReader(string(src))))
+		tz.KeepTrivia = true
+		pt := NewPasreTree(tz)
+		root, _ := pt.Parse()
+		if errs := pt.Errors(); len(errs) > 0 {
+			errs.SetFile(jackF)
+			diags = append(diags, errs...)
+			continue
+		}
+		classes = append(classes, root.(*ClassNode))
+	}
+	exitOnErrs(diags)
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			diagPrinter.Print(errorDiag("", "File system error: %v", err))
+			os.Exit(fsFail)
+		}
+		defer w.Close()
+	}
+	if *docType == "html" {
+		err = WriteHTMLDoc(w, classes)
+	} else {
+		err = WriteMarkdownDoc(w, classes)
+	}
+	if err != nil {
+		diagPrinter.Print(AsDiagnostic(err))
+		os.Exit(fsFail)
+	}
+}
+
+// runVm executes vm files headless and saves the screen as png
+func runVm(argv []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	format := fs.String("format", "text", "Diagnostics format: text or json")
+	steps := fs.Int("steps", 10000000, "Maximum count of executed vm commands, 0 is no limit")
+	pngF := fs.String("png", "screen.png", "Output png file of the screen")
+	fs.Parse(argv)
+
+	if err := setDiagPrinter(*format); err != nil || fs.NArg() == 0 {
+		if err == nil {
+			err = errors.New("The input vm files are not set")
+		}
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Argument Error: %v", err))
+		os.Exit(argFail)
+	}
+
+	vmFiles, err := getInputFiles(fs.Args(), "*.vm")
+	if err != nil {
+		diagPrinter.Print(errorDiag("", "File system error: %v", err))
+		os.Exit(fsFail)
+	}
+	sort.Strings(vmFiles)
+
+	runner, err := NewVmRunner(vmFiles)
+	if err != nil {
+		exitOnErrs(DiagnosticList{AsDiagnostic(err)})
+	}
+	if err := runner.Run(*steps); err != nil {
+		diagPrinter.Print(AsDiagnostic(err))
+		os.Exit(runFail)
+	}
+	if runner.Emu.Halted() {
+		fmt.Printf("The program halted after %d steps\n", runner.Emu.Cycles)
+	} else {
+		fmt.Printf("The program is stopped after %d steps\n", runner.Emu.Cycles)
+	}
+	if text := runner.OS.Text(); text != "" {
+		fmt.Println(text)
+	}
+
+	fmt.Printf("Saving the screen into \"%s\"\n", *pngF)
+	f, err := os.Create(*pngF)
+	if err == nil {
+		err = WriteScreenPNG(f, runner.Emu)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		diagPrinter.Print(errorDiag("", "File system error: %v", err))
+		os.Exit(fsFail)
+	}
+}
+
 func main() {
-	inDirPath, isXml, err := parseArgs()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "asm":
+			runAssembler(os.Args[2:])
+			return
+		case "run":
+			runVm(os.Args[2:])
+			return
+		case "fmt":
+			runFormatter(os.Args[2:])
+			return
+		case "doc":
+			runDoc(os.Args[2:])
+			return
+		case "lsp":
+			if err := NewLspServer(os.Stdin, os.Stdout).Run(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(argFail)
+			}
+			return
+		}
+	}
+
+	args, err := parseArgs()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("Argument Error: %v", err))
 		os.Exit(argFail)
 	}
 
-	inFiles, err := getJackFiles(inDirPath)
+	inFiles, err := getJackFiles(args.inPath)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("File system error: %v", err))
+		diagPrinter.Print(errorDiag("", "File system error: %v", err))
 		os.Exit(fsFail)
 	}
 
-	errCh := make(chan error)
+	units := newJackUnits()
+	errCh := make(chan *Diagnostic)
 	wg := &sync.WaitGroup{}
 
 	for _, inF := range inFiles {
 		var xmlTkF, xmlTreeF string
 		fmt.Printf("Reading the file \"%s\"\n", inF)
-		if isXml {
+		if args.isXml {
 			xmlTkF = getTokenXmlFileName(inF)
 			xmlTreeF = getParserXmlFileName(inF)
 			fmt.Printf("Saving results into \"%s\" and \"%s\"\n", xmlTkF, xmlTreeF)
 		}
 		wg.Add(1)
-		go processJackFile(wg, errCh, inF, xmlTkF, xmlTreeF)
+		go parseJackFile(wg, errCh, units, inF, xmlTkF, xmlTreeF)
+	}
+	exitOnErrs(gatherErrs(wg, errCh))
+
+	exitOnErrs(CheckProgram(units.roots, args.check))
+	if args.check.DeadCode == DeadCodeStrip {
+		StripDeadCode(units.roots)
 	}
 
-	errs := gatherErrs(wg, errCh)
-	if len(errs) > 0 {
-		for _, e := range errs {
-			fmt.Fprintln(os.Stderr, "Errors during compilation:")
-			fmt.Fprintln(os.Stderr, e)
+	var ph *Peephole
+	if args.opt {
+		ph = NewDefaultPeephole()
+	}
+	for inF, root := range units.roots {
+		if args.opt {
+			FoldConstants(root)
 		}
+		wg.Add(1)
+		go compileJackFile(wg, errCh, units, inF, root, ph, args.compat, args.symbols)
+	}
+	exitOnErrs(gatherErrs(wg, errCh))
+
+	if args.asm {
+		exitOnErrs(translateToAsm(args.inPath, units))
+	}
+}
+
+// exitOnErrs prints all diagnostics and exits if there are errors among them
+func exitOnErrs(diags DiagnosticList) {
+	for _, d := range diags {
+		diagPrinter.Print(d)
+	}
+	if diags.HasErrors() {
 		os.Exit(compFail)
 	}
 }
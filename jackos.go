@@ -0,0 +1,544 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Size of the text screen of the Output class
+const (
+	outputRows = 23
+	outputCols = 64
+)
+
+// Special characters of the Jack character set
+const (
+	charNewLine     = 128
+	charBackSpace   = 129
+	charDoubleQuote = 34
+)
+
+// JackOS implements the classes of the Jack OS in Go for the VM emulator.
+// Objects and arrays live in the heap of the emulator RAM, so compiled code
+// can access them. Screen draws into the screen memory map; Output writes
+// into a text buffer instead of drawing the characters
+type JackOS struct {
+	emu    *VmEmulator
+	blocks map[int]int // size of allocated heap blocks by address
+	free   []heapBlock // sorted by address
+	text   [outputRows][outputCols]byte
+	row    int
+	col    int
+	color  bool
+	Input  []int16 // key codes read by the Keyboard class
+}
+
+type heapBlock struct {
+	addr, size int
+}
+
+// NewJackOS registers the OS functions in the emulator. Functions defined in the
+// loaded vm code take precedence, e.g. the compiled official OS
+func NewJackOS(emu *VmEmulator) *JackOS {
+	jos := &JackOS{emu: emu}
+	jos.init()
+
+	natives := map[string]VmNative{
+		"Math.init":     func([]int16) int16 { return 0 },
+		"Math.abs":      jos.abs,
+		"Math.multiply": func(a []int16) int16 { return a[0] * a[1] },
+		"Math.divide":   jos.divide,
+		"Math.min":      jos.min,
+		"Math.max":      jos.max,
+		"Math.sqrt":     jos.sqrt,
+
+		"Memory.init":    func([]int16) int16 { jos.initHeap(); return 0 },
+		"Memory.peek":    func(a []int16) int16 { return jos.emu.RAM[jos.address(a[0], 1)] },
+		"Memory.poke":    func(a []int16) int16 { jos.emu.RAM[jos.address(a[0], 1)] = a[1]; return 0 },
+		"Memory.alloc":   func(a []int16) int16 { return jos.alloc(int(a[0])) },
+		"Memory.deAlloc": func(a []int16) int16 { jos.deAlloc(a[0]); return 0 },
+
+		"Array.new":     func(a []int16) int16 { return jos.alloc(int(a[0])) },
+		"Array.dispose": func(a []int16) int16 { jos.deAlloc(a[0]); return 0 },
+
+		"String.new":           jos.newString,
+		"String.dispose":       func(a []int16) int16 { jos.deAlloc(a[0]); return 0 },
+		"String.length":        func(a []int16) int16 { _, length := jos.chars(a[0]); return int16(length) },
+		"String.charAt":        jos.charAt,
+		"String.setCharAt":     jos.setCharAt,
+		"String.appendChar":    jos.appendChar,
+		"String.eraseLastChar": jos.eraseLastChar,
+		"String.intValue":      jos.intValue,
+		"String.setInt":        jos.setInt,
+		"String.backSpace":     func([]int16) int16 { return charBackSpace },
+		"String.doubleQuote":   func([]int16) int16 { return charDoubleQuote },
+		"String.newLine":       func([]int16) int16 { return charNewLine },
+
+		"Output.init":        func([]int16) int16 { jos.clearText(); return 0 },
+		"Output.moveCursor":  jos.moveCursor,
+		"Output.printChar":   func(a []int16) int16 { jos.printChar(a[0]); return 0 },
+		"Output.printString": func(a []int16) int16 { jos.print(jos.String(a[0])); return 0 },
+		"Output.printInt":    func(a []int16) int16 { jos.print(strconv.Itoa(int(a[0]))); return 0 },
+		"Output.println":     func([]int16) int16 { jos.printChar(charNewLine); return 0 },
+		"Output.backSpace":   func([]int16) int16 { jos.printChar(charBackSpace); return 0 },
+
+		"Screen.init":          func([]int16) int16 { jos.color = true; return 0 },
+		"Screen.clearScreen":   func([]int16) int16 { jos.clearScreen(); return 0 },
+		"Screen.setColor":      func(a []int16) int16 { jos.color = a[0] != 0; return 0 },
+		"Screen.drawPixel":     jos.drawPixel,
+		"Screen.drawLine":      jos.drawLine,
+		"Screen.drawRectangle": jos.drawRectangle,
+		"Screen.drawCircle":    jos.drawCircle,
+
+		"Keyboard.init":       func([]int16) int16 { return 0 },
+		"Keyboard.keyPressed": func([]int16) int16 { return jos.emu.RAM[kbdAddr] },
+		"Keyboard.readChar":   func([]int16) int16 { return jos.readChar() },
+		"Keyboard.readLine":   func(a []int16) int16 { return jos.newGoString(jos.readLine(a[0])) },
+		"Keyboard.readInt":    func(a []int16) int16 { return jos.readInt(a[0]) },
+
+		"Sys.halt":  func([]int16) int16 { jos.emu.Halt(); return 0 },
+		"Sys.error": func(a []int16) int16 { jos.emu.nativeErrorf("Error code %d", a[0]); return 0 },
+		"Sys.wait":  func([]int16) int16 { return 0 },
+	}
+	for name, fn := range natives {
+		emu.SetNative(name, osArgCount(name), fn)
+	}
+	return jos
+}
+
+// osArgCount returns the count of arguments of the OS subroutine. This of a method is counted
+func osArgCount(function string) int {
+	dot := strings.Index(function, ".")
+	for _, si := range osClasses[function[:dot]] {
+		if si.Name == function[dot+1:] {
+			if si.IsMethod() {
+				return len(si.Params) + 1
+			}
+			return len(si.Params)
+		}
+	}
+	panic("unknown OS subroutine " + function)
+}
+
+func (jos *JackOS) init() {
+	jos.initHeap()
+	jos.clearText()
+	jos.color = true
+}
+
+// Boot runs Sys.init of the vm code if it is loaded. Otherwise it calls Main.main
+// and halts when it returns, as Sys.init of the OS does
+func (jos *JackOS) Boot() error {
+	jos.init()
+	if jos.emu.HasFunction("Sys.init") {
+		return jos.emu.Boot()
+	}
+	return jos.emu.Call("Main.main")
+}
+
+// Text returns the lines of the text screen without trailing spaces
+func (jos *JackOS) Text() string {
+	lines := make([]string, outputRows)
+	for i, row := range jos.text {
+		lines[i] = strings.TrimRight(string(row[:]), " ")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// String returns the text of the Jack string object
+func (jos *JackOS) String(s int16) string {
+	addr, length := jos.chars(s)
+	sb := strings.Builder{}
+	for i := 0; i < length; i++ {
+		sb.WriteByte(byte(jos.emu.RAM[addr+2+i]))
+	}
+	return sb.String()
+}
+
+// address checks that size cells starting at the pointer are in RAM
+func (jos *JackOS) address(p int16, size int) int {
+	if p < 0 || int(p)+size > ramSize {
+		jos.emu.nativeErrorf("Illegal address %d", p)
+	}
+	return int(p)
+}
+
+// Math
+
+func (jos *JackOS) abs(a []int16) int16 {
+	if a[0] < 0 {
+		return -a[0]
+	}
+	return a[0]
+}
+
+func (jos *JackOS) divide(a []int16) int16 {
+	if a[1] == 0 {
+		jos.emu.nativeErrorf("Division by zero")
+	}
+	return a[0] / a[1]
+}
+
+func (jos *JackOS) min(a []int16) int16 {
+	if a[0] < a[1] {
+		return a[0]
+	}
+	return a[1]
+}
+
+func (jos *JackOS) max(a []int16) int16 {
+	if a[0] > a[1] {
+		return a[0]
+	}
+	return a[1]
+}
+
+func (jos *JackOS) sqrt(a []int16) int16 {
+	if a[0] < 0 {
+		jos.emu.nativeErrorf("Cannot compute square root of a negative number")
+	}
+	var r int16
+	for (r+1)*(r+1) <= a[0] && (r+1)*(r+1) > 0 {
+		r++
+	}
+	return r
+}
+
+// Memory. The heap is managed by a first fit free list kept outside of RAM
+
+func (jos *JackOS) initHeap() {
+	jos.blocks = make(map[int]int)
+	jos.free = []heapBlock{{heapBase, screenBase - heapBase}}
+}
+
+func (jos *JackOS) alloc(size int) int16 {
+	if size <= 0 {
+		jos.emu.nativeErrorf("Allocated memory size must be positive")
+	}
+	for i, b := range jos.free {
+		if b.size < size {
+			continue
+		}
+		if b.size == size {
+			jos.free = append(jos.free[:i], jos.free[i+1:]...)
+		} else {
+			jos.free[i] = heapBlock{b.addr + size, b.size - size}
+		}
+		jos.blocks[b.addr] = size
+		for j := b.addr; j < b.addr+size; j++ {
+			jos.emu.RAM[j] = 0
+		}
+		return int16(b.addr)
+	}
+	jos.emu.nativeErrorf("Heap overflow")
+	return 0
+}
+
+func (jos *JackOS) deAlloc(p int16) {
+	addr := int(p)
+	size, ok := jos.blocks[addr]
+	if !ok {
+		jos.emu.nativeErrorf("Address %d is not allocated", p)
+	}
+	delete(jos.blocks, addr)
+
+	i := 0
+	for i < len(jos.free) && jos.free[i].addr < addr {
+		i++
+	}
+	jos.free = append(jos.free, heapBlock{})
+	copy(jos.free[i+1:], jos.free[i:])
+	jos.free[i] = heapBlock{addr, size}
+
+	// Merge with the neighbours
+	if i+1 < len(jos.free) && addr+size == jos.free[i+1].addr {
+		jos.free[i].size += jos.free[i+1].size
+		jos.free = append(jos.free[:i+1], jos.free[i+2:]...)
+	}
+	if i > 0 && jos.free[i-1].addr+jos.free[i-1].size == addr {
+		jos.free[i-1].size += jos.free[i].size
+		jos.free = append(jos.free[:i], jos.free[i+1:]...)
+	}
+}
+
+// String. An object is a heap block of maxLength, length and the characters
+
+func (jos *JackOS) newString(a []int16) int16 {
+	if a[0] < 0 {
+		jos.emu.nativeErrorf("Maximum length must be non-negative")
+	}
+	s := jos.alloc(int(a[0]) + 2)
+	jos.emu.RAM[s] = a[0]
+	return s
+}
+
+// newGoString allocates a Jack string with the text
+func (jos *JackOS) newGoString(text string) int16 {
+	s := jos.newString([]int16{int16(len(text))})
+	for i := 0; i < len(text); i++ {
+		jos.appendChar([]int16{s, int16(text[i])})
+	}
+	return s
+}
+
+// chars returns the address of the string object and its length. The characters must be in RAM
+func (jos *JackOS) chars(s int16) (addr, length int) {
+	addr = jos.address(s, 2)
+	length = int(jos.emu.RAM[addr+1])
+	if length < 0 {
+		jos.emu.nativeErrorf("Illegal string length %d", length)
+	}
+	jos.address(s, 2+length)
+	return addr, length
+}
+
+func (jos *JackOS) charIndex(s, i int16) int {
+	addr, length := jos.chars(s)
+	if i < 0 || int(i) >= length {
+		jos.emu.nativeErrorf("String index %d is out of bounds", i)
+	}
+	return addr + 2 + int(i)
+}
+
+func (jos *JackOS) charAt(a []int16) int16 {
+	return jos.emu.RAM[jos.charIndex(a[0], a[1])]
+}
+
+func (jos *JackOS) setCharAt(a []int16) int16 {
+	jos.emu.RAM[jos.charIndex(a[0], a[1])] = a[2]
+	return 0
+}
+
+func (jos *JackOS) appendChar(a []int16) int16 {
+	addr, length := jos.chars(a[0])
+	if length >= int(jos.emu.RAM[addr]) {
+		jos.emu.nativeErrorf("String is full")
+	}
+	jos.address(a[0], 3+length)
+	jos.emu.RAM[addr+2+length] = a[1]
+	jos.emu.RAM[addr+1]++
+	return a[0]
+}
+
+func (jos *JackOS) eraseLastChar(a []int16) int16 {
+	addr := jos.address(a[0], 2)
+	if jos.emu.RAM[addr+1] == 0 {
+		jos.emu.nativeErrorf("String is empty")
+	}
+	jos.emu.RAM[addr+1]--
+	return 0
+}
+
+// intValue converts the leading digits with an optional minus
+func (jos *JackOS) intValue(a []int16) int16 {
+	return parseJackInt(jos.String(a[0]))
+}
+
+func parseJackInt(s string) int16 {
+	var v int16
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	for i := 0; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		v = v*10 + int16(s[i]-'0')
+	}
+	if neg {
+		return -v
+	}
+	return v
+}
+
+func (jos *JackOS) setInt(a []int16) int16 {
+	addr := jos.address(a[0], 2)
+	text := strconv.Itoa(int(a[1]))
+	if len(text) > int(jos.emu.RAM[addr]) {
+		jos.emu.nativeErrorf("String is too short for %s", text)
+	}
+	jos.emu.RAM[addr+1] = 0
+	for i := 0; i < len(text); i++ {
+		jos.appendChar([]int16{a[0], int16(text[i])})
+	}
+	return 0
+}
+
+// Output
+
+func (jos *JackOS) clearText() {
+	for r := range jos.text {
+		for c := range jos.text[r] {
+			jos.text[r][c] = ' '
+		}
+	}
+	jos.row, jos.col = 0, 0
+}
+
+func (jos *JackOS) moveCursor(a []int16) int16 {
+	if a[0] < 0 || a[0] >= outputRows || a[1] < 0 || a[1] >= outputCols {
+		jos.emu.nativeErrorf("Illegal cursor location %d, %d", a[0], a[1])
+	}
+	jos.row, jos.col = int(a[0]), int(a[1])
+	return 0
+}
+
+func (jos *JackOS) print(s string) {
+	for i := 0; i < len(s); i++ {
+		jos.printChar(int16(s[i]))
+	}
+}
+
+func (jos *JackOS) printChar(c int16) {
+	switch c {
+	case charNewLine:
+		jos.col = 0
+		jos.row = (jos.row + 1) % outputRows
+	case charBackSpace:
+		if jos.col > 0 {
+			jos.col--
+		} else if jos.row > 0 {
+			jos.row, jos.col = jos.row-1, outputCols-1
+		}
+		jos.text[jos.row][jos.col] = ' '
+	default:
+		if c < 32 || c > 126 {
+			c = ' '
+		}
+		jos.text[jos.row][jos.col] = byte(c)
+		if jos.col++; jos.col == outputCols {
+			jos.printChar(charNewLine)
+		}
+	}
+}
+
+// Screen
+
+func (jos *JackOS) clearScreen() {
+	for i := screenBase; i < kbdAddr; i++ {
+		jos.emu.RAM[i] = 0
+	}
+}
+
+func (jos *JackOS) setPixel(x, y int) {
+	addr := screenBase + y*screenWords + x/16
+	mask := int16(1) << uint(x%16)
+	if jos.color {
+		jos.emu.RAM[addr] |= mask
+	} else {
+		jos.emu.RAM[addr] &^= mask
+	}
+}
+
+func (jos *JackOS) checkPoint(x, y int16) {
+	if x < 0 || x >= screenWidth || y < 0 || y >= screenHeight {
+		jos.emu.nativeErrorf("Illegal pixel coordinates %d, %d", x, y)
+	}
+}
+
+func (jos *JackOS) drawPixel(a []int16) int16 {
+	jos.checkPoint(a[0], a[1])
+	jos.setPixel(int(a[0]), int(a[1]))
+	return 0
+}
+
+func (jos *JackOS) drawLine(a []int16) int16 {
+	jos.checkPoint(a[0], a[1])
+	jos.checkPoint(a[2], a[3])
+	x, y, x2, y2 := int(a[0]), int(a[1]), int(a[2]), int(a[3])
+	dx, dy := abs(x2-x), -abs(y2-y)
+	sx, sy := sign(x2-x), sign(y2-y)
+	for e := dx + dy; ; {
+		jos.setPixel(x, y)
+		if x == x2 && y == y2 {
+			return 0
+		}
+		if 2*e >= dy {
+			e += dy
+			x += sx
+		}
+		if 2*e <= dx {
+			e += dx
+			y += sy
+		}
+	}
+}
+
+func (jos *JackOS) drawRectangle(a []int16) int16 {
+	jos.checkPoint(a[0], a[1])
+	jos.checkPoint(a[2], a[3])
+	if a[0] > a[2] || a[1] > a[3] {
+		jos.emu.nativeErrorf("Illegal rectangle coordinates")
+	}
+	for y := int(a[1]); y <= int(a[3]); y++ {
+		for x := int(a[0]); x <= int(a[2]); x++ {
+			jos.setPixel(x, y)
+		}
+	}
+	return 0
+}
+
+func (jos *JackOS) drawCircle(a []int16) int16 {
+	jos.checkPoint(a[0], a[1])
+	cx, cy, r := int(a[0]), int(a[1]), int(a[2])
+	if r < 0 || r > 181 {
+		jos.emu.nativeErrorf("Illegal radius %d", r)
+	}
+	for y := cy - r; y <= cy+r; y++ {
+		for x := cx - r; x <= cx+r; x++ {
+			inScreen := x >= 0 && x < screenWidth && y >= 0 && y < screenHeight
+			if inScreen && (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r {
+				jos.setPixel(x, y)
+			}
+		}
+	}
+	return 0
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func sign(v int) int {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return 0
+}
+
+// Keyboard. Keys are taken from Input, the memory map of the keyboard is not changed
+
+func (jos *JackOS) readChar() int16 {
+	if len(jos.Input) == 0 {
+		jos.emu.nativeErrorf("Keyboard input is exhausted")
+	}
+	c := jos.Input[0]
+	jos.Input = jos.Input[1:]
+	jos.printChar(c)
+	return c
+}
+
+func (jos *JackOS) readLine(msg int16) string {
+	jos.print(jos.String(msg))
+	var line []byte
+	for {
+		switch c := jos.readChar(); c {
+		case charNewLine:
+			return string(line)
+		case charBackSpace:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		default:
+			line = append(line, byte(c))
+		}
+	}
+}
+
+func (jos *JackOS) readInt(msg int16) int16 {
+	return parseJackInt(jos.readLine(msg))
+}
@@ -0,0 +1,207 @@
+package main
+
+import "testing"
+
+// runJack compiles the classes and runs Main.main with the native OS
+func runJack(t *testing.T, input []int16, classes ...string) (*VmEmulator, *JackOS) {
+	emu := NewVmEmulator()
+	jos := NewJackOS(emu)
+	jos.Input = input
+
+	for _, code := range classes {
+		root := parseClass(t, code)
+		comp := NewCompiler()
+		if err := comp.Run(root); err != nil {
+			t.Fatalf("Compilation error: %v", err)
+		}
+		if err := emu.Load(root.Name.GetValue(), comp.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := jos.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := emu.Run(1000000); err != nil {
+		t.Fatal(err)
+	}
+	return emu, jos
+}
+
+func TestJackOSOutput(t *testing.T) {
+	main := `class Main {
+		function void main() {
+			var String s;
+			var Array a;
+			let a = Array.new(3);
+			let a[0] = 7; let a[1] = -3; let a[2] = a[0] * a[1];
+			do Output.printString("Hello, ");
+			do Output.printInt(a[2] / 2);
+			do Output.println();
+			let s = String.new(6);
+			do s.setInt(-1234);
+			do s.appendChar(33);
+			do Output.printString(s);
+			do Output.printInt(s.length());
+			do s.eraseLastChar();
+			do Output.printInt(s.intValue() + Math.sqrt(100) + Math.max(1, Math.abs(-5)));
+			do Output.moveCursor(3, 2);
+			do Output.printChar(String.doubleQuote());
+			do s.dispose();
+			do a.dispose();
+			return;
+		}
+	}`
+	_, jos := runJack(t, nil, main)
+	want := "Hello, -10\n-1234!6-1219\n\n  \""
+	if got := jos.Text(); got != want {
+		t.Errorf("Got text:\n%s\nwant:\n%s", got, want)
+	}
+	// String constants are never deallocated
+	if len(jos.blocks) != 1 {
+		t.Errorf("%d blocks are not deallocated; want 1", len(jos.blocks))
+	}
+}
+
+func TestJackOSObjects(t *testing.T) {
+	point := `class Point {
+		field int x, y;
+		constructor Point new(int ax, int ay) { let x = ax; let y = ay; return this; }
+		method int dist(Point p) { return Math.abs(x - p.getX()) + Math.abs(y - p.getY()); }
+		method int getX() { return x; }
+		method int getY() { return y; }
+	}`
+	main := `class Main {
+		function void main() {
+			var Point p, q;
+			let p = Point.new(1, 2);
+			let q = Point.new(-4, 10);
+			do Output.printInt(p.dist(q));
+			do Memory.poke(8000, Memory.peek(p) + 100);
+			return;
+		}
+	}`
+	emu, jos := runJack(t, nil, point, main)
+	if got := jos.Text(); got != "13" {
+		t.Errorf("Got %q; want 13", got)
+	}
+	if emu.RAM[8000] != 101 {
+		t.Errorf("RAM[8000] = %d; want 101", emu.RAM[8000])
+	}
+}
+
+func TestJackOSScreen(t *testing.T) {
+	main := `class Main {
+		function void main() {
+			do Screen.drawRectangle(10, 20, 30, 25);
+			do Screen.drawLine(0, 0, 511, 255);
+			do Screen.drawCircle(200, 100, 10);
+			do Screen.setColor(false);
+			do Screen.drawPixel(15, 22);
+			return;
+		}
+	}`
+	emu, _ := runJack(t, nil, main)
+	testCases := []struct {
+		x, y  int
+		black bool
+	}{
+		{10, 20, true}, {30, 25, true}, {31, 25, false}, {15, 22, false},
+		{0, 0, true}, {511, 255, true}, {256, 128, true}, {100, 0, false},
+		{200, 100, true}, {210, 100, true}, {208, 108, false},
+	}
+	for _, tc := range testCases {
+		if got := emu.Pixel(tc.x, tc.y); got != tc.black {
+			t.Errorf("Pixel(%d, %d) = %v; want %v", tc.x, tc.y, got, tc.black)
+		}
+	}
+}
+
+func TestJackOSKeyboard(t *testing.T) {
+	main := `class Main {
+		function void main() {
+			var int n;
+			let n = Keyboard.readInt("n? ");
+			do Output.printInt(n * 2);
+			return;
+		}
+	}`
+	_, jos := runJack(t, []int16{'1', '2', 'x', charBackSpace, charNewLine}, main)
+	if got, want := jos.Text(), "n? 12\n24"; got != want {
+		t.Errorf("Got %q; want %q", got, want)
+	}
+}
+
+func TestJackOSHeap(t *testing.T) {
+	emu := NewVmEmulator()
+	jos := NewJackOS(emu)
+	a := jos.alloc(10)
+	b := jos.alloc(20)
+	c := jos.alloc(30)
+	if a != heapBase || b != a+10 || c != b+20 {
+		t.Errorf("Got blocks %d, %d, %d", a, b, c)
+	}
+	jos.deAlloc(a)
+	jos.deAlloc(b)
+	if d := jos.alloc(25); d != a {
+		t.Errorf("Got %d; want merged block %d", d, a)
+	}
+	jos.deAlloc(c)
+	jos.deAlloc(a)
+	if len(jos.free) != 1 || jos.free[0].size != screenBase-heapBase {
+		t.Errorf("Got free list %v; want the whole heap", jos.free)
+	}
+}
+
+func TestJackOSErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		stmt string
+	}{
+		{"Division by zero", "do Output.printInt(1 / 0);"},
+		{"Pixel", "do Screen.drawPixel(512, 0);"},
+		{"String index", "var String s; let s = \"ab\"; do s.charAt(2);"},
+		{"String is full", "var String s; let s = String.new(0); do s.appendChar(65);"},
+		{"String address", "var String s; let s = 32767; do s.length();"},
+		{"String length", "var Array a; let a = Array.new(2); let a[1] = 31000; do Output.printString(a);"},
+		{"Sys.error", "do Sys.error(7);"},
+		{"Keyboard", "do Keyboard.readChar();"},
+		{"Argument count", "do Math.multiply();"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			emu := NewVmEmulator()
+			NewJackOS(emu)
+			comp := NewCompiler()
+			main := "class Main { function void main() { " + tc.stmt + " return; } }"
+			if err := comp.Run(parseClass(t, main)); err != nil {
+				t.Fatal(err)
+			}
+			if err := emu.Load("Main", comp.String()); err != nil {
+				t.Fatal(err)
+			}
+			if err := emu.Call("Main.main"); err != nil {
+				t.Fatal(err)
+			}
+			err := emu.Run(10000)
+			if d := AsDiagnostic(err); err == nil || d.Code != CodeVmRuntime || d.Line == 0 {
+				t.Errorf("Got %v; want runtime error at the call", err)
+			}
+		})
+	}
+}
+
+func TestJackOSHalt(t *testing.T) {
+	main := `class Main {
+		function void main() {
+			do Output.printInt(1);
+			do Sys.halt();
+			do Output.printInt(2);
+			return;
+		}
+	}`
+	_, jos := runJack(t, nil, main)
+	if got := jos.Text(); got != "1" {
+		t.Errorf("Got %q; want 1", got)
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC error codes
+const (
+	lspParseError     = -32700
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+	lspInternalError  = -32603
+)
+
+// LSP constants
+const (
+	lspSyncFull = 1
+
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+	lspSeverityInfo    = 3
+
+	lspKindMethod      = 2
+	lspKindFunction    = 3
+	lspKindConstructor = 4
+)
+
+type lspRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type lspResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *lspError       `json:"error,omitempty"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text,omitempty"`
+}
+
+type lspDocumentParams struct {
+	TextDocument   lspTextDocument `json:"textDocument"`
+	Position       lspPosition     `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Text *string `json:"text"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// LspServer speaks Language Server Protocol over a stream. Documents are analysed
+// together with the other jack files of their directory
+type LspServer struct {
+	r        *bufio.Reader
+	w        io.Writer
+	docs     map[string]string // text of open documents by path
+	shutdown bool
+}
+
+func NewLspServer(r io.Reader, w io.Writer) *LspServer {
+	return &LspServer{r: bufio.NewReader(r), w: w, docs: make(map[string]string)}
+}
+
+// Run serves requests until the exit notification. It returns an error if the
+// stream is broken or the client exits without shutdown
+func (s *LspServer) Run() error {
+	for {
+		body, err := s.readMessage()
+		if err != nil {
+			return err
+		}
+		var req lspRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.reply(nil, nil, &lspError{lspParseError, err.Error()})
+			continue
+		}
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("The client exited without shutdown")
+			}
+			return nil
+		}
+
+		result, lerr := s.handle(req)
+		if req.ID != nil {
+			s.reply(req.ID, result, lerr)
+		}
+	}
+}
+
+func (s *LspServer) readMessage() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v := strings.TrimPrefix(line, "Content-Length:"); v != line {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("Wrong header %s", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("Content-Length header is missing")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.r, body)
+	return body, err
+}
+
+func (s *LspServer) write(msg interface{}) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *LspServer) reply(id json.RawMessage, result interface{}, lerr *lspError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	s.write(lspResponse{JSONRPC: "2.0", ID: id, Result: result, Error: lerr})
+}
+
+func (s *LspServer) handle(req lspRequest) (result interface{}, lerr *lspError) {
+	// A bug in one request must not stop the whole session
+	defer func() {
+		if r := recover(); r != nil {
+			result, lerr = nil, &lspError{lspInternalError, fmt.Sprintf("Internal error in %s: %v", req.Method, r)}
+		}
+	}()
+
+	var p lspDocumentParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+	}
+	path := uriToPath(p.TextDocument.URI)
+
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    lspSyncFull,
+					"save":      map[string]bool{"includeText": true},
+				},
+				"definitionProvider": true,
+				"hoverProvider":      true,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"."}},
+			},
+			"serverInfo": map[string]string{"name": "jack"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "textDocument/didOpen":
+		s.docs[path] = p.TextDocument.Text
+		s.publishDiagnostics(path)
+	case "textDocument/didChange":
+		if n := len(p.ContentChanges); n > 0 {
+			s.docs[path] = p.ContentChanges[n-1].Text
+		}
+	case "textDocument/didSave":
+		if p.Text != nil {
+			s.docs[path] = *p.Text
+		}
+		s.publishDiagnostics(path)
+	case "textDocument/didClose":
+		delete(s.docs, path)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri": p.TextDocument.URI, "diagnostics": []lspDiagnostic{},
+		})
+	case "textDocument/definition":
+		return s.newWorkspace(path).definition(path, p.Position), nil
+	case "textDocument/hover":
+		return s.newWorkspace(path).hover(path, p.Position), nil
+	case "textDocument/completion":
+		return s.newWorkspace(path).completion(path, p.Position), nil
+	default:
+		if req.ID != nil {
+			return nil, &lspError{lspMethodNotFound, "Method " + req.Method + " is not supported"}
+		}
+	}
+	return nil, nil
+}
+
+func (s *LspServer) notify(method string, params interface{}) {
+	s.write(lspNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *LspServer) publishDiagnostics(path string) {
+	ws := s.newWorkspace(path)
+	diags := []lspDiagnostic{}
+	for _, d := range ws.diagnostics(path) {
+		diags = append(diags, toLspDiagnostic(d))
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri": pathToURI(path), "diagnostics": diags,
+	})
+}
+
+func toLspDiagnostic(d *Diagnostic) lspDiagnostic {
+	start := lspPosition{maxInt(d.Line-1, 0), maxInt(d.Col-1, 0)}
+	end := start
+	end.Character++
+	if d.EndLine > 0 && (d.EndLine > d.Line || d.EndCol > d.Col) {
+		end = lspPosition{d.EndLine - 1, d.EndCol - 1}
+	}
+	sev := lspSeverityError
+	switch d.Severity {
+	case SeverityWarning:
+		sev = lspSeverityWarning
+	case SeverityNote:
+		sev = lspSeverityInfo
+	}
+	msg := d.Msg
+	for _, n := range d.Notes {
+		msg += "\nnote: " + n
+	}
+	return lspDiagnostic{lspRange{start, end}, sev, d.Code, "jack", msg}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// lspUnit is a parsed jack file
+type lspUnit struct {
+	text string
+	root *ClassNode
+	errs DiagnosticList
+}
+
+// lspWorkspace is a snapshot of the jack files of one directory
+type lspWorkspace struct {
+	units map[string]*lspUnit // by path
+	prog  *ProgramInfo
+}
+
+// newWorkspace parses the jack files of the directory of the document. Open
+// documents are used instead of the files on the disk. Files with parse
+// errors are not added to the program, their trees are partial
+func (s *LspServer) newWorkspace(path string) *lspWorkspace {
+	ws := &lspWorkspace{units: make(map[string]*lspUnit), prog: NewProgramInfo()}
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.jack"))
+	files = append(files, path)
+	sort.Strings(files)
+
+	for _, f := range files {
+		if _, ok := ws.units[f]; ok {
+			continue
+		}
+		text, ok := s.docs[f]
+		if !ok {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			text = string(data)
+		}
+		u := parseJackSource(text)
+		u.errs.SetFile(f)
+		ws.units[f] = u
+		if len(u.errs) == 0 {
+			ws.prog.AddClass(f, u.root)
+		}
+	}
+	return ws
+}
+
+func parseJackSource(text string) *lspUnit {
+	pt := NewPasreTree(NewTokenizer(bufio.NewReader(strings.NewReader(text))))
+	root, _ := pt.Parse()
+	return &lspUnit{text: text, root: root.(*ClassNode), errs: pt.Errors()}
+}
+
+// diagnostics returns the parse errors of the file. If there are none,
+// the file is checked against the files of the workspace that are parsed
+// without errors
+func (ws *lspWorkspace) diagnostics(path string) DiagnosticList {
+	u := ws.units[path]
+	if u == nil {
+		return nil
+	}
+	if len(u.errs) > 0 {
+		return u.errs
+	}
+	roots := make(map[string]*ClassNode)
+	for f, unit := range ws.units {
+		if len(unit.errs) == 0 {
+			roots[f] = unit.root
+		}
+	}
+	var diags DiagnosticList
+	for _, d := range CheckProgram(roots, CheckOptions{Types: TypeCheckLoose}) {
+		if d.File == path {
+			diags = append(diags, d)
+		}
+	}
+	return diags
+}
+
+// lspTokens returns all the tokens of the text. Undefined tokens are skipped
+func lspTokens(text string) []Token {
+	tz := NewTokenizer(bufio.NewReader(strings.NewReader(text)))
+	var tokens []Token
+	for {
+		tk, err := tz.ReadToken()
+		if err == io.EOF {
+			return tokens
+		}
+		if err != nil {
+			if _, ok := err.(*Diagnostic); ok {
+				continue
+			}
+			return tokens
+		}
+		tokens = append(tokens, tk)
+	}
+}
+
+// lspSymbol is the identifier under the cursor with its context
+type lspSymbol struct {
+	tk        Token
+	qualifier Token // identifier before the dot
+	isCall    bool  // followed by "(" or "."
+	isPrefix  bool  // followed by "."
+	class     *ClassNode
+	sbr       *SubroutineDecNode // enclosing subroutine
+	tbl       *SymbolTableList
+}
+
+func (ws *lspWorkspace) symbolAt(path string, pos lspPosition) (*lspSymbol, bool) {
+	u := ws.units[path]
+	if u == nil {
+		return nil, false
+	}
+	tokens := lspTokens(u.text)
+	line, col := pos.Line+1, pos.Character+1
+	for i, tk := range tokens {
+		if tk.Type() != TokenIdentifier || tk.Line() != line || col < tk.Pos() || col > tk.Pos()+tokenWidth(tk) {
+			continue
+		}
+		sym := &lspSymbol{tk: tk, class: u.root}
+		if i >= 2 && isTokenOne(tokens[i-1], TokenSymbol, ".") {
+			sym.qualifier = tokens[i-2]
+		}
+		if i+1 < len(tokens) {
+			sym.isPrefix = isTokenOne(tokens[i+1], TokenSymbol, ".")
+			sym.isCall = sym.isPrefix || isTokenOne(tokens[i+1], TokenSymbol, "(")
+		}
+		sym.sbr, sym.tbl = ws.scope(u.root, line, col)
+		return sym, true
+	}
+	return nil, false
+}
+
+// scope returns the subroutine at the position and the symbol table of it
+func (ws *lspWorkspace) scope(cn *ClassNode, line, col int) (*SubroutineDecNode, *SymbolTableList) {
+	tbl := NewSymbolTableList()
+	tbl.CreateTable(cn.Name.GetValue())
+	declareClassVars(tbl, cn)
+
+	var sbr *SubroutineDecNode
+	for _, sd := range cn.SbrDec {
+		kw := sd.SbrKind
+		if kw.Line() < line || kw.Line() == line && kw.Pos() <= col {
+			sbr = sd
+		}
+	}
+	if sbr != nil {
+		tbl.CreateTable(cn.Name.GetValue() + "." + sbr.Name.GetValue())
+		declareSubroutineVars(tbl, cn.Name.GetValue(), sbr)
+	}
+	return sbr, tbl
+}
+
+// varDecl returns the declaration of the variable visible in the scope of the symbol
+func (sym *lspSymbol) varDecl(name string) (Token, bool) {
+	if sbr := sym.sbr; sbr != nil {
+		for _, vd := range sbr.Body.VarDec {
+			for _, id := range vd.Ids {
+				if id.GetValue() == name {
+					return id, true
+				}
+			}
+		}
+		for _, n := range sbr.ParamList.varNames {
+			if n.GetValue() == name {
+				return n, true
+			}
+		}
+	}
+	for _, vd := range sym.class.VarDec {
+		for _, n := range vd.Names {
+			if n.GetValue() == name {
+				return n, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// classOf returns the class of the qualifier of a call: the type of a variable or the class itself
+func (sym *lspSymbol) classOf(ws *lspWorkspace, qualifier string) (*ClassInfo, bool) {
+	if vi, ok := sym.tbl.Lookup(qualifier); ok {
+		qualifier = vi.Type
+	}
+	return ws.prog.Class(qualifier)
+}
+
+func (ws *lspWorkspace) classDecl(name string) (string, *ClassNode, bool) {
+	ci, ok := ws.prog.Class(name)
+	if !ok || ci.IsOS() {
+		return "", nil, false
+	}
+	u, ok := ws.units[ci.File]
+	if !ok {
+		return "", nil, false
+	}
+	return ci.File, u.root, true
+}
+
+func tokenLocation(path string, tk Token) lspLocation {
+	start := lspPosition{tk.Line() - 1, tk.Pos() - 1}
+	end := lspPosition{start.Line, start.Character + tokenWidth(tk)}
+	return lspLocation{pathToURI(path), lspRange{start, end}}
+}
+
+func (ws *lspWorkspace) definition(path string, pos lspPosition) interface{} {
+	sym, ok := ws.symbolAt(path, pos)
+	if !ok {
+		return nil
+	}
+	name := sym.tk.GetValue()
+
+	// Subroutine: Class.sbr, var.sbr or sbr()
+	if sym.qualifier != nil || sym.isCall && !sym.isPrefix {
+		className := sym.class.Name.GetValue()
+		if sym.qualifier != nil {
+			ci, ok := sym.classOf(ws, sym.qualifier.GetValue())
+			if !ok {
+				return nil
+			}
+			className = ci.Name
+		}
+		file, cn, ok := ws.classDecl(className)
+		if !ok {
+			return nil
+		}
+		for _, sd := range cn.SbrDec {
+			if sd.Name.GetValue() == name {
+				return tokenLocation(file, sd.Name)
+			}
+		}
+		return nil
+	}
+
+	if decl, ok := sym.varDecl(name); ok {
+		return tokenLocation(path, decl)
+	}
+	if file, cn, ok := ws.classDecl(name); ok {
+		return tokenLocation(file, cn.Name)
+	}
+	return nil
+}
+
+func sbrSignature(className string, si SbrInfo) string {
+	return fmt.Sprintf("%s %s %s.%s(%s)", si.Kind, si.ReturnType, className, si.Name, strings.Join(si.Params, ", "))
+}
+
+func (ws *lspWorkspace) hover(path string, pos lspPosition) interface{} {
+	sym, ok := ws.symbolAt(path, pos)
+	if !ok {
+		return nil
+	}
+	name := sym.tk.GetValue()
+
+	var text string
+	switch {
+	case sym.qualifier != nil || sym.isCall && !sym.isPrefix:
+		ci, ok := ws.prog.Class(sym.class.Name.GetValue())
+		if sym.qualifier != nil {
+			ci, ok = sym.classOf(ws, sym.qualifier.GetValue())
+		}
+		if !ok {
+			return nil
+		}
+		si, ok := ci.Sbrs[name]
+		if !ok {
+			return nil
+		}
+		text = "```jack\n" + sbrSignature(ci.Name, si) + "\n```"
+	default:
+		if vi, ok := sym.tbl.Lookup(name); ok {
+			text = fmt.Sprintf("```jack\n%s %s %s\n```\nKind: %s, type: %s, offset: %d (`%s %d`)",
+				vi.Kind, vi.Type, name, vi.Kind, vi.Type, vi.Offset, GetSegment(vi.Kind), vi.Offset)
+		} else if ci, ok := ws.prog.Class(name); ok {
+			text = "```jack\nclass " + ci.Name + "\n```"
+			if ci.IsOS() {
+				text += "\nJack OS class"
+			}
+		} else {
+			return nil
+		}
+	}
+
+	loc := tokenLocation(path, sym.tk)
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": text},
+		"range":    loc.Range,
+	}
+}
+
+// completion suggests subroutines of the class after "Class." and methods after "var."
+func (ws *lspWorkspace) completion(path string, pos lspPosition) interface{} {
+	items := []lspCompletionItem{}
+	u := ws.units[path]
+	if u == nil {
+		return items
+	}
+	lines := strings.Split(u.text, "\n")
+	if pos.Line >= len(lines) {
+		return items
+	}
+	prefix := lines[pos.Line]
+	if pos.Character < len(prefix) {
+		prefix = prefix[:pos.Character]
+	}
+
+	// Skip the typed part of the member, then the dot
+	prefix = strings.TrimRightFunc(prefix, isIdentRune)
+	if !strings.HasSuffix(prefix, ".") {
+		return items
+	}
+	prefix = strings.TrimSuffix(prefix, ".")
+	qualifier := prefix[len(strings.TrimRightFunc(prefix, isIdentRune)):]
+	if qualifier == "" {
+		return items
+	}
+
+	_, tbl := ws.scope(u.root, pos.Line+1, pos.Character+1)
+	vi, isVar := tbl.Lookup(qualifier)
+	className := qualifier
+	if isVar {
+		className = vi.Type
+	}
+	ci, ok := ws.prog.Class(className)
+	if !ok {
+		return items
+	}
+
+	for _, si := range ci.Sbrs {
+		if si.IsMethod() != isVar {
+			continue
+		}
+		kind := lspKindFunction
+		switch si.Kind {
+		case "method":
+			kind = lspKindMethod
+		case "constructor":
+			kind = lspKindConstructor
+		}
+		items = append(items, lspCompletionItem{si.Name, kind, sbrSignature(ci.Name, si)})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
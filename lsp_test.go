@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const lspPoint = `class Point {
+    field int x, y;
+    static int count;
+
+    constructor Point new(int ax, int ay) {
+        let x = ax;
+        let y = ay;
+        let count = count + 1;
+        return this;
+    }
+
+    method int getX() { return x; }
+
+    function int count() { return count; }
+}
+`
+
+const lspMain = `class Main {
+    function void main() {
+        var Point p;
+        var int sum;
+        let p = Point.new(1, 2);
+        let sum = p.getX() + Point.count();
+        do Output.printInt(sum);
+        do p.
+        return;
+    }
+}
+`
+
+// lspSession sends the requests to the server and returns the messages written by it
+func lspSession(t *testing.T, reqs ...interface{}) []map[string]interface{} {
+	in := &bytes.Buffer{}
+	reqs = append(reqs,
+		map[string]interface{}{"jsonrpc": "2.0", "id": 1000, "method": "shutdown"},
+		map[string]interface{}{"jsonrpc": "2.0", "method": "exit"},
+	)
+	for _, r := range reqs {
+		body, _ := json.Marshal(r)
+		fmt.Fprintf(in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+
+	out := &bytes.Buffer{}
+	if err := NewLspServer(in, out).Run(); err != nil {
+		t.Fatalf("Server error: %v", err)
+	}
+
+	var msgs []map[string]interface{}
+	r := NewLspServer(out, nil)
+	for {
+		body, err := r.readMessage()
+		if err != nil {
+			break
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func lspCall(id int, method, uri string, line, char int) map[string]interface{} {
+	return map[string]interface{}{
+		"jsonrpc": "2.0", "id": id, "method": method,
+		"params": map[string]interface{}{
+			"textDocument": map[string]string{"uri": uri},
+			"position":     map[string]int{"line": line, "character": char},
+		},
+	}
+}
+
+func lspOpen(uri, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"jsonrpc": "2.0", "method": "textDocument/didOpen",
+		"params": map[string]interface{}{
+			"textDocument": map[string]string{"uri": uri, "languageId": "jack", "text": text},
+		},
+	}
+}
+
+// lspResult finds the response by id and returns its result as json
+func lspResult(t *testing.T, msgs []map[string]interface{}, id int) string {
+	t.Helper()
+	for _, m := range msgs {
+		if v, ok := m["id"].(float64); ok && int(v) == id {
+			res, _ := json.Marshal(m["result"])
+			return string(res)
+		}
+	}
+	t.Fatalf("No response %d", id)
+	return ""
+}
+
+func setupLspDir(t *testing.T) (pointURI, mainURI string) {
+	dir := t.TempDir()
+	pointF := filepath.Join(dir, "Point.jack")
+	if err := os.WriteFile(pointF, []byte(lspPoint), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pathToURI(pointF), pathToURI(filepath.Join(dir, "Main.jack"))
+}
+
+func TestLspNavigation(t *testing.T) {
+	pointURI, mainURI := setupLspDir(t)
+	msgs := lspSession(t,
+		map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": map[string]interface{}{}},
+		lspOpen(mainURI, lspMain),
+		lspCall(2, "textDocument/definition", mainURI, 5, 18),  // p of p.getX
+		lspCall(3, "textDocument/definition", mainURI, 5, 21),  // getX
+		lspCall(4, "textDocument/definition", mainURI, 4, 17),  // Point of Point.new
+		lspCall(5, "textDocument/definition", mainURI, 4, 23),  // new
+		lspCall(6, "textDocument/hover", mainURI, 6, 28),       // sum
+		lspCall(7, "textDocument/hover", mainURI, 5, 36),       // count
+		lspCall(8, "textDocument/definition", mainURI, 6, 15),  // Output
+		lspCall(9, "textDocument/definition", mainURI, 1, 3),   // keyword
+		lspCall(10, "textDocument/completion", mainURI, 7, 13), // after p.
+		lspCall(11, "textDocument/hover", pointURI, 5, 12),     // field x in the constructor
+	)
+
+	if res := lspResult(t, msgs, 1); !strings.Contains(res, `"definitionProvider":true`) {
+		t.Errorf("Wrong capabilities %s", res)
+	}
+
+	testCases := []struct {
+		id   int
+		want string
+	}{
+		{2, fmt.Sprintf(`{"range":{"end":{"character":19,"line":2},"start":{"character":18,"line":2}},"uri":"%s"}`, mainURI)},
+		{3, fmt.Sprintf(`{"range":{"end":{"character":19,"line":11},"start":{"character":15,"line":11}},"uri":"%s"}`, pointURI)},
+		{4, fmt.Sprintf(`{"range":{"end":{"character":11,"line":0},"start":{"character":6,"line":0}},"uri":"%s"}`, pointURI)},
+		{5, fmt.Sprintf(`{"range":{"end":{"character":25,"line":4},"start":{"character":22,"line":4}},"uri":"%s"}`, pointURI)},
+		{8, "null"},
+		{9, "null"},
+	}
+	for _, tc := range testCases {
+		if got := lspResult(t, msgs, tc.id); got != tc.want {
+			t.Errorf("Request %d: got %s; want %s", tc.id, got, tc.want)
+		}
+	}
+
+	hovers := map[int]string{
+		6:  "local int sum",
+		7:  "function int Point.count()",
+		11: "field int x",
+	}
+	for id, want := range hovers {
+		if got := lspResult(t, msgs, id); !strings.Contains(got, want) {
+			t.Errorf("Hover %d: got %s; want %s", id, got, want)
+		}
+	}
+	if got := lspResult(t, msgs, 6); !strings.Contains(got, "offset: 1") {
+		t.Errorf("Hover must show the offset: %s", got)
+	}
+
+	var items []lspCompletionItem
+	json.Unmarshal([]byte(lspResult(t, msgs, 10)), &items)
+	if len(items) != 1 || items[0].Label != "getX" || items[0].Kind != lspKindMethod {
+		t.Errorf("Got completion %v; want method getX", items)
+	}
+}
+
+func TestLspCompletionOfClass(t *testing.T) {
+	_, mainURI := setupLspDir(t)
+	text := strings.Replace(lspMain, "do p.", "do Point.c", 1)
+	msgs := lspSession(t,
+		lspOpen(mainURI, text),
+		lspCall(1, "textDocument/completion", mainURI, 7, 18),
+		lspCall(2, "textDocument/completion", mainURI, 6, 18), // after Output.
+	)
+	var items []lspCompletionItem
+	json.Unmarshal([]byte(lspResult(t, msgs, 1)), &items)
+	if len(items) != 2 || items[0].Label != "count" || items[1].Label != "new" {
+		t.Errorf("Got completion %v; want count and new", items)
+	}
+	json.Unmarshal([]byte(lspResult(t, msgs, 2)), &items)
+	if len(items) != 7 {
+		t.Errorf("Got %d functions of Output; want 7", len(items))
+	}
+}
+
+func TestLspDiagnostics(t *testing.T) {
+	_, mainURI := setupLspDir(t)
+	wrong := "class Main {\n    function void main() {\n        do Point.get();\n        let x = 1\n    }\n}\n"
+	checked := "class Main {\n    function void main() {\n        do Point.get();\n        return;\n    }\n}\n"
+	msgs := lspSession(t,
+		lspOpen(mainURI, wrong),
+		map[string]interface{}{
+			"jsonrpc": "2.0", "method": "textDocument/didSave",
+			"params": map[string]interface{}{
+				"textDocument": map[string]string{"uri": mainURI},
+				"text":         checked,
+			},
+		},
+	)
+
+	var published []string
+	for _, m := range msgs {
+		if m["method"] == "textDocument/publishDiagnostics" {
+			res, _ := json.Marshal(m["params"])
+			published = append(published, string(res))
+		}
+	}
+	if len(published) != 2 {
+		t.Fatalf("Got %d diagnostics notifications; want 2", len(published))
+	}
+	// Parse errors first, then the whole program checks after save
+	if !strings.Contains(published[0], `"code":"E0201"`) || !strings.Contains(published[0], `"line":4`) {
+		t.Errorf("Wrong parse diagnostics %s", published[0])
+	}
+	want := `"range":{"end":{"character":20,"line":2},"start":{"character":17,"line":2}}`
+	if !strings.Contains(published[1], `"code":"E0302"`) || !strings.Contains(published[1], want) {
+		t.Errorf("Wrong check diagnostics %s", published[1])
+	}
+}
+
+func TestLspBrokenSibling(t *testing.T) {
+	_, mainURI := setupLspDir(t)
+	broken := "class Point {\n    function int get( {\n        return 1 + ;\n    }\n}\n"
+	otherF := filepath.Join(filepath.Dir(uriToPath(mainURI)), "Other.jack")
+	if err := os.WriteFile(otherF, []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	main := "class Main {\n    function void main() {\n        do Point.count();\n        return;\n    }\n}\n"
+	msgs := lspSession(t,
+		lspOpen(mainURI, main),
+		lspCall(1, "textDocument/hover", mainURI, 2, 18),
+	)
+
+	var published string
+	for _, m := range msgs {
+		if m["method"] == "textDocument/publishDiagnostics" {
+			res, _ := json.Marshal(m["params"])
+			published = string(res)
+		}
+	}
+	// The broken sibling declares Point too. It is skipped and Main is checked against Point.jack
+	if !strings.Contains(published, `"diagnostics":[]`) {
+		t.Errorf("Got diagnostics %s; want none", published)
+	}
+	if res := lspResult(t, msgs, 1); !strings.Contains(res, "function int Point.count()") {
+		t.Errorf("Got hover %s", res)
+	}
+}
+
+func TestLspProtocolErrors(t *testing.T) {
+	msgs := lspSession(t, map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "workspace/symbol"})
+	if e, ok := msgs[0]["error"].(map[string]interface{}); !ok || e["code"].(float64) != lspMethodNotFound {
+		t.Errorf("Got %v; want method not found", msgs[0])
+	}
+
+	in := strings.NewReader("Content-Length: 2\r\n\r\n{}")
+	if err := NewLspServer(in, &bytes.Buffer{}).Run(); err == nil {
+		t.Error("Expected error for the closed stream")
+	}
+	in = strings.NewReader("Content-Length: 22\r\n\r\n{\"method\":\"exit\"}     ")
+	if err := NewLspServer(bufio.NewReader(in), &bytes.Buffer{}).Run(); err == nil {
+		t.Error("Expected error for exit without shutdown")
+	}
+}
@@ -1,7 +1,5 @@
 package main
 
-import "strconv"
-
 type NodeType int
 
 func (nt NodeType) Type() NodeType {
@@ -12,6 +10,7 @@ type Node interface {
 	Type() NodeType
 	Xml(xb *XmlBuilder)
 	Compile(c *Compiler)
+	Format(f *Formatter)
 }
 
 const (
@@ -38,6 +37,7 @@ type ClassNode struct {
 	Name   Token
 	VarDec []*ClassVarDecNode
 	SbrDec []*SubroutineDecNode
+	Doc    string // text of the /** */ comment before the class
 }
 
 func NewClassNode(name Token) *ClassNode {
@@ -68,10 +68,41 @@ func (cn *ClassNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol("}")
 }
 
+func (cn *ClassNode) Format(f *Formatter) {
+	f.Line()
+	f.Word("class")
+	f.Space()
+	f.Token(cn.Name)
+	f.Space()
+	f.Word("{")
+	f.Indent()
+	for _, vd := range cn.VarDec {
+		f.Line()
+		vd.Format(f)
+	}
+	for i, sd := range cn.SbrDec {
+		if i > 0 || len(cn.VarDec) > 0 {
+			f.BlankLine()
+		}
+		f.Line()
+		sd.Format(f)
+	}
+	f.Dedent()
+	f.Line()
+	f.Word("}")
+}
+
 func (cn *ClassNode) Compile(c *Compiler) {
 	c.Tbl.CreateTable(cn.Name.GetValue())
 	defer c.Tbl.CloseTable()
 
+	c.sbrKinds = make(map[string]string)
+	for _, sbr := range cn.SbrDec {
+		if _, ok := c.sbrKinds[sbr.Name.GetValue()]; !ok {
+			c.sbrKinds[sbr.Name.GetValue()] = sbr.SbrKind.GetValue()
+		}
+	}
+
 	for _, vd := range cn.VarDec {
 		vd.Compile(c)
 	}
@@ -113,6 +144,21 @@ func (cvd *ClassVarDecNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol(";")
 }
 
+func (cvd *ClassVarDecNode) Format(f *Formatter) {
+	f.Token(cvd.Kind)
+	f.Space()
+	f.Token(cvd.VarType)
+	f.Space()
+	for i, n := range cvd.Names {
+		if i > 0 {
+			f.Word(",")
+			f.Space()
+		}
+		f.Token(n)
+	}
+	f.Word(";")
+}
+
 func (cvd *ClassVarDecNode) Compile(c *Compiler) {
 	var vk VarKind
 	if cvd.Kind.GetValue() == "field" {
@@ -122,7 +168,7 @@ func (cvd *ClassVarDecNode) Compile(c *Compiler) {
 	}
 
 	for _, n := range cvd.Names {
-		c.Tbl.AddVar(vk, cvd.VarType.GetValue(), n.GetValue())
+		c.declare(vk, cvd.VarType, n)
 	}
 }
 
@@ -133,10 +179,24 @@ type SubroutineDecNode struct {
 	Name       Token
 	ParamList  *ParameterListNode
 	Body       *SubroutineBodyNode
+	Doc        string // text of the /** */ comment before the subroutine
 }
 
 func NewSubroutineDecNode(sc Token, rt Token, name Token, param *ParameterListNode, b *SubroutineBodyNode) *SubroutineDecNode {
-	return &SubroutineDecNode{NodeSubroutineDec, sc, rt, name, param, b}
+	return &SubroutineDecNode{NodeSubroutineDec, sc, rt, name, param, b, ""}
+}
+
+// Signature returns kind, return type, name and parameter types of the subroutine
+func (sdn *SubroutineDecNode) Signature() SbrInfo {
+	si := SbrInfo{
+		Kind:       sdn.SbrKind.GetValue(),
+		ReturnType: sdn.ReturnType.GetValue(),
+		Name:       sdn.Name.GetValue(),
+	}
+	for _, vt := range sdn.ParamList.varTypes {
+		si.Params = append(si.Params, vt.GetValue())
+	}
+	return si
 }
 
 func (sdn *SubroutineDecNode) Xml(xb *XmlBuilder) {
@@ -152,6 +212,19 @@ func (sdn *SubroutineDecNode) Xml(xb *XmlBuilder) {
 	sdn.Body.Xml(xb)
 }
 
+func (sdn *SubroutineDecNode) Format(f *Formatter) {
+	f.Token(sdn.SbrKind)
+	f.Space()
+	f.Token(sdn.ReturnType)
+	f.Space()
+	f.Token(sdn.Name)
+	f.Word("(")
+	sdn.ParamList.Format(f)
+	f.Word(")")
+	f.Space()
+	sdn.Body.Format(f)
+}
+
 func (sdn *SubroutineDecNode) Compile(c *Compiler) {
 	// Get field count for constructor
 	fieldsCount := c.Tbl.Count(Field)
@@ -161,16 +234,18 @@ func (sdn *SubroutineDecNode) Compile(c *Compiler) {
 	c.Tbl.CreateTable(fn)
 	defer c.Tbl.CloseTable()
 
-	c.Function(fn, sdn.Body.LocalVarLen())
+	c.sbrKind = sdn.SbrKind.GetValue()
+	c.resetLabels()
+	c.Function(fn, sdn.SbrKind.GetValue(), sdn.Body.LocalVarLen())
 	if sdn.SbrKind.GetValue() == "constructor" {
-		c.Push(ConstSegm, strconv.Itoa(fieldsCount))
+		c.Push(ConstSegm, fieldsCount)
 		c.Call("Memory.alloc", 1)
-		c.Pop(PointerSegm, "0")
+		c.Pop(PointerSegm, 0)
 	}
 	if sdn.SbrKind.GetValue() == "method" {
 		c.Tbl.AddVar(Arg, className, "this") // add this as the first argument
-		c.Push(ArgSegm, "0")                 // Push first arg to stack
-		c.Pop(PointerSegm, "0")              // This = arg 0
+		c.Push(ArgSegm, 0)                   // Push first arg to stack
+		c.Pop(PointerSegm, 0)                // This = arg 0
 	}
 
 	sdn.ParamList.Compile(c)
@@ -211,10 +286,21 @@ func (pln *ParameterListNode) Xml(xb *XmlBuilder) {
 	}
 }
 
+func (pln *ParameterListNode) Format(f *Formatter) {
+	for i, vt := range pln.varTypes {
+		if i > 0 {
+			f.Word(",")
+			f.Space()
+		}
+		f.Token(vt)
+		f.Space()
+		f.Token(pln.varNames[i])
+	}
+}
+
 func (pln *ParameterListNode) Compile(c *Compiler) {
 	for i, vt := range pln.varTypes {
-		vn := pln.varNames[i]
-		c.Tbl.AddVar(Arg, vt.GetValue(), vn.GetValue())
+		c.declare(Arg, vt, pln.varNames[i])
 	}
 }
 
@@ -252,6 +338,22 @@ func (sbn *SubroutineBodyNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol("}")
 }
 
+func (sbn *SubroutineBodyNode) Format(f *Formatter) {
+	f.Word("{")
+	f.Indent()
+	for _, vd := range sbn.VarDec {
+		f.Line()
+		vd.Format(f)
+	}
+	if len(sbn.VarDec) > 0 && len(sbn.Statm.StList) > 0 {
+		f.BlankLine()
+	}
+	sbn.Statm.Format(f)
+	f.Dedent()
+	f.Line()
+	f.Word("}")
+}
+
 func (sbn *SubroutineBodyNode) Compile(c *Compiler) {
 	for _, vd := range sbn.VarDec {
 		vd.Compile(c)
@@ -299,9 +401,24 @@ func (vdn *VarDecNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol(";")
 }
 
+func (vdn *VarDecNode) Format(f *Formatter) {
+	f.Word("var")
+	f.Space()
+	f.Token(vdn.VarType)
+	f.Space()
+	for i, id := range vdn.Ids {
+		if i > 0 {
+			f.Word(",")
+			f.Space()
+		}
+		f.Token(id)
+	}
+	f.Word(";")
+}
+
 func (vdn *VarDecNode) Compile(c *Compiler) {
 	for _, id := range vdn.Ids {
-		c.Tbl.AddVar(Local, vdn.VarType.GetValue(), id.GetValue())
+		c.declare(Local, vdn.VarType, id)
 	}
 }
 
@@ -341,25 +458,39 @@ func (lsn *LetStatementNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol(";")
 }
 
+func (lsn *LetStatementNode) Format(f *Formatter) {
+	f.Word("let")
+	f.Space()
+	f.Token(lsn.VarName)
+	if lsn.ArrayExp != nil {
+		f.Word("[")
+		lsn.ArrayExp.Format(f)
+		f.Word("]")
+	}
+	f.Space()
+	f.Word("=")
+	f.Space()
+	lsn.ValueExp.Format(f)
+	f.Word(";")
+}
+
 func (lsn *LetStatementNode) Compile(c *Compiler) {
-	vi := c.Tbl.GetVarInfo(lsn.VarName.GetValue())
+	vi := c.lookup(lsn.VarName)
 	segm := GetSegment(vi.Kind)
 	if lsn.ArrayExp == nil {
 		lsn.ValueExp.Compile(c)
-		c.Pop(segm, strconv.Itoa(vi.Offset))
+		c.Pop(segm, vi.Offset)
 	} else {
 		// let a[expr1] = b[expr2]
-		c.Push(segm, strconv.Itoa(vi.Offset))
-		lsn.ArrayExp.Compile(c)
-		c.BinaryOp("+") // Calc address a + expr1 and push it onto the stack
+		c.arrayAddress(vi, lsn.ArrayExp) // Calc address a + expr1 and push it onto the stack
 
 		// Right expression
 		lsn.ValueExp.Compile(c)
-		c.Pop(TempSegm, "0") // Pop it to the temp var
+		c.Pop(TempSegm, 0) // Pop it to the temp var
 
-		c.Pop(PointerSegm, "1") // Write a+expr1 addr to THAT
-		c.Push(TempSegm, "0")   // Push temp (expr2) onto the stack
-		c.Pop(ThatSegm, "0")    // Write expr2 from the stack into a + expr1
+		c.Pop(PointerSegm, 1) // Write a+expr1 addr to THAT
+		c.Push(TempSegm, 0)   // Push temp (expr2) onto the stack
+		c.Pop(ThatSegm, 0)    // Write expr2 from the stack into a + expr1
 	}
 }
 
@@ -385,6 +516,14 @@ func (sn *StatementsNode) Xml(xb *XmlBuilder) {
 	}
 }
 
+// Format puts every statement on its own line
+func (sn *StatementsNode) Format(f *Formatter) {
+	for _, s := range sn.StList {
+		f.Line()
+		s.Format(f)
+	}
+}
+
 func (sn *StatementsNode) Compile(c *Compiler) {
 	for _, st := range sn.StList {
 		st.Compile(c)
@@ -425,7 +564,36 @@ func (ifn *IfStatementNode) Xml(xb *XmlBuilder) {
 	}
 }
 
+func (ifn *IfStatementNode) Format(f *Formatter) {
+	f.Word("if")
+	f.Space()
+	f.Word("(")
+	ifn.IfExpr.Format(f)
+	f.Word(")")
+	f.Space()
+	formatBlock(f, ifn.IfStat)
+	if ifn.ElseStat != nil {
+		f.Space()
+		f.Word("else")
+		f.Space()
+		formatBlock(f, ifn.ElseStat)
+	}
+}
+
+func formatBlock(f *Formatter, sn *StatementsNode) {
+	f.Word("{")
+	f.Indent()
+	sn.Format(f)
+	f.Dedent()
+	f.Line()
+	f.Word("}")
+}
+
 func (ifn *IfStatementNode) Compile(c *Compiler) {
+	if c.Compat == CompatReference {
+		ifn.compileReference(c)
+		return
+	}
 	elseLabel, endLabel := c.OpenIf()
 
 	ifn.IfExpr.Compile(c)
@@ -444,6 +612,25 @@ func (ifn *IfStatementNode) Compile(c *Compiler) {
 	c.Label(endLabel)
 }
 
+// compileReference jumps to the true branch on the condition as the reference compiler does
+func (ifn *IfStatementNode) compileReference(c *Compiler) {
+	trueLabel, falseLabel, endLabel := c.OpenReferenceIf()
+
+	ifn.IfExpr.Compile(c)
+	c.IfGoto(trueLabel)
+	c.Goto(falseLabel)
+	c.Label(trueLabel)
+	ifn.IfStat.Compile(c)
+	if ifn.ElseStat == nil {
+		c.Label(falseLabel)
+		return
+	}
+	c.Goto(endLabel)
+	c.Label(falseLabel)
+	ifn.ElseStat.Compile(c)
+	c.Label(endLabel)
+}
+
 type WhileStatementNode struct {
 	NodeType
 	Expr *ExpressionNode
@@ -467,6 +654,16 @@ func (wsn *WhileStatementNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol("}")
 }
 
+func (wsn *WhileStatementNode) Format(f *Formatter) {
+	f.Word("while")
+	f.Space()
+	f.Word("(")
+	wsn.Expr.Format(f)
+	f.Word(")")
+	f.Space()
+	formatBlock(f, wsn.Stat)
+}
+
 func (wsn *WhileStatementNode) Compile(c *Compiler) {
 	bLabel, eLabel := c.OpenWhile()
 
@@ -496,19 +693,31 @@ func (ds *DoStatementNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol(";")
 }
 
+func (ds *DoStatementNode) Format(f *Formatter) {
+	f.Word("do")
+	f.Space()
+	ds.Call.Format(f)
+	f.Word(";")
+}
+
 func (ds *DoStatementNode) Compile(c *Compiler) {
 	ds.Call.Compile(c)
 	// Clean return from function
-	c.Pop(TempSegm, "0")
+	c.Pop(TempSegm, 0)
 }
 
 type ReturnStatementNode struct {
 	NodeType
-	Expr *ExpressionNode
+	Keyword Token
+	Expr    *ExpressionNode
+}
+
+func NewReturnNode(kw Token) *ReturnStatementNode {
+	return &ReturnStatementNode{NodeType: NodeReturnStatement, Keyword: kw}
 }
 
-func NewReturnNode() *ReturnStatementNode {
-	return &ReturnStatementNode{NodeType: NodeReturnStatement}
+func (rsn *ReturnStatementNode) firstToken() Token {
+	return rsn.Keyword
 }
 
 func (rsn *ReturnStatementNode) AddExpr(expr *ExpressionNode) {
@@ -526,11 +735,20 @@ func (rsn *ReturnStatementNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol(";")
 }
 
+func (rsn *ReturnStatementNode) Format(f *Formatter) {
+	f.Token(rsn.Keyword)
+	if rsn.Expr != nil {
+		f.Space()
+		rsn.Expr.Format(f)
+	}
+	f.Word(";")
+}
+
 func (rsn *ReturnStatementNode) Compile(c *Compiler) {
 	if rsn.Expr != nil {
 		rsn.Expr.Compile(c)
 	} else {
-		c.Push(ConstSegm, "0")
+		c.Push(ConstSegm, 0)
 	}
 	c.Return()
 }
@@ -551,6 +769,10 @@ func (en *ExpressionNode) AddOpTerm(op Token, term *TermNode) {
 	en.opTerms = append(en.opTerms, term)
 }
 
+func (en *ExpressionNode) firstToken() Token {
+	return en.term.firstToken()
+}
+
 func (en *ExpressionNode) Xml(xb *XmlBuilder) {
 	xb.Open("expression")
 	defer xb.Close()
@@ -567,6 +789,17 @@ func (en *ExpressionNode) Xml(xb *XmlBuilder) {
 	}
 }
 
+// Format puts spaces around binary operators
+func (en *ExpressionNode) Format(f *Formatter) {
+	en.term.Format(f)
+	for i, op := range en.ops {
+		f.Space()
+		f.Token(op)
+		f.Space()
+		en.opTerms[i].Format(f)
+	}
+}
+
 func (en *ExpressionNode) Compile(c *Compiler) {
 	if len(en.ops) != len(en.opTerms) {
 		panic("Expression node is build wrong in operations and terms")
@@ -610,6 +843,16 @@ func (eln *ExpressionListNode) Xml(xb *XmlBuilder) {
 	}
 }
 
+func (eln *ExpressionListNode) Format(f *Formatter) {
+	for i, expr := range eln.Exprs {
+		if i > 0 {
+			f.Word(",")
+			f.Space()
+		}
+		expr.Format(f)
+	}
+}
+
 func (eln *ExpressionListNode) Compile(c *Compiler) {
 	for _, expr := range eln.Exprs {
 		expr.Compile(c)
@@ -631,6 +874,21 @@ func NewSubroutineCallNode(sbrName Token, params *ExpressionListNode) *Subroutin
 	return &SubroutineCallNode{NodeType: NodeSubroutineCall, SubroutineName: sbrName, Params: params}
 }
 
+// FullName returns the called name as it is written, e.g. foo or Bar.foo
+func (scn *SubroutineCallNode) FullName() string {
+	if scn.Prefix != nil {
+		return scn.Prefix.GetValue() + "." + scn.SubroutineName.GetValue()
+	}
+	return scn.SubroutineName.GetValue()
+}
+
+func (scn *SubroutineCallNode) firstToken() Token {
+	if scn.Prefix != nil {
+		return scn.Prefix
+	}
+	return scn.SubroutineName
+}
+
 func (scn *SubroutineCallNode) Xml(xb *XmlBuilder) {
 	// Due to some reason  Subrooutine call does not have open/close tag
 	if scn.Prefix != nil {
@@ -643,6 +901,17 @@ func (scn *SubroutineCallNode) Xml(xb *XmlBuilder) {
 	xb.WriteSymbol(")")
 }
 
+func (scn *SubroutineCallNode) Format(f *Formatter) {
+	if scn.Prefix != nil {
+		f.Token(scn.Prefix)
+		f.Word(".")
+	}
+	f.Token(scn.SubroutineName)
+	f.Word("(")
+	scn.Params.Format(f)
+	f.Word(")")
+}
+
 func (scn *SubroutineCallNode) Compile(c *Compiler) {
 	var name string
 	var argCount int
@@ -651,9 +920,9 @@ func (scn *SubroutineCallNode) Compile(c *Compiler) {
 		// If prefix is a var name, then the called function is a method
 		if c.Tbl.IsVar(prefix) {
 			// We should set this as the current var, e,g. circle.Draw() this = circle
-			vi := c.Tbl.GetVarInfo(prefix)
+			vi := c.lookup(scn.Prefix)
 			segm := GetSegment(vi.Kind)
-			c.Push(segm, strconv.Itoa(vi.Offset))
+			c.Push(segm, vi.Offset)
 			argCount = 1
 			// Call it with class name
 			name = vi.Type + "." + scn.SubroutineName.GetValue()
@@ -665,8 +934,12 @@ func (scn *SubroutineCallNode) Compile(c *Compiler) {
 		// if there is no prefix, then the method is called inside the class
 		className := c.Tbl.ParentName()
 		name = className + "." + scn.SubroutineName.GetValue()
+		if kind, ok := c.sbrKinds[scn.SubroutineName.GetValue()]; ok && kind != "method" {
+			c.errorf(scn.SubroutineName, CodeWrongCallKind, "%s is a %s and must be called as %s", name, kind, name)
+		}
+		c.needThis(scn.SubroutineName, "Method "+name)
 		// Push this as the first parameter
-		c.Push(PointerSegm, "0")
+		c.Push(PointerSegm, 0)
 		argCount = 1
 	}
 
@@ -687,6 +960,7 @@ const (
 	termNodeExpr
 	termNodeCall
 	termNodeUnary
+	termNodeError // placeholder of a term with a syntax error
 )
 
 type TermNode struct {
@@ -736,6 +1010,23 @@ func NewUnaryTermNode(op Token, term *TermNode) *TermNode {
 	return &TermNode{NodeType: NodeTerm, termType: termNodeUnary, unaryOp: op, unaryTerm: term}
 }
 
+// NewErrorTermNode creates the placeholder of a wrong term, so the partial tree has no nil terms
+func NewErrorTermNode(at Token) *TermNode {
+	return &TermNode{NodeType: NodeTerm, termType: termNodeError, val: at}
+}
+
+func (tn *TermNode) firstToken() Token {
+	switch tn.termType {
+	case termNodeExpr:
+		return tn.exp.firstToken()
+	case termNodeCall:
+		return tn.call.firstToken()
+	case termNodeUnary:
+		return tn.unaryOp
+	}
+	return tn.val
+}
+
 func (tn *TermNode) Xml(xb *XmlBuilder) {
 	xb.Open("term")
 	defer xb.Close()
@@ -757,25 +1048,51 @@ func (tn *TermNode) Xml(xb *XmlBuilder) {
 		tn.unaryTerm.Xml(xb)
 	case termNodeCall:
 		tn.call.Xml(xb)
+	case termNodeError:
+		// the wrong term has no source
 	default:
 		panic("Xml is not defined for the type of node")
 	}
 }
 
+func (tn *TermNode) Format(f *Formatter) {
+	switch tn.termType {
+	case termNodeArray:
+		f.Token(tn.val)
+		f.Word("[")
+		tn.arrayIdx.Format(f)
+		f.Word("]")
+	case termNodeExpr:
+		f.Word("(")
+		tn.exp.Format(f)
+		f.Word(")")
+	case termNodeUnary:
+		f.Token(tn.unaryOp)
+		tn.unaryTerm.Format(f)
+	case termNodeCall:
+		tn.call.Format(f)
+	default:
+		f.Token(tn.val)
+	}
+}
+
 func (tn *TermNode) Compile(c *Compiler) {
 	switch tn.termType {
+	case termNodeError:
+		c.errorf(tn.val, CodeCompile, "Cannot compile the wrong term")
 	case termNodeIntConst:
-		c.Push(ConstSegm, tn.val.GetValue())
+		c.Push(ConstSegm, c.intConst(tn.val))
 	case termNodeKeyWordConst:
-		c.Push(ConstSegm, "0")
+		c.Push(ConstSegm, 0)
 		if tn.val.GetValue() == "true" {
 			c.UnaryOp("~")
 		}
 	case termNodeThis:
-		c.Push(PointerSegm, "0")
+		c.needThis(tn.val, "this")
+		c.Push(PointerSegm, 0)
 	case termNodeVar:
-		vi := c.Tbl.GetVarInfo(tn.val.GetValue())
-		c.Push(GetSegment(vi.Kind), strconv.Itoa(vi.Offset))
+		vi := c.lookup(tn.val)
+		c.Push(GetSegment(vi.Kind), vi.Offset)
 	case termNodeExpr:
 		tn.exp.Compile(c)
 	case termNodeUnary:
@@ -785,19 +1102,17 @@ func (tn *TermNode) Compile(c *Compiler) {
 		tn.call.Compile(c)
 	case termNodeStrConst:
 		strLen := len(tn.val.GetValue())
-		c.Push(ConstSegm, strconv.Itoa(strLen))
+		c.Push(ConstSegm, strLen)
 		c.Call("String.new", 1) // Create string and return pointer to it on the stack
 		for i := 0; i < strLen; i++ {
 			char := int(tn.val.GetValue()[i])
-			c.Push(ConstSegm, strconv.Itoa(char))
+			c.Push(ConstSegm, char)
 			c.Call("String.appendChar", 2) // String.appendChar(cretaedString, char)
 		}
 	case termNodeArray:
-		vi := c.Tbl.GetVarInfo(tn.val.GetValue())
-		c.Push(GetSegment(vi.Kind), strconv.Itoa(vi.Offset)) // Push arr var
-		tn.arrayIdx.Compile(c)                               // calc index i and push it
-		c.BinaryOp("+")                                      // calc address arr + i
-		c.Pop(PointerSegm, "1")                              // THAT = addr + i
-		c.Push(ThatSegm, "0")                                // Stack = *(addr + i)
+		vi := c.lookup(tn.val)
+		c.arrayAddress(vi, tn.arrayIdx) // calc address arr + i
+		c.Pop(PointerSegm, 1)           // THAT = addr + i
+		c.Push(ThatSegm, 0)             // Stack = *(addr + i)
 	}
 }
@@ -0,0 +1,252 @@
+package main
+
+// PeepholeRule rewrites a short sequence of instructions. Match gets exactly Len
+// instructions and returns their replacement. The replacement must be shorter
+type PeepholeRule struct {
+	Name  string
+	Len   int
+	Match func(code []VmInstr) (repl []VmInstr, ok bool)
+}
+
+// LayoutRule changes the layout of a control structure that starts at the instruction i.
+// Apply returns the whole new code
+type LayoutRule struct {
+	Name  string
+	Apply func(code []VmInstr, i int) (newCode []VmInstr, ok bool)
+}
+
+// Peephole applies the rules to the code until none of them matches.
+// Then the layout rules are applied
+type Peephole struct {
+	rules   []PeepholeRule
+	Layouts []LayoutRule
+}
+
+func NewPeephole(rules ...PeepholeRule) *Peephole {
+	return &Peephole{rules: rules}
+}
+
+// NewDefaultPeephole returns the optimizer with all the default rules
+func NewDefaultPeephole() *Peephole {
+	p := NewPeephole(DefaultPeepholeRules...)
+	p.Layouts = DefaultLayoutRules
+	return p
+}
+
+// Optimize returns the new code
+func (p *Peephole) Optimize(code []VmInstr) []VmInstr {
+	code = p.window(code)
+	for _, l := range p.Layouts {
+		for i := 0; i < len(code); i++ {
+			if newCode, ok := l.Apply(code, i); ok {
+				code = newCode
+			}
+		}
+	}
+	return code
+}
+
+// window adds the instructions one by one and tries the rules on the end of the result,
+// so a replacement is checked again with the code before it
+func (p *Peephole) window(code []VmInstr) []VmInstr {
+	out := make([]VmInstr, 0, len(code))
+	for _, vi := range code {
+		out = append(out, vi)
+		for p.reduce(&out) {
+		}
+	}
+	return out
+}
+
+func (p *Peephole) reduce(out *[]VmInstr) bool {
+	for _, r := range p.rules {
+		start := len(*out) - r.Len
+		if start < 0 {
+			continue
+		}
+		if repl, ok := r.Match((*out)[start:]); ok {
+			*out = append((*out)[:start], repl...)
+			return true
+		}
+	}
+	return false
+}
+
+func isPush(vi VmInstr, segm MemSegment, idx int) bool {
+	return vi.Op == VmPush && vi.Segm == segm && vi.Index == idx
+}
+
+func isPop(vi VmInstr, segm MemSegment, idx int) bool {
+	return vi.Op == VmPop && vi.Segm == segm && vi.Index == idx
+}
+
+var DefaultPeepholeRules = []PeepholeRule{
+	{
+		// ~~x is x
+		Name: "double-not", Len: 2,
+		Match: func(code []VmInstr) ([]VmInstr, bool) {
+			return nil, code[0].Op == VmNot && code[1].Op == VmNot
+		},
+	},
+	{
+		// true, e.g. while (true): the jump is unconditional
+		Name: "true-if-goto", Len: 3,
+		Match: func(code []VmInstr) ([]VmInstr, bool) {
+			if isPush(code[0], ConstSegm, 0) && code[1].Op == VmNot && code[2].Op == VmIfGoto {
+				return []VmInstr{{Op: VmGoto, Name: code[2].Name}}, true
+			}
+			return nil, false
+		},
+	},
+	{
+		// The condition is known: jump always or never
+		Name: "const-if-goto", Len: 2,
+		Match: func(code []VmInstr) ([]VmInstr, bool) {
+			if code[0].Op != VmPush || code[0].Segm != ConstSegm || code[1].Op != VmIfGoto {
+				return nil, false
+			}
+			if code[0].Index == 0 {
+				return nil, true
+			}
+			return []VmInstr{{Op: VmGoto, Name: code[1].Name}}, true
+		},
+	},
+	{
+		// if-goto jumps if the value is not 0, so x == 0 need not be calculated
+		Name: "zero-test", Len: 4,
+		Match: func(code []VmInstr) ([]VmInstr, bool) {
+			if isPush(code[0], ConstSegm, 0) && code[1].Op == VmEq && code[2].Op == VmNot && code[3].Op == VmIfGoto {
+				return code[3:], true
+			}
+			return nil, false
+		},
+	},
+	{
+		// The value is written where it was read from
+		Name: "push-pop", Len: 2,
+		Match: func(code []VmInstr) ([]VmInstr, bool) {
+			ok := code[0].Op == VmPush && code[0].Segm != ConstSegm &&
+				isPop(code[1], code[0].Segm, code[0].Index)
+			return nil, ok
+		},
+	},
+	{
+		Name: "goto-next", Len: 2,
+		Match: func(code []VmInstr) ([]VmInstr, bool) {
+			if code[0].Op == VmGoto && code[1].Op == VmLabel && code[0].Name == code[1].Name {
+				return code[1:], true
+			}
+			return nil, false
+		},
+	},
+	{
+		// let a[i] = x: x is pushed after THAT is set instead of being saved in temp 0.
+		// x must not depend on THAT
+		Name: "array-store", Len: 5,
+		Match: func(code []VmInstr) ([]VmInstr, bool) {
+			val := code[0]
+			if val.Op != VmPush || val.Segm == ThatSegm || val.Segm == PointerSegm ||
+				!isPop(code[1], TempSegm, 0) || !isPop(code[2], PointerSegm, 1) ||
+				!isPush(code[3], TempSegm, 0) || !isPop(code[4], ThatSegm, 0) {
+				return nil, false
+			}
+			return []VmInstr{code[2], val, code[4]}, true
+		},
+	},
+}
+
+// labelIndex returns the index of the label after the instruction i or -1.
+// The search stops at the end of the function
+func labelIndex(code []VmInstr, i int, name string) int {
+	for j := i + 1; j < len(code) && code[j].Op != VmFunction; j++ {
+		if code[j].Op == VmLabel && code[j].Name == name {
+			return j
+		}
+	}
+	return -1
+}
+
+// jumpCount returns the count of goto and if-goto to the label
+func jumpCount(code []VmInstr, name string) int {
+	n := 0
+	for _, vi := range code {
+		if (vi.Op == VmGoto || vi.Op == VmIfGoto) && vi.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// concat joins the parts into the new code
+func concat(parts ...[]VmInstr) []VmInstr {
+	var code []VmInstr
+	for _, p := range parts {
+		code = append(code, p...)
+	}
+	return code
+}
+
+// Layout rules remove the negation of the condition that the compiler emits for if and while.
+// An if without else keeps it: its code would be longer without the negation
+var DefaultLayoutRules = []LayoutRule{
+	{
+		// not; if-goto L; T; goto E; label L; F; label E
+		// ->   if-goto L; F; goto E; label L; T; label E
+		Name: "if-else",
+		Apply: func(code []VmInstr, i int) ([]VmInstr, bool) {
+			if i+1 >= len(code) || code[i].Op != VmNot || code[i+1].Op != VmIfGoto {
+				return nil, false
+			}
+			l := code[i+1].Name
+			j := labelIndex(code, i+1, l)
+			if j < 0 || code[j-1].Op != VmGoto || jumpCount(code, l) != 1 {
+				return nil, false
+			}
+			e := code[j-1].Name
+			k := labelIndex(code, j, e)
+			if k < 0 {
+				return nil, false
+			}
+			return concat(code[:i], code[i+1:i+2], code[j+1:k], code[j-1:j+1], code[i+2:j-1], code[k:]), true
+		},
+	},
+	{
+		// label B; C; not; if-goto E; BODY; goto B; label E
+		// -> goto E; label B; BODY; label E; C; if-goto B
+		// The loop jumps once per iteration instead of twice
+		Name: "while",
+		Apply: func(code []VmInstr, i int) ([]VmInstr, bool) {
+			if code[i].Op != VmLabel {
+				return nil, false
+			}
+			b := code[i].Name
+			// The condition is straight code
+			n := i + 1
+			for n < len(code) && !isFlow(code[n]) {
+				n++
+			}
+			if n+1 >= len(code) || code[n-1].Op != VmNot || code[n].Op != VmIfGoto {
+				return nil, false
+			}
+			e := code[n].Name
+			g := labelIndex(code, n, e) - 1
+			if g <= n || code[g].Op != VmGoto || code[g].Name != b ||
+				jumpCount(code, b) != 1 || jumpCount(code, e) != 1 {
+				return nil, false
+			}
+			head := []VmInstr{{Op: VmGoto, Name: e}, code[i]}
+			tail := []VmInstr{code[g+1]}
+			jump := []VmInstr{{Op: VmIfGoto, Name: b}}
+			return concat(code[:i], head, code[n+1:g], tail, code[i+1:n-1], jump, code[g+2:]), true
+		},
+	},
+}
+
+// isFlow reports that the instruction changes the flow or can be a target of a jump
+func isFlow(vi VmInstr) bool {
+	switch vi.Op {
+	case VmLabel, VmGoto, VmIfGoto, VmFunction, VmReturn:
+		return true
+	}
+	return false
+}
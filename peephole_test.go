@@ -0,0 +1,243 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func vmLines(code []VmInstr) string {
+	lines := make([]string, len(code))
+	for i, vi := range code {
+		lines[i] = vi.String()
+	}
+	return strings.Join(lines, "; ")
+}
+
+func TestPeepholeRules(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"double-not", "push local 0\nnot\nnot\npop local 1", "push local 0; pop local 1"},
+		{"true-if-goto", "push constant 0\nnot\nif-goto L", "goto L"},
+		{"while-true", "label B\npush constant 0\nnot\nnot\nif-goto E", "label B"},
+		{"if-not", "push argument 0\nnot\nnot\nif-goto L", "push argument 0; if-goto L"},
+		{"const-if-goto", "push constant 7\nif-goto L\npush constant 0\nif-goto M", "goto L"},
+		{"push-pop", "push this 1\npop this 1\npush constant 1\npop temp 0", "push constant 1; pop temp 0"},
+		{"push-pop-other", "push this 1\npop this 2", "push this 1; pop this 2"},
+		{"goto-next", "goto L\nlabel L\ngoto M\nlabel N", "label L; goto M; label N"},
+		{
+			"array-store",
+			"push local 0\npush constant 1\nadd\npush argument 2\npop temp 0\npop pointer 1\npush temp 0\npop that 0",
+			"push local 0; push constant 1; add; pop pointer 1; push argument 2; pop that 0",
+		},
+		{
+			"array-store-that",
+			"push that 0\npop temp 0\npop pointer 1\npush temp 0\npop that 0",
+			"push that 0; pop temp 0; pop pointer 1; push temp 0; pop that 0",
+		},
+		{"nested", "push local 2\npush local 0\npush local 1\npop local 1\npop local 0\nnot\npush this 0\npop this 0\nnot", "push local 2"},
+	}
+
+	ph := NewPeephole(DefaultPeepholeRules...)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, err := ParseVm("Test", tc.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := vmLines(ph.Optimize(code)); got != tc.want {
+				t.Errorf("Got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPeepholeLayouts(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			"if-else",
+			"push local 0\nnot\nif-goto L\npush constant 1\ngoto E\nlabel L\npush constant 2\nlabel E",
+			"push local 0; if-goto L; push constant 2; goto E; label L; push constant 1; label E",
+		},
+		{
+			"if-else-nested",
+			"push local 0\nnot\nif-goto L\npush local 1\nnot\nif-goto L1\npush constant 1\ngoto E1\nlabel L1\npush constant 2\nlabel E1\ngoto E\nlabel L\npush constant 3\nlabel E",
+			"push local 0; if-goto L; push constant 3; goto E; label L; push local 1; if-goto L1; push constant 2; goto E1; label L1; push constant 1; label E1; label E",
+		},
+		{
+			"if-without-else",
+			"push local 0\nnot\nif-goto E\npush constant 1\nlabel E",
+			"push local 0; not; if-goto E; push constant 1; label E",
+		},
+		{
+			"if-else-label-reused",
+			"push local 0\nnot\nif-goto L\npush constant 1\ngoto E\nlabel L\npush constant 2\nlabel E\ngoto L",
+			"push local 0; not; if-goto L; push constant 1; goto E; label L; push constant 2; label E; goto L",
+		},
+		{
+			"while",
+			"label B\npush local 0\npush constant 5\nlt\nnot\nif-goto E\npush local 1\npop local 2\ngoto B\nlabel E\nreturn",
+			"goto E; label B; push local 1; pop local 2; label E; push local 0; push constant 5; lt; if-goto B; return",
+		},
+		{
+			"while-nested",
+			"label B\npush local 0\nnot\nif-goto E\nlabel B1\npush local 1\nnot\nif-goto E1\ngoto B1\nlabel E1\ngoto B\nlabel E",
+			"goto E; label B; goto E1; label B1; label E1; push local 1; if-goto B1; label E; push local 0; if-goto B",
+		},
+		{
+			"while-other-function",
+			"label B\npush local 0\nnot\nif-goto E\ngoto B\nfunction F 0\nlabel E",
+			"label B; push local 0; not; if-goto E; goto B; function F 0; label E",
+		},
+		{"zero-test", "push local 0\npush constant 0\neq\nnot\nif-goto L", "push local 0; if-goto L"},
+	}
+
+	ph := NewDefaultPeephole()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, err := ParseVm("Test", tc.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := vmLines(ph.Optimize(code)); got != tc.want {
+				t.Errorf("Got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPeepholeNoRules(t *testing.T) {
+	code, _ := ParseVm("Test", "push constant 0\nnot\nnot\nif-goto L")
+	if got := NewPeephole().Optimize(code); len(got) != len(code) {
+		t.Errorf("Got %s; want the same code", vmLines(got))
+	}
+}
+
+// compileAndRun runs the program and returns the output and the count of vm commands
+func compileAndRun(t *testing.T, ph *Peephole, classes ...string) (string, int) {
+	t.Helper()
+	emu := NewVmEmulator()
+	jos := NewJackOS(emu)
+	size := 0
+	for _, code := range classes {
+		root := parseClass(t, code)
+		comp := NewCompiler()
+		comp.Peephole = ph
+		if err := comp.Run(root); err != nil {
+			t.Fatalf("Compilation error: %v", err)
+		}
+		size += len(comp.Code())
+		if err := emu.Load(root.Name.GetValue(), comp.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := jos.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := emu.Run(1000000); err != nil {
+		t.Fatal(err)
+	}
+	return jos.Text(), size
+}
+
+func TestPeepholeSemantics(t *testing.T) {
+	testCases := []struct {
+		name    string
+		classes []string
+	}{
+		{"loops", []string{`class Main {
+			function void main() {
+				var int i, sum;
+				while (true) {
+					let i = i + 1;
+					if (~(i < 10)) {
+						do Output.printInt(sum);
+						return;
+					}
+					if (~(i = 3)) { let sum = sum + i; } else { let sum = sum - 1; }
+				}
+				return;
+			}
+		}`}},
+		{"branches", []string{`class Main {
+			function void main() {
+				var int i, j, n;
+				while (i < 4) {
+					let j = 0;
+					while (j < i) {
+						if (j = 0) { let n = n + 10; } else { let n = n + j; }
+						if (j > 1) { let n = n - 1; }
+						let j = j + 1;
+					}
+					let i = i + 1;
+				}
+				do Output.printInt(n);
+				return;
+			}
+		}`}},
+		{"arrays", []string{`class Main {
+			function void main() {
+				var Array a, b;
+				var int i;
+				let a = Array.new(5);
+				let b = Array.new(5);
+				let a[0] = 10;
+				let i = 1;
+				while (i < 5) {
+					let a[i] = a[i - 1] + i;
+					let b[i] = i;
+					let b[a[i] - a[i - 1]] = true;
+					let i = i + 1;
+				}
+				let i = 0;
+				while (i < 5) {
+					do Output.printInt(a[i]);
+					do Output.printInt(b[i]);
+					let i = i + 1;
+				}
+				return;
+			}
+		}`}},
+		{"objects", []string{`class Main {
+			function void main() {
+				var Counter c;
+				let c = Counter.new();
+				do c.add(5);
+				do c.add(-2);
+				do Output.printInt(c.get());
+				if (c.isPositive()) { do Output.printString("yes"); }
+				if (false) { do Output.printString("never"); }
+				return;
+			}
+		}`, `class Counter {
+			field int n;
+			field boolean pos;
+			constructor Counter new() { let n = n; return this; }
+			method void add(int d) { let n = n + d; let pos = ~(n < 1); return; }
+			method int get() { return n; }
+			method boolean isPositive() { return ~~pos; }
+		}`}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			want, size := compileAndRun(t, nil, tc.classes...)
+			got, optSize := compileAndRun(t, NewDefaultPeephole(), tc.classes...)
+			if want == "" {
+				t.Fatal("The program prints nothing")
+			}
+			if got != want {
+				t.Errorf("Got output %q; want %q", got, want)
+			}
+			if optSize >= size {
+				t.Errorf("Optimized code has %d commands; want less than %d", optSize, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VmRunner executes vm files headless with the native OS
+type VmRunner struct {
+	Emu *VmEmulator
+	OS  *JackOS
+}
+
+// NewVmRunner loads the vm files. Static variables of every file are named after it
+func NewVmRunner(vmFiles []string) (*VmRunner, error) {
+	emu := NewVmEmulator()
+	r := &VmRunner{Emu: emu, OS: NewJackOS(emu)}
+	for _, vmF := range vmFiles {
+		code, err := os.ReadFile(vmF)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(vmF), filepath.Ext(vmF))
+		if err := emu.Load(name, string(code)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Run boots the program and executes it until Sys.halt or for the count of steps.
+// Reaching the count of steps is not an error
+func (r *VmRunner) Run(steps int) error {
+	if err := r.OS.Boot(); err != nil {
+		return err
+	}
+	if err := r.Emu.Run(steps); err != nil && err != ErrCycleLimit {
+		return err
+	}
+	return nil
+}
+
+// ScreenImage returns the screen memory map RAM[16384..24575] as a 512x256 image
+func ScreenImage(emu *VmEmulator) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, screenWidth, screenHeight))
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			c := color.Gray{Y: 255}
+			if emu.Pixel(x, y) {
+				c.Y = 0
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+func WriteScreenPNG(w io.Writer, emu *VmEmulator) error {
+	return png.Encode(w, ScreenImage(emu))
+}
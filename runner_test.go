@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeVmFiles(t *testing.T, files map[string]string) []string {
+	dir := t.TempDir()
+	var paths []string
+	for name, code := range files {
+		p := filepath.Join(dir, name+".vm")
+		if err := os.WriteFile(p, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func TestRunnerScreenPNG(t *testing.T) {
+	main := `function Main.main 0
+push constant 3
+push constant 1
+push constant 20
+push constant 2
+call Screen.drawRectangle 4
+pop temp 0
+push constant 511
+push constant 255
+call Screen.drawPixel 2
+pop temp 0
+call Sys.halt 0
+pop temp 0
+push constant 0
+return
+`
+	r, err := NewVmRunner(writeVmFiles(t, map[string]string{"Main": main}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Emu.Halted() {
+		t.Error("The program must halt")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteScreenPNG(buf, r.Emu); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 512 || b.Dy() != 256 {
+		t.Fatalf("Got image %v; want 512x256", b)
+	}
+
+	black := 0
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 512; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r == 0 {
+				black++
+			}
+		}
+	}
+	if black != 18*2+1 {
+		t.Errorf("Got %d black pixels; want 37", black)
+	}
+	for _, p := range [][2]int{{3, 1}, {20, 2}, {511, 255}} {
+		if r, _, _, _ := img.At(p[0], p[1]).RGBA(); r != 0 {
+			t.Errorf("Pixel %v must be black", p)
+		}
+	}
+}
+
+func TestRunnerSteps(t *testing.T) {
+	sys := `function Sys.init 0
+label LOOP
+push constant 1
+push constant 0
+call Memory.poke 2
+pop temp 0
+goto LOOP
+`
+	r, err := NewVmRunner(writeVmFiles(t, map[string]string{"Sys": sys}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(100); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if r.Emu.Halted() || r.Emu.Cycles != 100 {
+		t.Errorf("Halted %v after %d steps; want running after 100", r.Emu.Halted(), r.Emu.Cycles)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// SymbolScope is a symbol table of a class or a subroutine prepared for the dump
+type SymbolScope struct {
+	Scope   string          `json:"scope"` // class or subroutine
+	Name    string          `json:"name"`
+	Counts  map[VarKind]int `json:"counts"`
+	Symbols []SymbolJSON    `json:"symbols"`
+}
+
+// SymbolJSON is a variable of the dump
+type SymbolJSON struct {
+	Name  string  `json:"name"`
+	Kind  VarKind `json:"kind"`
+	Type  string  `json:"type"`
+	Index int     `json:"index"`
+}
+
+// DumpSymbols converts the tables into the dump. Subroutine tables are named Class.subroutine
+func DumpSymbols(tables []*SymbolTable) []SymbolScope {
+	scopes := make([]SymbolScope, 0, len(tables))
+	for _, tbl := range tables {
+		sc := SymbolScope{Scope: "class", Name: tbl.Name, Counts: make(map[VarKind]int), Symbols: []SymbolJSON{}}
+		kinds := []VarKind{Field, Static}
+		if strings.Contains(tbl.Name, ".") {
+			sc.Scope = "subroutine"
+			kinds = []VarKind{Arg, Local}
+		}
+		for _, vk := range kinds {
+			sc.Counts[vk] = tbl.Count(vk)
+		}
+		for _, e := range tbl.Entries() {
+			sc.Symbols = append(sc.Symbols, SymbolJSON{e.Name, e.Kind, e.Type, e.Offset})
+		}
+		scopes = append(scopes, sc)
+	}
+	return scopes
+}
+
+// WriteSymbols writes the tables as text or json
+func WriteSymbols(w io.Writer, tables []*SymbolTable, format string) error {
+	scopes := DumpSymbols(tables)
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(scopes)
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for i, sc := range scopes {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			fmt.Fprintf(tw, "%s %s\n", sc.Scope, sc.Name)
+			fmt.Fprintln(tw, "name\tkind\ttype\tindex")
+			for _, s := range sc.Symbols {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", s.Name, s.Kind, s.Type, s.Index)
+			}
+			var counts []string
+			for _, vk := range []VarKind{Field, Static, Arg, Local} {
+				if n, ok := sc.Counts[vk]; ok {
+					counts = append(counts, fmt.Sprintf("%s %d", vk, n))
+				}
+			}
+			fmt.Fprintf(tw, "count: %s\n", strings.Join(counts, ", "))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown symbols format \"%s\". Expected text or json", format)
+}
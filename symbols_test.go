@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const symbolsCode = `class Point {
+    field int x, y;
+    static int count;
+
+    constructor Point new(int ax, int ay) {
+        let x = ax;
+        let y = ay;
+        return this;
+    }
+
+    method int dist(Point other) {
+        var int dx, dy;
+        let dx = x - other.getX();
+        let dy = y;
+        return dx + dy;
+    }
+}
+`
+
+func compileSymbols(t *testing.T) []*SymbolTable {
+	comp := NewCompiler()
+	comp.Tbl.Keep = true
+	if err := comp.Run(parseClass(t, symbolsCode)); err != nil {
+		t.Fatal(err)
+	}
+	return comp.Tbl.Created
+}
+
+func TestWriteSymbolsText(t *testing.T) {
+	var sb strings.Builder
+	if err := WriteSymbols(&sb, compileSymbols(t), "text"); err != nil {
+		t.Fatal(err)
+	}
+	want := `class Point
+name   kind    type  index
+x      field   int   0
+y      field   int   1
+count  static  int   0
+count: field 2, static 1
+
+subroutine Point.new
+name  kind      type  index
+ax    argument  int   0
+ay    argument  int   1
+count: argument 2, local 0
+
+subroutine Point.dist
+name   kind      type   index
+this   argument  Point  0
+other  argument  Point  1
+dx     local     int    0
+dy     local     int    1
+count: argument 2, local 2
+`
+	if sb.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestWriteSymbolsJson(t *testing.T) {
+	var sb strings.Builder
+	if err := WriteSymbols(&sb, compileSymbols(t), "json"); err != nil {
+		t.Fatal(err)
+	}
+	var scopes []struct {
+		Scope   string
+		Name    string
+		Counts  map[string]int
+		Symbols []struct {
+			Name  string
+			Kind  string
+			Type  string
+			Index int
+		}
+	}
+	if err := json.Unmarshal([]byte(sb.String()), &scopes); err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 3 {
+		t.Fatalf("Got %d scopes; want 3", len(scopes))
+	}
+	dist := scopes[2]
+	if dist.Scope != "subroutine" || dist.Name != "Point.dist" || dist.Counts["argument"] != 2 || dist.Counts["local"] != 2 {
+		t.Errorf("Got scope %+v", dist)
+	}
+	if s := dist.Symbols[0]; s.Name != "this" || s.Kind != "argument" || s.Type != "Point" || s.Index != 0 {
+		t.Errorf("Got the first symbol %+v; want this argument", s)
+	}
+
+	if err := WriteSymbols(&sb, nil, "xml"); err == nil {
+		t.Error("Got no error for an unknown format")
+	}
+}
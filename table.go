@@ -1,9 +1,6 @@
 package main
 
-import (
-	"errors"
-	"fmt"
-)
+import "sort"
 
 type VarKind int
 
@@ -14,6 +11,22 @@ const (
 	Local
 )
 
+var varKindNames = map[VarKind]string{
+	Field:  "field",
+	Static: "static",
+	Arg:    "argument",
+	Local:  "local",
+}
+
+func (vk VarKind) String() string {
+	return varKindNames[vk]
+}
+
+// MarshalText is used to write the kind as a string into json
+func (vk VarKind) MarshalText() ([]byte, error) {
+	return []byte(vk.String()), nil
+}
+
 type VarInfo struct {
 	Kind   VarKind
 	Type   string
@@ -40,7 +53,7 @@ func NewSymbolTable(name string) *SymbolTable {
 
 func (st *SymbolTable) AddVar(kind VarKind, vType, name string) error {
 	if _, ok := st.table[name]; ok {
-		return fmt.Errorf("Var named %s already in the symbol table %s", name, st.Name)
+		return errorDiag(CodeRedeclared, "Var named %s already in the symbol table %s", name, st.Name)
 	}
 	st.table[name] = VarInfo{kind, vType, st.counter[kind]}
 	st.counter[kind] = st.counter[kind] + 1
@@ -50,7 +63,7 @@ func (st *SymbolTable) AddVar(kind VarKind, vType, name string) error {
 func (st *SymbolTable) GetVarInfo(name string) (vi VarInfo, err error) {
 	var ok bool
 	if vi, ok = st.table[name]; !ok {
-		err = errors.New("Not found")
+		err = errorDiag(CodeUndeclaredVar, "A variable named \"%s\" was not declared", name)
 	}
 	return
 }
@@ -59,13 +72,36 @@ func (st *SymbolTable) Count(kind VarKind) int {
 	return st.counter[kind]
 }
 
+// SymbolEntry is a variable of a symbol table
+type SymbolEntry struct {
+	Name string
+	VarInfo
+}
+
+// Entries returns all the variables of the table sorted by kind and offset
+func (st *SymbolTable) Entries() []SymbolEntry {
+	entries := make([]SymbolEntry, 0, len(st.table))
+	for name, vi := range st.table {
+		entries = append(entries, SymbolEntry{name, vi})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Offset < entries[j].Offset
+	})
+	return entries
+}
+
 type SymbolTableList struct {
-	list []*SymbolTable
+	list    []*SymbolTable
+	Keep    bool           // created tables are collected into Created
+	Created []*SymbolTable // in the order of creation
 }
 
 func NewSymbolTableList() *SymbolTableList {
 	list := make([]*SymbolTable, 0)
-	return &SymbolTableList{list}
+	return &SymbolTableList{list: list}
 }
 
 func (stl *SymbolTableList) find(name string) (VarInfo, error) {
@@ -75,12 +111,15 @@ func (stl *SymbolTableList) find(name string) (VarInfo, error) {
 			return vi, nil
 		}
 	}
-	return VarInfo{}, fmt.Errorf("A variable named \"%s\" was not declared", name)
+	return VarInfo{}, errorDiag(CodeUndeclaredVar, "A variable named \"%s\" was not declared", name)
 }
 
 func (stl *SymbolTableList) CreateTable(name string) {
 	tbl := NewSymbolTable(name)
 	stl.list = append(stl.list, tbl)
+	if stl.Keep {
+		stl.Created = append(stl.Created, tbl)
+	}
 }
 
 func (stl *SymbolTableList) CloseTable() {
@@ -121,7 +160,7 @@ func (stl *SymbolTableList) AddVar(kind VarKind, vType, name string) {
 func (stl *SymbolTableList) GetVarInfo(name string) VarInfo {
 	vi, err := stl.find(name)
 	if err != nil {
-		panic(fmt.Errorf("Cannot find variable %s", name))
+		panic(err)
 	}
 	return vi
 }
@@ -135,3 +174,17 @@ func (stl *SymbolTableList) IsVar(name string) bool {
 	_, err := stl.find(name)
 	return err == nil
 }
+
+// Current returns the innermost table of the list
+func (stl *SymbolTableList) Current() *SymbolTable {
+	if len(stl.list) == 0 {
+		panic("Symbol table list is empty")
+	}
+	return stl.list[len(stl.list)-1]
+}
+
+// Lookup finds a variable in all the tables of the list without panicking
+func (stl *SymbolTableList) Lookup(name string) (VarInfo, bool) {
+	vi, err := stl.find(name)
+	return vi, err == nil
+}
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // All symbols of Jack Language
@@ -41,6 +42,14 @@ const (
 	TokenIntegerConst
 )
 
+var tokenTypeNames = map[TokenType]string{
+	TokenKeyword:      "keyword",
+	TokenIdentifier:   "identifier",
+	TokenSymbol:       "symbol",
+	TokenStringConst:  "string constant",
+	TokenIntegerConst: "integer constant",
+}
+
 func (tt TokenType) Type() TokenType {
 	return tt
 }
@@ -52,6 +61,19 @@ type Token interface {
 	GetValue() string
 	Line() int
 	Pos() int
+	Trivia() *Trivia
+}
+
+// Trivia is the source around the token: spaces, blank lines and comments.
+// The trailing trivia lasts to the end of the token line, the rest is leading trivia of the next token
+type Trivia struct {
+	Leading  string
+	Text     string // the token as it is in the source
+	Trailing string
+}
+
+func (tr *Trivia) String() string {
+	return tr.Leading + tr.Text + tr.Trailing
 }
 
 type defaultToken struct {
@@ -59,6 +81,7 @@ type defaultToken struct {
 	xmlNode string
 	line    int
 	pos     int
+	trivia  *Trivia
 }
 
 func (dt *defaultToken) GetValue() string {
@@ -77,6 +100,15 @@ func (dt *defaultToken) Pos() int {
 	return dt.pos
 }
 
+// Trivia returns nil if the tokenizer does not keep trivia
+func (dt *defaultToken) Trivia() *Trivia {
+	return dt.trivia
+}
+
+func (dt *defaultToken) setTrivia(tr *Trivia) {
+	dt.trivia = tr
+}
+
 func (dt *defaultToken) String() string {
 	sb := strings.Builder{}
 	sb.WriteString(dt.xmlNode)
@@ -101,7 +133,7 @@ type KeywordToken struct {
 }
 
 func NewKeywordToken(value string, line, pos int) Token {
-	return &KeywordToken{TokenKeyword, defaultToken{value, "keyword", line, pos}}
+	return &KeywordToken{TokenKeyword, defaultToken{value, "keyword", line, pos, nil}}
 }
 
 type IdentifierToken struct {
@@ -110,7 +142,7 @@ type IdentifierToken struct {
 }
 
 func NewIdentifierToken(value string, line, pos int) Token {
-	return &IdentifierToken{TokenIdentifier, defaultToken{value, "identifier", line, pos}}
+	return &IdentifierToken{TokenIdentifier, defaultToken{value, "identifier", line, pos, nil}}
 }
 
 type SymbolToken struct {
@@ -119,7 +151,7 @@ type SymbolToken struct {
 }
 
 func NewSymbolToken(value string, line, pos int) Token {
-	return &SymbolToken{TokenSymbol, defaultToken{value, "symbol", line, pos}}
+	return &SymbolToken{TokenSymbol, defaultToken{value, "symbol", line, pos, nil}}
 }
 
 type StringConstantToken struct {
@@ -130,7 +162,7 @@ type StringConstantToken struct {
 func NewStringConstantToken(value string, line, pos int) Token {
 	return &StringConstantToken{
 		TokenStringConst,
-		defaultToken{value, "stringConstant", line, pos},
+		defaultToken{value, "stringConstant", line, pos, nil},
 	}
 }
 
@@ -142,7 +174,7 @@ type IntegerConstantToken struct {
 func NewIntegerConstantToken(value string, line, pos int) Token {
 	return &IntegerConstantToken{
 		TokenIntegerConst,
-		defaultToken{value, "integerConstant", line, pos},
+		defaultToken{value, "integerConstant", line, pos, nil},
 	}
 }
 
@@ -154,12 +186,45 @@ func isEOL(ch byte) bool {
 	return ch == '\n'
 }
 
+// The greatest integer constant of Jack
+const maxIntConst = 32767
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// isIdentStart reports that an identifier can start with the byte: a latin letter or underscore
+func isIdentStart(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_'
+}
+
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || isDigit(ch)
+}
+
+// Comment is a comment of the source with the delimiters, e.g. "// text" or "/* text */"
+type Comment struct {
+	Text    string
+	Line    int
+	Pos     int
+	EndLine int
+}
+
+func (c Comment) IsBlock() bool {
+	return strings.HasPrefix(c.Text, "/*")
+}
+
 type Tokenizer struct {
-	reader *bufio.Reader
-	buf    strings.Builder
-	xml    *XmlBuilder
-	Line   int
-	Pos    int
+	reader       *bufio.Reader
+	buf          strings.Builder
+	xml          *XmlBuilder
+	Line         int
+	Pos          int
+	KeepComments bool      // comments are collected into Comments
+	Comments     []Comment // in the order of the source
+	KeepTrivia   bool      // tokens carry their trivia
+	EndTrivia    string    // trivia after the last token
+	raw          strings.Builder
 }
 
 func NewTokenizer(r *bufio.Reader) *Tokenizer {
@@ -172,46 +237,66 @@ func NewTokenizer(r *bufio.Reader) *Tokenizer {
 
 func (t *Tokenizer) ReadToken() (Token, error) {
 	first, err := t.skipSpaces()
-	if err != nil {
-		return nil, err
+	if err == nil {
+		first, err = t.skipComment(first)
 	}
-
-	first, err = t.skipComment(first)
 	if err != nil {
+		if t.KeepTrivia && errors.Is(err, io.EOF) {
+			t.EndTrivia = t.raw.String()
+			t.raw.Reset()
+		}
 		return nil, err
 	}
 
 	var newTk Token
 	startPos := t.Pos
+	startRaw := t.raw.Len() - 1
 	switch {
 	case symbols[first]:
 		newTk = NewSymbolToken(string(first), t.Line, startPos)
 	case first == '"':
-		word := t.readStringToken()
+		word, err := t.readStringToken()
+		if err != nil {
+			return nil, err
+		}
 		newTk = NewStringConstantToken(word, t.Line, startPos)
-	case unicode.IsLetter(rune(first)):
+	case isIdentStart(first) || first >= utf8.RuneSelf:
+		// A word of non latin letters is reported as a wrong identifier
 		word, err := t.readWord(first)
 		if err != nil {
 			return nil, err
 		}
+		if i := strings.IndexFunc(word, func(r rune) bool { return r > unicode.MaxASCII || !isIdentChar(byte(r)) }); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(word[i:])
+			return nil, errorDiag(CodeInvalidIdent, "Invalid character %q in identifier \"%s\"", r, word).AtPos(t.Line, startPos)
+		}
 		if keywords[word] {
 			newTk = NewKeywordToken(word, t.Line, startPos)
 		} else {
 			newTk = NewIdentifierToken(word, t.Line, startPos)
 		}
-	case unicode.IsNumber(rune(first)):
+	case isDigit(first):
 		word, err := t.readWord(first)
 		if err != nil {
 			return nil, err
 		}
+		if strings.IndexFunc(word, func(r rune) bool { return r > unicode.MaxASCII || !isDigit(byte(r)) }) >= 0 {
+			return nil, errorDiag(CodeInvalidInt, "Invalid integer constant \"%s\"", word).AtPos(t.Line, startPos)
+		}
+		if v, err := strconv.Atoi(word); err != nil || v > maxIntConst {
+			return nil, errorDiag(CodeIntRange, "Integer constant %s is out of range 0..%d", word, maxIntConst).AtPos(t.Line, startPos)
+		}
 		newTk = NewIntegerConstantToken(word, t.Line, startPos)
 	}
 
 	if newTk != nil {
+		if t.KeepTrivia {
+			t.readTrivia(newTk, startRaw)
+		}
 		t.xml.WriteToken(newTk)
 		return newTk, nil
 	}
-	return nil, fmt.Errorf("Line: %d, Pos: %d undefined token type", t.Line, t.Pos)
+	return nil, errorDiag(CodeUndefinedToken, "Undefined token type \"%c\"", first).AtPos(t.Line, startPos)
 }
 
 func (t *Tokenizer) WriteXml(wr *bufio.Writer) {
@@ -223,10 +308,51 @@ func (t *Tokenizer) nextByte() (byte, error) {
 	b, err := t.reader.ReadByte()
 	if err == nil {
 		t.Pos++
+		if t.KeepTrivia {
+			t.raw.WriteByte(b)
+		}
 	}
 	return b, err
 }
 
+// readTrivia splits the read source at the token start into the leading trivia and the token text
+// and reads the trailing trivia up to the end of the line
+func (t *Tokenizer) readTrivia(tk Token, start int) {
+	raw := t.raw.String()
+	tr := &Trivia{Leading: raw[:start], Text: raw[start:]}
+	t.raw.Reset()
+
+	for {
+		next, err := t.reader.Peek(2)
+		if len(next) == 0 || err != nil && !errors.Is(err, io.EOF) {
+			break
+		}
+		if isSpace(next[0]) {
+			t.nextByte()
+			continue
+		}
+		if isEOL(next[0]) {
+			t.nextByte()
+			t.nextLine()
+			break
+		}
+		if len(next) < 2 || next[0] != '/' || next[1] != '/' && next[1] != '*' {
+			break
+		}
+		t.nextByte()
+		if next[1] == '/' {
+			t.readInlineComment()
+			break
+		}
+		if t.readMultilineComment() != nil {
+			break
+		}
+	}
+	tr.Trailing = t.raw.String()
+	t.raw.Reset()
+	tk.(interface{ setTrivia(*Trivia) }).setTrivia(tr)
+}
+
 func (t *Tokenizer) nextLine() {
 	t.Line++
 	t.Pos = 0
@@ -262,34 +388,63 @@ func (t *Tokenizer) isMultiLineComment(first byte) bool {
 }
 
 func (t *Tokenizer) skipInlineComment() (byte, error) {
-	_, err := t.reader.ReadBytes('\n')
-	if err != nil {
+	if err := t.readInlineComment(); err != nil {
 		return 0, err
 	}
-	t.nextLine()
 	return t.skipSpaces()
 }
 
+// readInlineComment reads the comment after the first slash up to the end of the line
+func (t *Tokenizer) readInlineComment() error {
+	line, pos := t.Line, t.Pos
+	text, err := t.reader.ReadString('\n')
+	if t.KeepTrivia {
+		t.raw.WriteString(text)
+	}
+	t.addComment("/"+strings.TrimRight(text, "\r\n"), line, pos)
+	if err != nil {
+		return err
+	}
+	t.nextLine()
+	return nil
+}
+
 func (t *Tokenizer) skipMultilineComment() (after byte, err error) {
+	if err := t.readMultilineComment(); err != nil {
+		return 0, err
+	}
+	return t.skipSpaces()
+}
+
+// readMultilineComment reads the comment after the first slash
+func (t *Tokenizer) readMultilineComment() error {
+	line, pos := t.Line, t.Pos
+	text := strings.Builder{}
+	text.WriteByte('/')
+	var prev byte
 	for {
-		first, err := t.nextByte()
+		ch, err := t.nextByte()
 		if err != nil {
-			return 0, err
-		}
-		if first == '*' {
-			next, err := t.nextByte()
-			if err != nil {
-				return 0, err
-			}
-			if next == '/' {
-				break
-			}
+			return err
 		}
-		if first == '\n' {
+		text.WriteByte(ch)
+		if ch == '\n' {
 			t.nextLine()
 		}
+		// The opening star cannot close the comment: /*/
+		if prev == '*' && ch == '/' && text.Len() > 3 {
+			break
+		}
+		prev = ch
+	}
+	t.addComment(text.String(), line, pos)
+	return nil
+}
+
+func (t *Tokenizer) addComment(text string, line, pos int) {
+	if t.KeepComments {
+		t.Comments = append(t.Comments, Comment{text, line, pos, t.Line})
 	}
-	return t.skipSpaces()
 }
 
 func (t *Tokenizer) skipComment(first byte) (after byte, err error) {
@@ -335,18 +490,22 @@ func (t *Tokenizer) readWord(fb byte) (string, error) {
 	return word, nil
 }
 
-func (t *Tokenizer) readStringToken() string {
+// readStringToken reads the string constant after the opening quote.
+// The constant cannot contain a new line and must be closed on the same line
+func (t *Tokenizer) readStringToken() (string, error) {
+	line, pos := t.Line, t.Pos
 	t.buf.Reset()
 
 	for {
-		ch, err := t.nextByte()
-		if err != nil || ch == '"' {
-			break
+		next, err := t.reader.Peek(1)
+		if err != nil || isEOL(next[0]) {
+			return "", errorDiag(CodeUnterminatedStr, "String constant is not terminated").AtPos(line, pos)
 		}
-		if ch == '\n' {
-			t.nextLine()
+		ch, _ := t.nextByte()
+		if ch == '"' {
+			break
 		}
 		t.buf.WriteByte(ch)
 	}
-	return t.buf.String()
+	return t.buf.String(), nil
 }
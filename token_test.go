@@ -174,3 +174,128 @@ func TestOneLinePos(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenizerTrivia(t *testing.T) {
+	src := "// header\r\n\r\nclass A { // open\n" +
+		"    /** doc\n     */\n    field int x;  /* a */ /* b */\n\n" +
+		"    function void f() { do Output.printString(\"two  lines\"); }\n}\n\n// end"
+	tz := NewTokenizer(bufio.NewReader(strings.NewReader(src)))
+	tz.KeepTrivia = true
+
+	var tokens []Token
+	sb := strings.Builder{}
+	for {
+		tk, err := tz.ReadToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		tokens = append(tokens, tk)
+		sb.WriteString(tk.Trivia().String())
+	}
+	sb.WriteString(tz.EndTrivia)
+	if sb.String() != src {
+		t.Fatalf("Got source:\n%q\nwant:\n%q", sb.String(), src)
+	}
+
+	testCases := []struct {
+		i    int
+		want Trivia
+	}{
+		{0, Trivia{"// header\r\n\r\n", "class", " "}},
+		{1, Trivia{"", "A", " "}},
+		{2, Trivia{"", "{", " // open\n"}},
+		{3, Trivia{"    /** doc\n     */\n    ", "field", " "}},
+		{6, Trivia{"", ";", "  /* a */ /* b */\n"}},
+		{7, Trivia{"\n    ", "function", " "}},
+		{18, Trivia{"", "\"two  lines\"", ""}},
+		{21, Trivia{"", "}", "\n"}},
+		{22, Trivia{"", "}", "\n"}},
+	}
+	for _, tc := range testCases {
+		if got := tokens[tc.i].Trivia(); *got != tc.want {
+			t.Errorf("Token %d: got %q; want %q", tc.i, *got, tc.want)
+		}
+	}
+	if tz.EndTrivia != "\n// end" {
+		t.Errorf("Got end trivia %q", tz.EndTrivia)
+	}
+	if tk := NewSymbolToken(";", 1, 1); tk.Trivia() != nil {
+		t.Error("Trivia must be nil if it is not kept")
+	}
+}
+
+func TestLexicalRules(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+		want Token  // the first token if there is no error
+		err  string // the error of the first token
+	}{
+		{"Identifier", "abc1", NewIdentifierToken("abc1", 0, 0), ""},
+		{"Underscore identifier", "_a_1", NewIdentifierToken("_a_1", 0, 0), ""},
+		{"Only underscore", "_", NewIdentifierToken("_", 0, 0), ""},
+		{"Invalid identifier char", "ab$c;", nil, "1:1: error[E0102]: Invalid character '$' in identifier \"ab$c\""},
+		{"Non latin identifier", "\xd0\xb0b", nil, "1:1: error[E0102]: Invalid character '\u0430' in identifier \"\xd0\xb0b\""},
+		{"Non latin letter inside", "a\xd0\xb0;", nil, "1:1: error[E0102]: Invalid character '\u0430' in identifier \"a\xd0\xb0\""},
+		{"Zero", "0", NewIntegerConstantToken("0", 0, 0), ""},
+		{"Max integer", "32767", NewIntegerConstantToken("32767", 0, 0), ""},
+		{"Leading zeros", "007", NewIntegerConstantToken("007", 0, 0), ""},
+		{"Too big integer", "32768", nil, "1:1: error[E0104]: Integer constant 32768 is out of range 0..32767"},
+		{"Huge integer", "99999999999999999999", nil, "1:1: error[E0104]: Integer constant 99999999999999999999 is out of range 0..32767"},
+		{"Letters in integer", "123abc", nil, "1:1: error[E0103]: Invalid integer constant \"123abc\""},
+		{"Underscore in integer", "1_000", nil, "1:1: error[E0103]: Invalid integer constant \"1_000\""},
+		{"String", "\"a // b\"", NewStringConstantToken("a // b", 0, 0), ""},
+		{"Empty string", "\"\"", NewStringConstantToken("", 0, 0), ""},
+		{"Unterminated string", "x = \"abc", nil, "1:5: error[E0105]: String constant is not terminated"},
+		{"String with new line", "\"ab\ncd\"", nil, "1:1: error[E0105]: String constant is not terminated"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tz := NewTokenizer(bufio.NewReader(strings.NewReader(tc.code)))
+			var err error
+			var tk Token
+			for err == nil {
+				if tk, err = tz.ReadToken(); tc.want != nil {
+					break
+				}
+			}
+			if tc.want != nil {
+				if err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				compareTokens(t, tk, tc.want)
+				return
+			}
+			if err == nil || errors.Is(err, io.EOF) {
+				t.Fatalf("Got no error; want %s", tc.err)
+			}
+			if err.Error() != tc.err {
+				t.Errorf("Got error %s; want %s", err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestLexicalErrorRecovery(t *testing.T) {
+	tz := NewTokenizer(bufio.NewReader(strings.NewReader("let x = 123abc;\nlet s = \"ab\nlet y = 40000;")))
+	var values []string
+	errs := 0
+	for {
+		tk, err := tz.ReadToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			errs++
+			continue
+		}
+		values = append(values, tk.GetValue())
+	}
+	want := "let x = ; let s = let y = ;"
+	if got := strings.Join(values, " "); got != want || errs != 3 {
+		t.Errorf("Got tokens %q and %d errors; want %q and 3 errors", got, errs, want)
+	}
+}
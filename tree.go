@@ -3,9 +3,7 @@ package main
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
-	"runtime"
 )
 
 type ParseTree struct {
@@ -14,6 +12,7 @@ type ParseTree struct {
 	peeked         [2]Token // buffer for peeked values
 	rootNodeParser func(*ParseTree) Node
 	root           Node
+	errs           DiagnosticList
 }
 
 func NewPasreTree(tz *Tokenizer) *ParseTree {
@@ -22,29 +21,40 @@ func NewPasreTree(tz *Tokenizer) *ParseTree {
 	return &pt
 }
 
-func (t *ParseTree) recover(errp *error) {
-	e := recover()
-	if e != nil {
-		if _, ok := e.(runtime.Error); ok {
-			panic(e)
-		}
-		*errp = e.(error)
+// errorf records an error at the token. If the token is nil the current position
+// of the tokenizer is used
+func (t *ParseTree) errorf(tk Token, code string, format string, args ...interface{}) {
+	d := errorDiag(code, format, args...)
+	if tk != nil {
+		d.At(tk)
+	} else {
+		d.AtPos(t.tz.Line, t.tz.Pos)
 	}
+	t.addDiag(d)
 }
 
-func (t *ParseTree) error(msg string) {
-	t.errorf("%s", msg)
-}
-
-func (t *ParseTree) errorf(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args...))
+// addDiag records the diagnostic once. The same error at the same position
+// is skipped, as recovery can run into the wrong token again
+func (t *ParseTree) addDiag(d *Diagnostic) {
+	for _, prev := range t.errs {
+		if prev.Line == d.Line && prev.Col == d.Col && prev.Msg == d.Msg {
+			return
+		}
+	}
+	t.errs = append(t.errs, d)
 }
 
+// Parse builds the tree even if there are errors, so the returned node can be partial.
+// The returned error is DiagnosticList with all the errors found
 func (t *ParseTree) Parse() (rootNode Node, err error) {
-	defer t.recover(&err)
 	t.root = t.rootNodeParser(t)
 	rootNode = t.root
-	return
+	return rootNode, t.errs.Err()
+}
+
+// Errors returns all the diagnostics found by Parse
+func (t *ParseTree) Errors() DiagnosticList {
+	return t.errs
 }
 
 func (t *ParseTree) WriteXml(wb *bufio.Writer) {
@@ -55,44 +65,36 @@ func (t *ParseTree) WriteXml(wb *bufio.Writer) {
 	}
 }
 
+// next must be called only after peek returned a token
 func (t *ParseTree) next() Token {
-	if t.peeked[1] != nil {
-		t.current, t.peeked[0], t.peeked[1] = t.peeked[0], t.peeked[1], nil
-		return t.current
-	}
-
-	if t.peeked[0] != nil {
-		t.current, t.peeked[0] = t.peeked[0], nil
-		return t.current
-	}
-
-	var err error
-	t.current, err = t.tz.ReadToken()
-	if err != nil && !errors.Is(err, io.EOF) {
-		t.errorf("Unexpected token: %v", err)
-	}
-	if err != nil && errors.Is(err, io.EOF) {
-		t.errorf("Unexpected EOF Ln %d", t.tz.Line)
-	}
+	t.peek(0)
+	t.current, t.peeked[0], t.peeked[1] = t.peeked[0], t.peeked[1], nil
 	return t.current
 }
 
+// peek returns nil at EOF. Tokenizer errors are recorded and the wrong input is skipped
 func (t *ParseTree) peek(fw int) Token {
 	if fw < 0 || fw > 1 {
 		panic("Can peak only for 0 or 1")
 	}
 
-	if t.peeked[fw] != nil {
-		return t.peeked[fw]
-	}
-
-	p, err := t.tz.ReadToken()
-	if err != nil && !errors.Is(err, io.EOF) {
-		t.errorf("Unexpected token: %v", err)
+	for i := 0; i <= fw; i++ {
+		if t.peeked[i] != nil {
+			continue
+		}
+		for {
+			p, err := t.tz.ReadToken()
+			if err == nil {
+				t.peeked[i] = p
+				break
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			t.addDiag(AsDiagnostic(err))
+		}
 	}
-	t.peeked[fw] = p
-
-	return p
+	return t.peeked[fw]
 }
 
 func isTokenType(tk Token, tt TokenType) bool {
@@ -118,66 +120,147 @@ func (t *ParseTree) feed() Token {
 	return t.next()
 }
 
+// missingToken creates a token expected by the grammar in place of the wrong one
+func (t *ParseTree) missingToken(at Token, tt TokenType, val string) Token {
+	line, pos := t.tz.Line, t.tz.Pos
+	if at != nil {
+		line, pos = at.Line(), at.Pos()
+	}
+	switch tt {
+	case TokenKeyword:
+		return NewKeywordToken(val, line, pos)
+	case TokenSymbol:
+		return NewSymbolToken(val, line, pos)
+	}
+	return NewIdentifierToken(val, line, pos)
+}
+
+func (t *ParseTree) unexpected(tk Token, expected string) {
+	if tk == nil {
+		t.errorf(nil, CodeUnexpectedEOF, "Unexpected EOF. Expected %s", expected)
+	} else {
+		t.errorf(tk, CodeUnexpectedToken, "Unexpected %s \"%s\". Expected %s", tokenTypeNames[tk.Type()], tk.GetValue(), expected)
+	}
+}
+
+// feedToken consumes the token if it is expected. Otherwise it records the error,
+// leaves the token and returns a missing one
 func (t *ParseTree) feedToken(tt TokenType, val string) Token {
-	tk := t.next()
-	if tk.Type() != tt || (val != "" && tk.GetValue() != val) {
-		t.errorf("Unexpexted token %v. Expected value %s", tk, val)
+	p := t.peek(0)
+	if isTokenType(p, tt) && (val == "" || p.GetValue() == val) {
+		return t.next()
 	}
-	return tk
+	if val == "" {
+		t.unexpected(p, tokenTypeNames[tt])
+	} else {
+		t.unexpected(p, "\""+val+"\"")
+	}
+	return t.missingToken(p, tt, val)
 }
 
 // type:'int'|'char'|'boolean'|className
 func (t *ParseTree) varType() Token {
-	tk := t.next()
-	switch tk.Type() {
-	case TokenKeyword:
-		val := tk.GetValue()
-		if val != "int" && val != "char" && val != "boolean" {
-			t.errorf("Unexpected Jack builin type: %v", tk)
+	p := t.peek(0)
+	switch {
+	case isTokenAny(p, TokenKeyword, "int", "char", "boolean"), isTokenType(p, TokenIdentifier):
+		return t.next()
+	case isTokenType(p, TokenKeyword):
+		t.errorf(p, CodeWrongType, "Unexpected Jack builtin type \"%s\"", p.GetValue())
+		return t.next()
+	}
+	t.unexpected(p, "type")
+	return t.missingToken(p, TokenIdentifier, "")
+}
+
+func isDeclStart(tk Token) bool {
+	return isTokenAny(tk, TokenKeyword, "static", "field", "constructor", "function", "method")
+}
+
+func isStatementStart(tk Token) bool {
+	return isTokenAny(tk, TokenKeyword, "let", "do", "if", "while", "return")
+}
+
+// syncStatement skips tokens after an error until the end of the statement
+func (t *ParseTree) syncStatement() {
+	if isTokenAny(t.current, TokenSymbol, ";", "}") {
+		return
+	}
+	for {
+		p := t.peek(0)
+		if p == nil || isTokenOne(p, TokenSymbol, "}") || isStatementStart(p) || isDeclStart(p) {
+			return
+		}
+		if isTokenOne(t.next(), TokenSymbol, ";") {
+			return
 		}
-	case TokenIdentifier:
-		break
-	default:
-		t.errorf("Unexpected Token for Var type: %v", tk)
 	}
+}
 
-	return tk
+// syncDecl skips tokens after an error until the next class declaration or the end of the class
+func (t *ParseTree) syncDecl() {
+	depth := 0
+	for {
+		p := t.peek(0)
+		if p == nil || isDeclStart(p) || depth == 0 && isTokenOne(p, TokenSymbol, "}") {
+			return
+		}
+		if isTokenOne(p, TokenSymbol, "{") {
+			depth++
+		} else if isTokenOne(p, TokenSymbol, "}") {
+			depth--
+		}
+		t.next()
+	}
 }
 
 func (t *ParseTree) class() *ClassNode {
-	t.feedToken(TokenKeyword, "class")
+	doc := docComment(t.feedToken(TokenKeyword, "class"))
 	clName := t.feedToken(TokenIdentifier, "")
 	t.feedToken(TokenSymbol, "{")
 
 	cln := NewClassNode(clName)
-	p := t.peek(0)
-	for isTokenAny(p, TokenKeyword, "static", "field") {
-		clv := t.classVarDec()
-		cln.AddVarDecs(clv)
-		p = t.peek(0)
-	}
-
-	for isTokenAny(p, TokenKeyword, "constructor", "function", "method") {
-		sbr := t.subroutineDec()
-		cln.AddSbrDecs(sbr)
-		p = t.peek(0)
+	cln.Doc = doc
+	for {
+		p := t.peek(0)
+		switch {
+		case isTokenAny(p, TokenKeyword, "static", "field"):
+			if len(cln.SbrDec) > 0 {
+				t.errorf(p, CodeDeclOrder, "Class variables must be declared before subroutines")
+			}
+			cln.AddVarDecs(t.classVarDec())
+		case isTokenAny(p, TokenKeyword, "constructor", "function", "method"):
+			cln.AddSbrDecs(t.subroutineDec())
+		case p == nil || isTokenOne(p, TokenSymbol, "}"):
+			t.feedToken(TokenSymbol, "}")
+			return cln
+		default:
+			t.unexpected(p, "class variable or subroutine declaration")
+			t.syncDecl()
+		}
 	}
-
-	t.feedToken(TokenSymbol, "}")
-	return cln
 }
 
 func (t *ParseTree) classVarDec() *ClassVarDecNode {
+	errCount := len(t.errs)
+	defer func() {
+		if len(t.errs) > errCount {
+			t.syncStatement()
+		}
+	}()
+
 	p := t.peek(0)
 	var varClass Token
 	if isTokenAny(p, TokenKeyword, "static", "field") {
 		varClass = t.feed()
+	} else {
+		t.unexpected(p, "static or field")
+		varClass = t.missingToken(p, TokenKeyword, "field")
 	}
 	varType := t.varType()
 	varName := t.feedToken(TokenIdentifier, "")
 	vd := NewClassVarDecNode(varClass, varType, varName)
-	for !isTokenOne(t.peek(0), TokenSymbol, ";") {
-		t.feedToken(TokenSymbol, ",")
+	for isTokenOne(t.peek(0), TokenSymbol, ",") {
+		t.feed()
 		vd.AddVarNames(t.feedToken(TokenIdentifier, ""))
 	}
 	t.feedToken(TokenSymbol, ";")
@@ -186,10 +269,13 @@ func (t *ParseTree) classVarDec() *ClassVarDecNode {
 
 func (t *ParseTree) subroutineDec() *SubroutineDecNode {
 	p := t.peek(0)
-	if !isTokenAny(p, TokenKeyword, "constructor", "function", "method") {
-		t.errorf("Expected method class: constructor, function or method")
+	var sbrClass Token
+	if isTokenAny(p, TokenKeyword, "constructor", "function", "method") {
+		sbrClass = t.feed()
+	} else {
+		t.unexpected(p, "constructor, function or method")
+		sbrClass = t.missingToken(p, TokenKeyword, "function")
 	}
-	sbrClass := t.feed()
 
 	var returnType Token
 	p = t.peek(0)
@@ -204,7 +290,9 @@ func (t *ParseTree) subroutineDec() *SubroutineDecNode {
 	paramList := t.parameterList()
 	t.feedToken(TokenSymbol, ")")
 	sbrBody := t.subroutineBody()
-	return NewSubroutineDecNode(sbrClass, returnType, sbrName, paramList, sbrBody)
+	sdn := NewSubroutineDecNode(sbrClass, returnType, sbrName, paramList, sbrBody)
+	sdn.Doc = docComment(sbrClass)
+	return sdn
 }
 
 func (t *ParseTree) parameterList() *ParameterListNode {
@@ -248,10 +336,17 @@ func (t *ParseTree) subroutineBody() *SubroutineBodyNode {
 
 // varDec:'var' type varName (','varName)*';'
 func (t *ParseTree) varDec() *VarDecNode {
+	errCount := len(t.errs)
+	defer func() {
+		if len(t.errs) > errCount {
+			t.syncStatement()
+		}
+	}()
+
 	t.feedToken(TokenKeyword, "var")
 	vd := NewVarDecNode(t.varType(), t.feedToken(TokenIdentifier, ""))
-	for !isTokenOne(t.peek(0), TokenSymbol, ";") {
-		t.feedToken(TokenSymbol, ",")
+	for isTokenOne(t.peek(0), TokenSymbol, ",") {
+		t.feed()
 		vd.AddId(t.feedToken(TokenIdentifier, ""))
 	}
 	t.feedToken(TokenSymbol, ";")
@@ -261,25 +356,32 @@ func (t *ParseTree) varDec() *VarDecNode {
 func (t *ParseTree) statements() *StatementsNode {
 	st := NewStatementsNode()
 	p := t.peek(0)
-	for !isTokenOne(p, TokenSymbol, "}") {
+	for p != nil && !isTokenOne(p, TokenSymbol, "}") && !isDeclStart(p) {
+		errCount := len(t.errs)
 		var newSt Node
 
-		switch p.GetValue() {
-		case "let":
+		switch {
+		case isTokenOne(p, TokenKeyword, "let"):
 			newSt = t.letStatement()
-		case "if":
+		case isTokenOne(p, TokenKeyword, "if"):
 			newSt = t.ifStatement()
-		case "while":
+		case isTokenOne(p, TokenKeyword, "while"):
 			newSt = t.whileStatement()
-		case "do":
+		case isTokenOne(p, TokenKeyword, "do"):
 			newSt = t.doStatement()
-		case "return":
+		case isTokenOne(p, TokenKeyword, "return"):
 			newSt = t.returnStatement()
 		default:
-			t.errorf("Unexpected statement begin: %v", p)
+			t.unexpected(p, "statement")
+			t.feed()
 		}
 
-		st.AddSt(newSt)
+		if newSt != nil {
+			st.AddSt(newSt)
+		}
+		if len(t.errs) > errCount {
+			t.syncStatement()
+		}
 		p = t.peek(0)
 	}
 	return st
@@ -346,10 +448,10 @@ func (t *ParseTree) doStatement() *DoStatementNode {
 }
 
 func (t *ParseTree) returnStatement() *ReturnStatementNode {
-	t.feedToken(TokenKeyword, "return")
+	kw := t.feedToken(TokenKeyword, "return")
 
-	rsn := NewReturnNode()
-	if !isTokenOne(t.peek(0), TokenSymbol, ";") {
+	rsn := NewReturnNode(kw)
+	if p := t.peek(0); !isTokenAny(p, TokenSymbol, ";", "}") {
 		expr := t.expression()
 		rsn.AddExpr(expr)
 	}
@@ -421,7 +523,8 @@ func (t *ParseTree) term() *TermNode {
 			tn = NewVarTermNode(ident)
 		}
 	default:
-		t.errorf("Token is not a term: %v", pFirst)
+		t.unexpected(pFirst, "term")
+		tn = NewErrorTermNode(t.missingToken(pFirst, TokenIdentifier, ""))
 	}
 
 	return tn
@@ -193,3 +193,86 @@ func TestClassBody(t *testing.T) {
 	start := func(p *ParseTree) Node { return p.class() }
 	simpleTest(t, start, classTest)
 }
+
+func TestErrorRecovery(t *testing.T) {
+	code := `class Main {
+  field int a b;
+  function void main() {
+    var int x;
+    let x = ;
+    do Output.printInt(x);
+    if (x { let x = 1; }
+    let y = 3 + ;
+    return;
+  }
+  method void foo( int a {
+    return
+  }
+  function void bar() { return; }
+}`
+	reader := bufio.NewReader(strings.NewReader(code))
+	pt := NewPasreTree(NewTokenizer(reader))
+	root, err := pt.Parse()
+	if err == nil {
+		t.Fatal("Expected errors")
+	}
+
+	wantLines := []int{2, 5, 7, 8, 11, 13}
+	errs := pt.Errors()
+	if len(errs) != len(wantLines) {
+		t.Fatalf("Got %d errors:\n%v\nwant %d", len(errs), err, len(wantLines))
+	}
+	for i, d := range errs {
+		if d.Line != wantLines[i] {
+			t.Errorf("Error %d: got line %d; want %d", i, d.Line, wantLines[i])
+		}
+	}
+
+	cn, ok := root.(*ClassNode)
+	if !ok {
+		t.Fatalf("Got %T; want *ClassNode", root)
+	}
+	if len(cn.SbrDec) != 3 {
+		t.Fatalf("Got %d subroutines in the partial tree; want 3", len(cn.SbrDec))
+	}
+	if got := len(cn.SbrDec[0].Body.Statm.StList); got != 5 {
+		t.Errorf("Got %d statements in main; want 5", got)
+	}
+}
+
+func TestEOFError(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("class Main { function void main() { return;"))
+	pt := NewPasreTree(NewTokenizer(reader))
+	if _, err := pt.Parse(); err == nil {
+		t.Fatal("Expected EOF error")
+	}
+	if len(pt.Errors()) != 1 {
+		t.Errorf("Got %d errors: %v; want 1", len(pt.Errors()), pt.Errors())
+	}
+}
+
+func TestErrorsOnOneLine(t *testing.T) {
+	code := "class Main { function void main() { var int x y; let x = ; return; } }"
+	pt := NewPasreTree(NewTokenizer(bufio.NewReader(strings.NewReader(code))))
+	root, _ := pt.Parse()
+
+	want := []string{
+		"1:47: error[E0201]: Unexpected identifier \"y\". Expected \";\"",
+		"1:58: error[E0201]: Unexpected symbol \";\". Expected term",
+	}
+	errs := pt.Errors()
+	if len(errs) != len(want) {
+		t.Fatalf("Got %d errors:\n%v\nwant %d", len(errs), errs, len(want))
+	}
+	for i, e := range errs {
+		if e.Error() != want[i] {
+			t.Errorf("Got %s; want %s", e.Error(), want[i])
+		}
+	}
+
+	// The wrong term is kept as a placeholder in the partial tree
+	let := root.(*ClassNode).SbrDec[0].Body.Statm.StList[0].(*LetStatementNode)
+	if tn := let.ValueExp.term; tn == nil || tn.termType != termNodeError {
+		t.Errorf("Got term %v; want the error placeholder", tn)
+	}
+}
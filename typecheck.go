@@ -0,0 +1,321 @@
+package main
+
+import "fmt"
+
+// TypeStrictness sets how strict the type checker is. Jack is loosely typed,
+// so the loose level reports only mistakes that always produce broken code
+type TypeStrictness int
+
+const (
+	TypeCheckOff TypeStrictness = iota
+	// int, char and boolean are interchangeable, Array is compatible with any object and int
+	TypeCheckLoose
+	// boolean is distinct from int and char, conditions must be boolean
+	TypeCheckStrict
+)
+
+func ParseTypeStrictness(s string) (TypeStrictness, error) {
+	switch s {
+	case "off":
+		return TypeCheckOff, nil
+	case "loose":
+		return TypeCheckLoose, nil
+	case "strict":
+		return TypeCheckStrict, nil
+	}
+	return TypeCheckOff, fmt.Errorf("Unknown type check level \"%s\". Expected off, loose or strict", s)
+}
+
+const (
+	typeUnknown = "" // type cannot be inferred, e.g. an element of Array
+	typeInt     = "int"
+	typeChar    = "char"
+	typeBoolean = "boolean"
+	typeVoid    = "void"
+	typeArray   = "Array"
+	typeString  = "String"
+	typeNull    = "null"
+)
+
+func isPrimitiveType(t string) bool {
+	return t == typeInt || t == typeChar || t == typeBoolean
+}
+
+func isNumericType(t string) bool {
+	return t == typeInt || t == typeChar
+}
+
+// TypeChecker infers types of expressions and reports mismatches
+type TypeChecker struct {
+	prog  *ProgramInfo
+	level TypeStrictness
+	Tbl   *SymbolTableList
+	file  string
+	class *ClassInfo
+	sbr   SbrInfo
+	errs  DiagnosticList
+}
+
+func NewTypeChecker(prog *ProgramInfo, level TypeStrictness) *TypeChecker {
+	return &TypeChecker{prog: prog, level: level}
+}
+
+func (tc *TypeChecker) errorf(tk Token, code string, format string, args ...interface{}) {
+	d := errorDiag(code, format, args...).At(tk)
+	d.File = tc.file
+	tc.errs = append(tc.errs, d)
+}
+
+// Check returns all type errors found in the class
+func (tc *TypeChecker) Check(file string, cn *ClassNode) DiagnosticList {
+	tc.file = file
+	tc.errs = nil
+	if tc.level == TypeCheckOff {
+		return nil
+	}
+	tc.Tbl = NewSymbolTableList()
+	tc.class, _ = tc.prog.Class(cn.Name.GetValue())
+
+	tc.Tbl.CreateTable(cn.Name.GetValue())
+	defer tc.Tbl.CloseTable()
+	declareClassVars(tc.Tbl, cn)
+
+	for _, sbr := range cn.SbrDec {
+		tc.checkSubroutine(sbr)
+	}
+	return tc.errs
+}
+
+func (tc *TypeChecker) checkSubroutine(sbr *SubroutineDecNode) {
+	tc.Tbl.CreateTable(tc.class.Name + "." + sbr.Name.GetValue())
+	defer tc.Tbl.CloseTable()
+	declareSubroutineVars(tc.Tbl, tc.class.Name, sbr)
+
+	tc.sbr = sbr.Signature()
+	tc.statements(sbr.Body.Statm)
+}
+
+func (tc *TypeChecker) statements(sn *StatementsNode) {
+	for _, st := range sn.StList {
+		switch s := st.(type) {
+		case *LetStatementNode:
+			tc.letStatement(s)
+		case *IfStatementNode:
+			tc.condition(s.IfExpr)
+			tc.statements(s.IfStat)
+			if s.ElseStat != nil {
+				tc.statements(s.ElseStat)
+			}
+		case *WhileStatementNode:
+			tc.condition(s.Expr)
+			tc.statements(s.Stat)
+		case *DoStatementNode:
+			tc.call(s.Call)
+		case *ReturnStatementNode:
+			tc.returnStatement(s)
+		}
+	}
+}
+
+func (tc *TypeChecker) letStatement(lsn *LetStatementNode) {
+	vi, ok := tc.Tbl.Lookup(lsn.VarName.GetValue())
+	valType := tc.expression(lsn.ValueExp)
+	if !ok {
+		return
+	}
+
+	if lsn.ArrayExp != nil {
+		tc.index(lsn.VarName, vi.Type, lsn.ArrayExp)
+		return
+	}
+	if !tc.compatible(vi.Type, valType) {
+		tc.errorf(lsn.VarName, CodeTypeMismatch, "Cannot assign a value of type %s to the variable %s of type %s",
+			valType, lsn.VarName.GetValue(), vi.Type)
+	}
+}
+
+func (tc *TypeChecker) returnStatement(rsn *ReturnStatementNode) {
+	rt := tc.sbr.ReturnType
+	tk := rsn.firstToken()
+	if rsn.Expr == nil {
+		if rt != typeVoid {
+			tc.errorf(tk, CodeReturnMismatch, "Subroutine %s must return a value of type %s", tc.sbr.Name, rt)
+		}
+		return
+	}
+
+	exprType := tc.expression(rsn.Expr)
+	if rt == typeVoid {
+		tc.errorf(tk, CodeReturnMismatch, "Void subroutine %s cannot return a value", tc.sbr.Name)
+		return
+	}
+	if !tc.compatible(rt, exprType) {
+		tc.errorf(tk, CodeReturnMismatch, "Subroutine %s returns %s; got %s", tc.sbr.Name, rt, exprType)
+	}
+}
+
+func (tc *TypeChecker) condition(en *ExpressionNode) {
+	t := tc.expression(en)
+	if tc.level == TypeCheckStrict && t != typeUnknown && t != typeBoolean {
+		tc.errorf(en.firstToken(), CodeTypeMismatch, "Condition must be boolean; got %s", t)
+	}
+}
+
+// index checks an access arr[idx]
+func (tc *TypeChecker) index(name Token, varType string, idx *ExpressionNode) {
+	idxType := tc.expression(idx)
+	if isPrimitiveType(varType) && tc.level == TypeCheckStrict {
+		tc.errorf(name, CodeTypeMismatch, "Variable %s of type %s cannot be indexed", name.GetValue(), varType)
+	}
+	if !tc.numeric(idxType) {
+		tc.errorf(idx.firstToken(), CodeTypeMismatch, "Array index must be int; got %s", idxType)
+	}
+}
+
+// numeric tells if the type can take part in arithmetic
+func (tc *TypeChecker) numeric(t string) bool {
+	if t == typeUnknown || isNumericType(t) {
+		return true
+	}
+	if t == typeArray && tc.level == TypeCheckLoose {
+		return true // address arithmetic
+	}
+	return false
+}
+
+// compatible tells if a value of type got can be stored into want
+func (tc *TypeChecker) compatible(want, got string) bool {
+	switch {
+	case want == typeUnknown || got == typeUnknown || want == got:
+		return true
+	case got == typeVoid || want == typeVoid:
+		return false
+	case got == typeNull:
+		return !isPrimitiveType(want) || tc.level == TypeCheckLoose
+	case isPrimitiveType(want) && isPrimitiveType(got):
+		return tc.level == TypeCheckLoose || (isNumericType(want) && isNumericType(got))
+	case want == typeArray || got == typeArray:
+		return !isPrimitiveType(want) && !isPrimitiveType(got) ||
+			tc.level == TypeCheckLoose && (want == typeInt || got == typeInt)
+	}
+	return false
+}
+
+func (tc *TypeChecker) expression(en *ExpressionNode) string {
+	t := tc.term(en.term)
+	for i, op := range en.ops {
+		rt := tc.term(en.opTerms[i])
+		t = tc.binaryOp(op, t, rt)
+	}
+	return t
+}
+
+func (tc *TypeChecker) binaryOp(op Token, lt, rt string) string {
+	for _, t := range [...]string{lt, rt} {
+		if t == typeVoid {
+			tc.errorf(op, CodeVoidValue, "Void value used in the operation %s", op.GetValue())
+			return typeUnknown
+		}
+	}
+
+	switch op.GetValue() {
+	case "+", "-", "*", "/":
+		if !tc.numeric(lt) || !tc.numeric(rt) {
+			tc.errorf(op, CodeTypeMismatch, "Operation %s expects int operands; got %s and %s", op.GetValue(), lt, rt)
+		}
+		return typeInt
+	case "<", ">":
+		if tc.level == TypeCheckStrict && (!tc.numeric(lt) || !tc.numeric(rt)) {
+			tc.errorf(op, CodeTypeMismatch, "Operation %s expects int operands; got %s and %s", op.GetValue(), lt, rt)
+		}
+		return typeBoolean
+	case "=":
+		if tc.level == TypeCheckStrict && !tc.compatible(lt, rt) && !tc.compatible(rt, lt) {
+			tc.errorf(op, CodeTypeMismatch, "Cannot compare %s and %s", lt, rt)
+		}
+		return typeBoolean
+	case "&", "|":
+		if lt == typeBoolean && rt == typeBoolean {
+			return typeBoolean
+		}
+		if tc.level == TypeCheckStrict && lt != typeUnknown && rt != typeUnknown && !(tc.numeric(lt) && tc.numeric(rt)) {
+			tc.errorf(op, CodeTypeMismatch, "Operation %s expects both boolean or both int operands; got %s and %s", op.GetValue(), lt, rt)
+		}
+		if lt == typeBoolean || rt == typeBoolean {
+			return typeBoolean
+		}
+		return typeInt
+	}
+	return typeUnknown
+}
+
+func (tc *TypeChecker) term(tn *TermNode) string {
+	switch tn.termType {
+	case termNodeIntConst:
+		return typeInt
+	case termNodeStrConst:
+		return typeString
+	case termNodeKeyWordConst:
+		if tn.val.GetValue() == "null" {
+			return typeNull
+		}
+		return typeBoolean
+	case termNodeThis:
+		return tc.class.Name
+	case termNodeVar:
+		if vi, ok := tc.Tbl.Lookup(tn.val.GetValue()); ok {
+			return vi.Type
+		}
+	case termNodeArray:
+		if vi, ok := tc.Tbl.Lookup(tn.val.GetValue()); ok {
+			tc.index(tn.val, vi.Type, tn.arrayIdx)
+		} else {
+			tc.expression(tn.arrayIdx)
+		}
+	case termNodeExpr:
+		return tc.expression(tn.exp)
+	case termNodeUnary:
+		t := tc.term(tn.unaryTerm)
+		if t == typeVoid {
+			tc.errorf(tn.unaryOp, CodeVoidValue, "Void value used in the operation %s", tn.unaryOp.GetValue())
+			return typeUnknown
+		}
+		if tn.unaryOp.GetValue() == "-" {
+			if !tc.numeric(t) {
+				tc.errorf(tn.unaryOp, CodeTypeMismatch, "Operation - expects an int operand; got %s", t)
+			}
+			return typeInt
+		}
+		if t == typeBoolean {
+			return typeBoolean
+		}
+		if tc.level == TypeCheckStrict && !tc.numeric(t) {
+			tc.errorf(tn.unaryOp, CodeTypeMismatch, "Operation ~ expects a boolean or int operand; got %s", t)
+		}
+		return t
+	case termNodeCall:
+		return tc.call(tn.call)
+	}
+	return typeUnknown
+}
+
+// call checks the arguments and returns the return type of the subroutine
+func (tc *TypeChecker) call(call *SubroutineCallNode) string {
+	argTypes := make([]string, 0, call.Params.Len())
+	for _, e := range call.Params.Exprs {
+		argTypes = append(argTypes, tc.expression(e))
+	}
+
+	si, ok := lookupCall(tc.prog, tc.Tbl, tc.class, call)
+	if !ok || len(si.Params) != len(argTypes) {
+		// Reported by Checker
+		return typeUnknown
+	}
+	for i, want := range si.Params {
+		if !tc.compatible(want, argTypes[i]) {
+			tc.errorf(call.Params.Exprs[i].firstToken(), CodeTypeMismatch, "Argument %d of %s expects %s; got %s",
+				i+1, call.FullName(), want, argTypes[i])
+		}
+	}
+	return si.ReturnType
+}
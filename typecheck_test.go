@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestTypeCheck(t *testing.T) {
+	wrap := func(body string) string {
+		return `class Main {
+			field int count;
+			function void main() { return; }
+			function int num() { return 1; }
+			function boolean flag() { return true; }
+			method Main self() { return this; }
+			function void check(int a, boolean b, char c, Main m, Array arr, String s) {
+				var int x; var boolean y; var Main z;
+				` + body + `
+			}
+		}`
+	}
+
+	testCases := []struct {
+		name   string
+		body   string
+		loose  int
+		strict int
+	}{
+		{"Valid", "let x = a + Main.num(); let z = m; let arr[x] = s; return;", 0, 0},
+		{"Return value from void", "return 1;", 1, 1},
+		{"Object into int", "let x = Main.self(); return;", 1, 1},
+		{"Int into object", "let z = 1; return;", 1, 1},
+		{"Boolean in arithmetic", "let x = b + 1; return;", 1, 1},
+		{"Void in expression", "let x = 1 + Main.main(); return;", 1, 1},
+		{"Wrong argument", "do Main.check(1, true, 65, 1, null, \"s\"); return;", 1, 1},
+		{"Null into object", "let z = null; return;", 0, 0},
+		{"Array is compatible with objects", "let z = arr; let arr = Array.new(x); return;", 0, 0},
+		{"Array address arithmetic", "let x = arr + 1; return;", 0, 1},
+		{"Boolean into int", "let x = b; return;", 0, 1},
+		{"Char into int", "let x = c; let c = x; return;", 0, 0},
+		{"Int condition", "if (x) { let y = true; } return;", 0, 1},
+		{"Boolean condition", "while (x < 10 & b) { let x = x + 1; } return;", 0, 0},
+		{"Mixed logic operands", "let y = b & x; return;", 0, 1},
+		{"Compare object and int", "let y = z = 1; return;", 0, 1},
+		{"Index primitive", "let x = a[1]; return;", 0, 1},
+		{"Index with object", "let x = arr[m]; return;", 1, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := parseClass(t, wrap(tc.body))
+			prog := NewProgramInfo()
+			if err := prog.AddClass("Main.jack", root); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, lvl := range [...]struct {
+				level TypeStrictness
+				want  int
+			}{{TypeCheckOff, 0}, {TypeCheckLoose, tc.loose}, {TypeCheckStrict, tc.strict}} {
+				errs := NewTypeChecker(prog, lvl.level).Check("Main.jack", root)
+				if len(errs) != lvl.want {
+					t.Errorf("Level %d: got %d errors %v; want %d", lvl.level, len(errs), errs, lvl.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTypeCheckReturns(t *testing.T) {
+	code := `class Main {
+		function int a() { return; }
+		function void b() { return; }
+		function Main c() { return 1; }
+		constructor Main new() { return this; }
+	}`
+	root := parseClass(t, code)
+	prog := NewProgramInfo()
+	prog.AddClass("Main.jack", root)
+	errs := NewTypeChecker(prog, TypeCheckLoose).Check("Main.jack", root)
+	if len(errs) != 2 {
+		t.Errorf("Got %d errors %v; want 2", len(errs), errs)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+// varUse records how a variable is accessed
+type varUse struct {
+	decl    Token
+	kind    VarKind
+	read    bool
+	written bool
+	warned  bool // a read before the assignment is reported
+}
+
+// VarChecker reports variables that are never used and locals that can be read
+// before any let assigns them. Fields and statics are private to the class,
+// so they are checked across all the subroutines of the class
+type VarChecker struct {
+	unused bool
+	uninit bool
+	Tbl    *SymbolTableList
+	file   string
+	class  map[string]*varUse // fields and statics
+	sbr    map[string]*varUse // parameters and locals
+	warns  DiagnosticList
+}
+
+func NewVarChecker(unused, uninit bool) *VarChecker {
+	return &VarChecker{unused: unused, uninit: uninit}
+}
+
+func (vc *VarChecker) warnf(tk Token, code string, format string, args ...interface{}) {
+	d := NewDiagnostic(SeverityWarning, code, format, args...).At(tk)
+	d.File = vc.file
+	vc.warns = append(vc.warns, d)
+}
+
+// Check returns the warnings about the variables of the class
+func (vc *VarChecker) Check(file string, cn *ClassNode) DiagnosticList {
+	vc.file = file
+	vc.warns = nil
+	if !vc.unused && !vc.uninit {
+		return nil
+	}
+	className := cn.Name.GetValue()
+	vc.Tbl = NewSymbolTableList()
+	vc.Tbl.CreateTable(className)
+	defer vc.Tbl.CloseTable()
+	declareClassVars(vc.Tbl, cn)
+
+	vc.class = make(map[string]*varUse)
+	for _, vd := range cn.VarDec {
+		for _, n := range vd.Names {
+			vi, _ := vc.Tbl.Lookup(n.GetValue())
+			vc.class[n.GetValue()] = &varUse{decl: n, kind: vi.Kind}
+		}
+	}
+
+	for _, sbr := range cn.SbrDec {
+		vc.checkSubroutine(className, sbr)
+	}
+
+	if vc.unused {
+		for _, vd := range cn.VarDec {
+			for _, n := range vd.Names {
+				vc.reportUnused(vc.class[n.GetValue()], n.GetValue())
+			}
+		}
+	}
+	return vc.warns
+}
+
+func (vc *VarChecker) checkSubroutine(className string, sbr *SubroutineDecNode) {
+	vc.Tbl.CreateTable(className + "." + sbr.Name.GetValue())
+	defer vc.Tbl.CloseTable()
+	declareSubroutineVars(vc.Tbl, className, sbr)
+
+	vc.sbr = make(map[string]*varUse)
+	var order []string
+	for _, n := range sbr.ParamList.varNames {
+		vc.sbr[n.GetValue()] = &varUse{decl: n, kind: Arg}
+		order = append(order, n.GetValue())
+	}
+	for _, vd := range sbr.Body.VarDec {
+		for _, id := range vd.Ids {
+			vc.sbr[id.GetValue()] = &varUse{decl: id, kind: Local}
+			order = append(order, id.GetValue())
+		}
+	}
+
+	vc.statements(sbr.Body.Statm, make(assigned))
+
+	if vc.unused {
+		for _, name := range order {
+			vc.reportUnused(vc.sbr[name], name)
+		}
+	}
+}
+
+func (vc *VarChecker) reportUnused(u *varUse, name string) {
+	if u == nil || u.read {
+		return
+	}
+	what := "Variable"
+	switch u.kind {
+	case Arg:
+		what = "Parameter"
+	case Field:
+		what = "Field"
+	case Static:
+		what = "Static variable"
+	}
+	if u.written {
+		vc.warnf(u.decl, CodeUnusedVar, "%s %s is assigned but never used", what, name)
+	} else {
+		vc.warnf(u.decl, CodeUnusedVar, "%s %s is never used", what, name)
+	}
+}
+
+// assigned is the set of locals that are assigned on every path to the current statement
+type assigned map[string]bool
+
+func (a assigned) copy() assigned {
+	c := make(assigned, len(a))
+	for k := range a {
+		c[k] = true
+	}
+	return c
+}
+
+// use finds the variable by the name taking shadowing into account
+func (vc *VarChecker) use(name string) *varUse {
+	vi, ok := vc.Tbl.Lookup(name)
+	if !ok {
+		return nil
+	}
+	if vi.Kind == Field || vi.Kind == Static {
+		return vc.class[name]
+	}
+	return vc.sbr[name]
+}
+
+// statements walks the statements in the order of execution and returns the locals
+// assigned after them
+func (vc *VarChecker) statements(sn *StatementsNode, as assigned) assigned {
+	if sn == nil {
+		return as
+	}
+	for _, st := range sn.StList {
+		switch nd := st.(type) {
+		case *LetStatementNode:
+			vc.reads(nd.ArrayExp, as)
+			vc.reads(nd.ValueExp, as)
+			u := vc.use(nd.VarName.GetValue())
+			if u == nil {
+				continue
+			}
+			if nd.ArrayExp != nil {
+				// an element is stored by the address in the variable
+				vc.read(nd.VarName, u, as)
+				continue
+			}
+			u.written = true
+			if u.kind == Local {
+				as[nd.VarName.GetValue()] = true
+			}
+		case *IfStatementNode:
+			vc.reads(nd.IfExpr, as)
+			thenAs := vc.statements(nd.IfStat, as.copy())
+			elseAs := vc.statements(nd.ElseStat, as.copy())
+			switch {
+			case terminates(nd.IfStat):
+				as = elseAs
+			case terminates(nd.ElseStat):
+				as = thenAs
+			default:
+				for k := range as {
+					delete(as, k)
+				}
+				for k := range thenAs {
+					if elseAs[k] {
+						as[k] = true
+					}
+				}
+			}
+		case *WhileStatementNode:
+			vc.reads(nd.Expr, as)
+			// the body can be skipped, so it assigns nothing for the code after the loop
+			vc.statements(nd.Stat, as.copy())
+		default:
+			vc.reads(st, as)
+		}
+	}
+	return as
+}
+
+// reads marks all the variables read in the node
+func (vc *VarChecker) reads(n Node, as assigned) {
+	if isNilNode(n) {
+		return
+	}
+	Inspect(n, func(n Node) bool {
+		switch nd := n.(type) {
+		case *TermNode:
+			if nd.termType == termNodeVar || nd.termType == termNodeArray {
+				if u := vc.use(nd.val.GetValue()); u != nil {
+					vc.read(nd.val, u, as)
+				}
+			}
+		case *SubroutineCallNode:
+			if nd.Prefix != nil {
+				if u := vc.use(nd.Prefix.GetValue()); u != nil {
+					vc.read(nd.Prefix, u, as)
+				}
+			}
+		}
+		return true
+	})
+}
+
+func (vc *VarChecker) read(tk Token, u *varUse, as assigned) {
+	if vc.uninit && u.kind == Local && !u.warned && !as[tk.GetValue()] {
+		u.warned = true
+		vc.warnf(tk, CodeUninitVar, "Variable %s may be used before it is assigned", tk.GetValue())
+	}
+	u.read = true
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestVarCheck(t *testing.T) {
+	code := `class Main {
+		field int used, unused, written;
+		static int count;
+		method int f(int a, int b) {
+			var int x, y, z, w;
+			var Array arr;
+			let written = 1;
+			let count = count + used;
+			if (a > 0) {
+				let x = 1;
+			} else {
+				let x = 2;
+				let y = 3;
+			}
+			while (x > 0) {
+				let z = 1;
+			}
+			let arr[0] = z;
+			let w = 5;
+			return x + y;
+		}
+	}`
+	errs := NewVarChecker(true, true).Check("Main.jack", parseClass(t, code))
+
+	want := []string{
+		"Main.jack:18:17: warning[E0906]: Variable z may be used before it is assigned",
+		"Main.jack:18:8: warning[E0906]: Variable arr may be used before it is assigned",
+		"Main.jack:20:15: warning[E0906]: Variable y may be used before it is assigned",
+		"Main.jack:4:27: warning[E0905]: Parameter b is never used",
+		"Main.jack:5:21: warning[E0905]: Variable w is assigned but never used",
+		"Main.jack:2:19: warning[E0905]: Field unused is never used",
+		"Main.jack:2:27: warning[E0905]: Field written is assigned but never used",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Got %d diagnostics %v; want %d", len(errs), errs, len(want))
+	}
+	for i, d := range errs {
+		if d.Error() != want[i] {
+			t.Errorf("Got %s; want %s", d.Error(), want[i])
+		}
+	}
+}
+
+func TestVarCheckOptions(t *testing.T) {
+	units := map[string]*ClassNode{"Main.jack": parseClass(t, `class Main {
+		function void main() {
+			var int x, y;
+			let x = y;
+			return;
+		}
+	}`)}
+	tests := []struct {
+		opts CheckOptions
+		want int
+	}{
+		{CheckOptions{}, 0},
+		{CheckOptions{Unused: true}, 1},
+		{CheckOptions{Uninit: true}, 1},
+		{CheckOptions{Unused: true, Uninit: true}, 2},
+	}
+	for _, tt := range tests {
+		if diags := CheckProgram(units, tt.opts); len(diags) != tt.want {
+			t.Errorf("Options %+v: got %d diagnostics %v; want %d", tt.opts, len(diags), diags, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type VmOpcode int
+
+const (
+	VmPush VmOpcode = iota
+	VmPop
+	VmAdd
+	VmSub
+	VmNeg
+	VmEq
+	VmGt
+	VmLt
+	VmAnd
+	VmOr
+	VmNot
+	VmLabel
+	VmGoto
+	VmIfGoto
+	VmFunction
+	VmCall
+	VmReturn
+)
+
+var vmOpcodeNames = map[VmOpcode]string{
+	VmPush: "push", VmPop: "pop",
+	VmAdd: "add", VmSub: "sub", VmNeg: "neg",
+	VmEq: "eq", VmGt: "gt", VmLt: "lt",
+	VmAnd: "and", VmOr: "or", VmNot: "not",
+	VmLabel: "label", VmGoto: "goto", VmIfGoto: "if-goto",
+	VmFunction: "function", VmCall: "call", VmReturn: "return",
+}
+
+var vmOpcodes = make(map[string]VmOpcode, len(vmOpcodeNames))
+
+func init() {
+	for op, name := range vmOpcodeNames {
+		vmOpcodes[name] = op
+	}
+}
+
+func (op VmOpcode) String() string {
+	return vmOpcodeNames[op]
+}
+
+// VmInstr is one command of the VM language
+type VmInstr struct {
+	Op    VmOpcode
+	Segm  MemSegment // push and pop
+	Index int        // push and pop index, count of locals or arguments
+	Name  string     // label or function name
+	Kind  string     // function: kind of the jack subroutine, empty if unknown
+	File  string     // name of the vm file without extension, used for statics
+	Line  int        // line in the vm file, 0 if unknown
+}
+
+func (vi VmInstr) String() string {
+	switch vi.Op {
+	case VmPush, VmPop:
+		return vi.Op.String() + " " + string(vi.Segm) + " " + strconv.Itoa(vi.Index)
+	case VmLabel, VmGoto, VmIfGoto:
+		return vi.Op.String() + " " + vi.Name
+	case VmFunction, VmCall:
+		return vi.Op.String() + " " + vi.Name + " " + strconv.Itoa(vi.Index)
+	}
+	return vi.Op.String()
+}
+
+// WriteVm writes the instructions as vm code, one command per line
+func WriteVm(w io.Writer, code []VmInstr) error {
+	bw := bufio.NewWriter(w)
+	for _, vi := range code {
+		bw.WriteString(vi.String())
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func FormatVm(code []VmInstr) string {
+	sb := strings.Builder{}
+	WriteVm(&sb, code)
+	return sb.String()
+}
+
+// Count of fields of vm commands with arguments
+var vmFieldCounts = map[string]int{
+	"push": 3, "pop": 3, "function": 3, "call": 3,
+	"label": 2, "goto": 2, "if-goto": 2,
+}
+
+var vmSegments = map[MemSegment]bool{
+	ConstSegm: true, LocalSegm: true, ArgSegm: true, ThisSegm: true,
+	ThatSegm: true, TempSegm: true, StaticSegm: true, PointerSegm: true,
+}
+
+// ParseVm reads vm code of the file. The file is the name without extension, e.g. Main
+func ParseVm(file string, code string) ([]VmInstr, error) {
+	var instrs []VmInstr
+	var errs DiagnosticList
+	errorf := func(line int, format string, args ...interface{}) {
+		d := errorDiag(CodeVmParse, format, args...).AtPos(line, 1)
+		d.File = file + ".vm"
+		errs = append(errs, d)
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(code))
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+		f := strings.Fields(text)
+		if len(f) == 0 {
+			continue
+		}
+
+		op, ok := vmOpcodes[f[0]]
+		if !ok {
+			errorf(line, "Unknown command %s", f[0])
+			continue
+		}
+		want := vmFieldCounts[f[0]]
+		if want == 0 {
+			want = 1
+		}
+		if len(f) != want {
+			errorf(line, "Command %s expects %d arguments; got %d", f[0], want-1, len(f)-1)
+			continue
+		}
+
+		vi := VmInstr{Op: op, File: file, Line: line}
+		switch op {
+		case VmPush, VmPop:
+			vi.Segm = MemSegment(f[1])
+			if !vmSegments[vi.Segm] {
+				errorf(line, "Unknown segment %s", f[1])
+				continue
+			}
+			if op == VmPop && vi.Segm == ConstSegm {
+				errorf(line, "Cannot pop into the constant segment")
+				continue
+			}
+		case VmFunction, VmCall, VmLabel, VmGoto, VmIfGoto:
+			vi.Name = f[1]
+		}
+		if len(f) == 3 {
+			idx, err := strconv.Atoi(f[2])
+			if err != nil || idx < 0 || idx > 32767 {
+				errorf(line, "Wrong index %s", f[2])
+				continue
+			}
+			vi.Index = idx
+		}
+		instrs = append(instrs, vi)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return instrs, errs.Err()
+}
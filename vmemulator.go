@@ -0,0 +1,478 @@
+package main
+
+import "errors"
+
+// Hack memory map
+const (
+	staticBase = 16
+	staticEnd  = 256
+	stackBase  = 256
+	heapBase   = 2048
+	screenBase = 16384
+	kbdAddr    = 24576
+	ramSize    = 32768
+
+	screenWidth  = 512
+	screenHeight = 256
+	screenWords  = screenWidth / 16 // count of words in a screen row
+)
+
+// Return address of the frame created by VmEmulator.Call. Returning to it halts the emulator
+const vmHostReturn = -1
+
+// Return addresses are saved in 16-bit stack cells, so the program cannot be longer
+const maxVmCode = 32767
+
+// ErrCycleLimit is returned by Run when the program has not halted in the given count of cycles
+var ErrCycleLimit = errors.New("cycle limit is exceeded")
+
+// VmNative is a function implemented in Go. It gets the arguments of the call and returns the result
+type VmNative func(args []int16) int16
+
+type nativeFunc struct {
+	fn       VmNative
+	argCount int
+}
+
+// VmEmulator executes VM code on the Hack memory without translating it to assembly
+type VmEmulator struct {
+	RAM        [ramSize]int16
+	Cycles     int // count of executed commands
+	code       []VmInstr
+	funcOf     []string       // function of every command
+	functions  map[string]int // address of the function command
+	labels     map[string]int // address of function$label
+	statics    map[string]int // first static address of a file
+	natives    map[string]nativeFunc
+	native     VmInstr // call command of the native function being executed
+	nextStatic int
+	pc         int
+	halted     bool
+}
+
+func NewVmEmulator() *VmEmulator {
+	return &VmEmulator{
+		functions:  make(map[string]int),
+		labels:     make(map[string]int),
+		statics:    make(map[string]int),
+		natives:    make(map[string]nativeFunc),
+		nextStatic: staticBase,
+	}
+}
+
+func (e *VmEmulator) errorf(vi VmInstr, code string, format string, args ...interface{}) {
+	d := errorDiag(code, format, args...)
+	if vi.Line > 0 {
+		d.AtPos(vi.Line, 1)
+	}
+	if vi.File != "" {
+		d.File = vi.File + ".vm"
+	}
+	panic(d)
+}
+
+func (e *VmEmulator) recover(errp *error) {
+	r := recover()
+	if r != nil {
+		d, ok := r.(*Diagnostic)
+		if !ok {
+			panic(r)
+		}
+		*errp = d
+	}
+}
+
+// Load parses and loads vm code of the file. The file is the name without extension, e.g. Main
+func (e *VmEmulator) Load(file, code string) error {
+	instrs, err := ParseVm(file, code)
+	if err != nil {
+		return err
+	}
+	return e.LoadInstrs(file, instrs)
+}
+
+// LoadInstrs loads commands of one file. Static variables of the file get their own addresses
+func (e *VmEmulator) LoadInstrs(file string, instrs []VmInstr) (err error) {
+	defer e.recover(&err)
+	if _, ok := e.statics[file]; ok {
+		e.errorf(VmInstr{File: file}, CodeVmParse, "File %s is already loaded", file)
+	}
+	if len(e.code)+len(instrs) > maxVmCode {
+		e.errorf(VmInstr{File: file}, CodeVmParse, "Program is longer than %d commands", maxVmCode)
+	}
+
+	staticCount := 0
+	function := ""
+	for _, vi := range instrs {
+		vi.File = file
+		switch vi.Op {
+		case VmFunction:
+			if _, ok := e.functions[vi.Name]; ok {
+				e.errorf(vi, CodeVmParse, "Function %s is already defined", vi.Name)
+			}
+			function = vi.Name
+			e.functions[function] = len(e.code)
+		case VmLabel:
+			name := function + "$" + vi.Name
+			if _, ok := e.labels[name]; ok {
+				e.errorf(vi, CodeVmParse, "Label %s is already defined in %s", vi.Name, function)
+			}
+			e.labels[name] = len(e.code)
+		case VmPush, VmPop:
+			if vi.Segm == StaticSegm && vi.Index >= staticCount {
+				staticCount = vi.Index + 1
+			}
+		}
+		if function == "" {
+			e.errorf(vi, CodeVmParse, "Command %s is outside of a function", vi)
+		}
+		e.code = append(e.code, vi)
+		e.funcOf = append(e.funcOf, function)
+	}
+
+	if e.nextStatic+staticCount > staticEnd {
+		e.errorf(VmInstr{File: file}, CodeVmParse, "Static variables of %s do not fit into RAM[16..255]", file)
+	}
+	e.statics[file] = e.nextStatic
+	e.nextStatic += staticCount
+	return nil
+}
+
+// SetNative registers a Go function with the count of its arguments. It is called only
+// if the vm code does not define the function
+func (e *VmEmulator) SetNative(function string, argCount int, fn VmNative) {
+	e.natives[function] = nativeFunc{fn, argCount}
+}
+
+// HasFunction reports that the function is defined in the loaded vm code
+func (e *VmEmulator) HasFunction(function string) bool {
+	_, ok := e.functions[function]
+	return ok
+}
+
+// Halt stops the program, e.g. by Sys.halt
+func (e *VmEmulator) Halt() {
+	e.halted = true
+}
+
+// nativeErrorf reports a runtime error of the native function being executed
+func (e *VmEmulator) nativeErrorf(format string, args ...interface{}) {
+	e.errorf(e.native, CodeVmRuntime, e.native.Name+": "+format, args...)
+}
+
+// Pixel reports that the pixel of the 512x256 screen is black
+func (e *VmEmulator) Pixel(x, y int) bool {
+	return e.RAM[screenBase+y*screenWords+x/16]&(1<<uint(x%16)) != 0
+}
+
+// Boot sets SP to 256 and calls Sys.init as the bootstrap code of the Hack platform
+func (e *VmEmulator) Boot() (err error) {
+	defer e.recover(&err)
+	e.RAM[0] = stackBase
+	e.halted = false
+	e.call(VmInstr{Op: VmCall, Name: "Sys.init"}, vmHostReturn)
+	return nil
+}
+
+// Call pushes the arguments and calls the function. The emulator halts when the function
+// returns and its result is on the top of the stack
+func (e *VmEmulator) Call(function string, args ...int16) (err error) {
+	defer e.recover(&err)
+	if e.RAM[0] < stackBase {
+		e.RAM[0] = stackBase
+	}
+	e.halted = false
+	vi := VmInstr{Op: VmCall, Name: function, Index: len(args)}
+	for _, a := range args {
+		e.push(vi, a)
+	}
+	e.call(vi, vmHostReturn)
+	return nil
+}
+
+// Step executes one command
+func (e *VmEmulator) Step() (err error) {
+	defer e.recover(&err)
+	e.step()
+	return nil
+}
+
+// Run executes commands until the program halts. Zero maxCycles means no limit
+func (e *VmEmulator) Run(maxCycles int) (err error) {
+	defer e.recover(&err)
+	for n := 0; !e.halted; n++ {
+		if maxCycles > 0 && n >= maxCycles {
+			return ErrCycleLimit
+		}
+		e.step()
+	}
+	return nil
+}
+
+// Halted reports that the called function returned or the program entered an endless
+// loop of the form: label L; goto L
+func (e *VmEmulator) Halted() bool {
+	return e.halted
+}
+
+// Current returns the command to be executed next
+func (e *VmEmulator) Current() (VmInstr, bool) {
+	if e.pc < 0 || e.pc >= len(e.code) {
+		return VmInstr{}, false
+	}
+	return e.code[e.pc], true
+}
+
+// Function returns the name of the function being executed
+func (e *VmEmulator) Function() string {
+	if e.pc < 0 || e.pc >= len(e.funcOf) {
+		return ""
+	}
+	return e.funcOf[e.pc]
+}
+
+func (e *VmEmulator) SP() int {
+	return int(e.RAM[0])
+}
+
+// Stack returns the working stack from RAM[256] to SP
+func (e *VmEmulator) Stack() []int16 {
+	sp := e.SP()
+	if sp < stackBase || sp > heapBase {
+		return nil
+	}
+	return e.RAM[stackBase:sp]
+}
+
+// Result returns the value on the top of the stack, e.g. the result of Call
+func (e *VmEmulator) Result() int16 {
+	s := e.Stack()
+	if len(s) == 0 {
+		return 0
+	}
+	return s[len(s)-1]
+}
+
+func (e *VmEmulator) step() {
+	vi, ok := e.Current()
+	if !ok {
+		e.errorf(vi, CodeVmRuntime, "Program counter %d is out of the code", e.pc)
+	}
+	if e.halted {
+		return
+	}
+	e.Cycles++
+	next := e.pc + 1
+
+	switch vi.Op {
+	case VmPush:
+		e.push(vi, e.read(vi, e.address(vi)))
+	case VmPop:
+		addr := e.address(vi)
+		e.write(vi, addr, e.pop(vi))
+	case VmAdd, VmSub, VmAnd, VmOr, VmEq, VmGt, VmLt:
+		y := e.pop(vi)
+		x := e.pop(vi)
+		e.push(vi, vmBinaryOp(vi.Op, x, y))
+	case VmNeg:
+		e.push(vi, -e.pop(vi))
+	case VmNot:
+		e.push(vi, ^e.pop(vi))
+	case VmLabel:
+	case VmGoto:
+		next = e.label(vi)
+		if next == e.pc-1 {
+			e.halted = true
+		}
+	case VmIfGoto:
+		if e.pop(vi) != 0 {
+			next = e.label(vi)
+		}
+	case VmFunction:
+		for i := 0; i < vi.Index; i++ {
+			e.push(vi, 0)
+		}
+	case VmCall:
+		e.call(vi, next)
+		return
+	case VmReturn:
+		e.ret(vi)
+		return
+	}
+	e.pc = next
+}
+
+func vmBinaryOp(op VmOpcode, x, y int16) int16 {
+	switch op {
+	case VmAdd:
+		return x + y
+	case VmSub:
+		return x - y
+	case VmAnd:
+		return x & y
+	case VmOr:
+		return x | y
+	case VmEq:
+		return vmBool(x == y)
+	case VmGt:
+		return vmBool(x > y)
+	case VmLt:
+		return vmBool(x < y)
+	}
+	return 0
+}
+
+// vmBool converts a boolean into Jack true (-1) or false (0)
+func vmBool(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+func (e *VmEmulator) label(vi VmInstr) int {
+	addr, ok := e.labels[e.Function()+"$"+vi.Name]
+	if !ok {
+		e.errorf(vi, CodeVmRuntime, "Label %s is not defined in %s", vi.Name, e.Function())
+	}
+	return addr
+}
+
+// address returns the RAM address of the segment cell. The constant segment has no address
+func (e *VmEmulator) address(vi VmInstr) int {
+	switch vi.Segm {
+	case ConstSegm:
+		return -1
+	case LocalSegm:
+		return int(e.RAM[1]) + vi.Index
+	case ArgSegm:
+		return int(e.RAM[2]) + vi.Index
+	case ThisSegm:
+		return int(e.RAM[3]) + vi.Index
+	case ThatSegm:
+		return int(e.RAM[4]) + vi.Index
+	case TempSegm:
+		if vi.Index > 7 {
+			e.errorf(vi, CodeVmRuntime, "Index %d is out of the temp segment", vi.Index)
+		}
+		return tempBase + vi.Index
+	case PointerSegm:
+		if vi.Index > 1 {
+			e.errorf(vi, CodeVmRuntime, "Index %d is out of the pointer segment", vi.Index)
+		}
+		return pointerBase + vi.Index
+	case StaticSegm:
+		return e.statics[vi.File] + vi.Index
+	}
+	e.errorf(vi, CodeVmRuntime, "Unknown segment %s", vi.Segm)
+	return 0
+}
+
+func (e *VmEmulator) read(vi VmInstr, addr int) int16 {
+	if vi.Segm == ConstSegm {
+		return int16(vi.Index)
+	}
+	e.checkAddress(vi, addr)
+	return e.RAM[addr]
+}
+
+func (e *VmEmulator) write(vi VmInstr, addr int, val int16) {
+	e.checkAddress(vi, addr)
+	e.RAM[addr] = val
+}
+
+func (e *VmEmulator) checkAddress(vi VmInstr, addr int) {
+	if addr < 0 || addr >= ramSize {
+		e.errorf(vi, CodeVmRuntime, "Address %d is out of RAM", addr)
+	}
+}
+
+func (e *VmEmulator) push(vi VmInstr, val int16) {
+	sp := e.SP()
+	if sp < stackBase || sp >= heapBase {
+		e.errorf(vi, CodeVmRuntime, "Stack overflow in %s", e.funcName(vi))
+	}
+	e.RAM[sp] = val
+	e.RAM[0]++
+}
+
+func (e *VmEmulator) pop(vi VmInstr) int16 {
+	// The working stack of a function starts above its frame
+	sp := e.SP()
+	if sp <= stackBase || sp <= int(e.RAM[1]) || sp > heapBase {
+		e.errorf(vi, CodeVmRuntime, "Stack underflow in %s", e.funcName(vi))
+	}
+	e.RAM[0]--
+	return e.RAM[sp-1]
+}
+
+func (e *VmEmulator) funcName(vi VmInstr) string {
+	if f := e.Function(); f != "" {
+		return f
+	}
+	return vi.Name
+}
+
+// call saves the frame of the caller and jumps to the function
+func (e *VmEmulator) call(vi VmInstr, ret int) {
+	addr, ok := e.functions[vi.Name]
+	if !ok {
+		nf, ok := e.natives[vi.Name]
+		if !ok {
+			e.errorf(vi, CodeVmRuntime, "Function %s is not defined", vi.Name)
+		}
+		e.callNative(vi, nf, ret)
+		return
+	}
+	e.push(vi, int16(ret))
+	for i := 1; i <= 4; i++ {
+		e.push(vi, e.RAM[i]) // LCL, ARG, THIS, THAT
+	}
+	e.RAM[2] = e.RAM[0] - 5 - int16(vi.Index)
+	e.RAM[1] = e.RAM[0]
+	e.pc = addr
+}
+
+func (e *VmEmulator) callNative(vi VmInstr, nf nativeFunc, ret int) {
+	if vi.Index != nf.argCount {
+		e.errorf(vi, CodeVmRuntime, "Function %s expects %d arguments; got %d", vi.Name, nf.argCount, vi.Index)
+	}
+	sp := e.SP() - vi.Index
+	if sp < stackBase {
+		e.errorf(vi, CodeVmRuntime, "Stack underflow in %s", e.funcName(vi))
+	}
+	args := make([]int16, vi.Index)
+	copy(args, e.RAM[sp:])
+	e.RAM[0] = int16(sp)
+
+	e.native = vi
+	e.push(vi, nf.fn(args))
+	if ret == vmHostReturn {
+		e.halted = true
+		return
+	}
+	e.pc = ret
+}
+
+func (e *VmEmulator) ret(vi VmInstr) {
+	frame := int(e.RAM[1])
+	if frame-5 < stackBase {
+		e.errorf(vi, CodeVmRuntime, "Return without a call in %s", e.Function())
+	}
+	ret := e.RAM[frame-5]
+	arg := int(e.RAM[2])
+	e.write(vi, arg, e.pop(vi))
+	e.RAM[0] = int16(arg + 1)
+	for i := 4; i >= 1; i-- {
+		e.RAM[i] = e.RAM[frame-5+i] // THAT, THIS, ARG, LCL
+	}
+
+	if ret == vmHostReturn {
+		e.halted = true
+		return
+	}
+	e.pc = int(ret)
+	if e.pc < 0 || e.pc >= len(e.code) {
+		e.errorf(vi, CodeVmRuntime, "Wrong return address %d", e.pc)
+	}
+}
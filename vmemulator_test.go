@@ -0,0 +1,269 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestEmulator(t *testing.T, files map[string]string) *VmEmulator {
+	emu := NewVmEmulator()
+	for name, code := range files {
+		if err := emu.Load(name, code); err != nil {
+			t.Fatalf("Load error: %v", err)
+		}
+	}
+	return emu
+}
+
+func TestParseVm(t *testing.T) {
+	code := `// comment
+function Main.f 2
+push constant 7 // seven
+pop local 1
+label L1
+if-goto L1
+call Math.abs 1
+return
+`
+	want := []VmInstr{
+		{Op: VmFunction, Name: "Main.f", Index: 2, File: "Main", Line: 2},
+		{Op: VmPush, Segm: ConstSegm, Index: 7, File: "Main", Line: 3},
+		{Op: VmPop, Segm: LocalSegm, Index: 1, File: "Main", Line: 4},
+		{Op: VmLabel, Name: "L1", File: "Main", Line: 5},
+		{Op: VmIfGoto, Name: "L1", File: "Main", Line: 6},
+		{Op: VmCall, Name: "Math.abs", Index: 1, File: "Main", Line: 7},
+		{Op: VmReturn, File: "Main", Line: 8},
+	}
+	got, err := ParseVm("Main", code)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v; want %v", got, want)
+	}
+}
+
+func TestParseVmErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+		line int
+	}{
+		{"Unknown command", "function Main.f 0\nmul", 2},
+		{"Unknown segment", "push heap 1", 1},
+		{"Pop constant", "pop constant 1", 1},
+		{"Wrong index", "push local x", 1},
+		{"Big index", "push constant 32768", 1},
+		{"Argument count", "return 1", 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseVm("Main", tc.code)
+			if err == nil {
+				t.Fatal("Expected error")
+			}
+			dl := err.(DiagnosticList)
+			if dl[0].Line != tc.line || dl[0].Code != CodeVmParse || dl[0].File != "Main.vm" {
+				t.Errorf("Got %v; want error on line %d", dl[0], tc.line)
+			}
+		})
+	}
+}
+
+func TestEmulatorStep(t *testing.T) {
+	emu := newTestEmulator(t, map[string]string{"Main": `function Main.f 1
+push constant 3
+push constant 5
+sub
+neg
+pop local 0
+push local 0
+push constant 2
+gt
+not
+return
+`})
+	if err := emu.Call("Main.f"); err != nil {
+		t.Fatal(err)
+	}
+
+	// function, push, push, sub
+	wantStacks := [][]int16{{0}, {0, 3}, {0, 3, 5}, {0, -2}}
+	for _, want := range wantStacks {
+		if err := emu.Step(); err != nil {
+			t.Fatal(err)
+		}
+		// The frame of the call takes 5 cells
+		if got := emu.Stack()[5:]; !reflect.DeepEqual(got, want) {
+			t.Errorf("Stack %v; want %v", got, want)
+		}
+	}
+	if err := emu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if !emu.Halted() || emu.Result() != -1 || emu.SP() != 257 {
+		t.Errorf("Got result %d, SP %d; want result -1, SP 257", emu.Result(), emu.SP())
+	}
+	if emu.Cycles != 11 {
+		t.Errorf("Cycles %d; want 11", emu.Cycles)
+	}
+}
+
+func TestEmulatorCompiledCode(t *testing.T) {
+	jack := `class Main {
+		static int calls;
+		field int x;
+		constructor Main new(int ax) { let x = ax; return this; }
+		method int getX() { return x; }
+		function int fib(int n) {
+			let calls = calls + 1;
+			if (n < 2) { return n; }
+			return Main.fib(n - 1) + Main.fib(n - 2);
+		}
+		function int sum(Array a, int n) {
+			var int i, s;
+			while (i < n) { let s = s + a[i]; let i = i + 1; }
+			return s;
+		}
+		function int calls() { return calls; }
+	}`
+	comp := NewCompiler()
+	if err := comp.Run(parseClass(t, jack)); err != nil {
+		t.Fatalf("Compilation error: %v", err)
+	}
+	// Simple OS functions for the test
+	sys := `function Memory.alloc 0
+push static 0
+push constant 2048
+add
+push static 0
+push argument 0
+add
+pop static 0
+return
+function Array.new 1
+push argument 0
+call Memory.alloc 1
+return
+`
+	emu := newTestEmulator(t, map[string]string{"Main": comp.String(), "Sys": sys})
+
+	call := func(function string, args ...int16) int16 {
+		if err := emu.Call(function, args...); err != nil {
+			t.Fatal(err)
+		}
+		if err := emu.Run(1000000); err != nil {
+			t.Fatalf("%s: %v", function, err)
+		}
+		return emu.Result()
+	}
+
+	if got := call("Main.fib", 10); got != 55 {
+		t.Errorf("fib(10) = %d; want 55", got)
+	}
+	if got := call("Main.calls"); got != 177 {
+		t.Errorf("calls = %d; want 177", got)
+	}
+
+	arr := call("Array.new", 3)
+	copy(emu.RAM[arr:], []int16{10, -20, 30000})
+	if got := call("Main.sum", arr, 3); got != 10-20+30000 {
+		t.Errorf("sum = %d; want 29990", got)
+	}
+
+	obj := call("Main.new", 42)
+	if got := call("Main.getX", obj); got != 42 {
+		t.Errorf("getX = %d; want 42", got)
+	}
+	if emu.RAM[obj] != 42 {
+		t.Errorf("RAM[%d] = %d; want field x = 42", obj, emu.RAM[obj])
+	}
+}
+
+func TestEmulatorBoot(t *testing.T) {
+	sys := `function Sys.init 0
+push constant 1
+pop static 0
+call Main.main 0
+pop temp 0
+label END
+goto END
+`
+	main := `function Main.main 0
+push constant 2
+pop static 0
+push constant 0
+return
+`
+	emu := newTestEmulator(t, map[string]string{"Sys": sys, "Main": main})
+	if err := emu.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := emu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if !emu.Halted() || emu.Function() != "Sys.init" {
+		t.Errorf("Halted %v in %s; want halt in Sys.init", emu.Halted(), emu.Function())
+	}
+	// Every file has its own static segment
+	if emu.RAM[16]+emu.RAM[17] != 3 || emu.RAM[16] == emu.RAM[17] {
+		t.Errorf("Statics %d, %d; want 1 and 2", emu.RAM[16], emu.RAM[17])
+	}
+}
+
+func TestEmulatorErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+		line int
+	}{
+		{"Stack underflow", "function Main.f 0\nadd", 2},
+		{"Undefined function", "function Main.f 0\ncall Main.g 0", 2},
+		{"Undefined label", "function Main.f 0\ngoto L", 2},
+		{"Temp index", "function Main.f 0\npush temp 8", 2},
+		{"Out of code", "function Main.f 0\npush constant 0", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			emu := newTestEmulator(t, map[string]string{"Main": tc.code})
+			if err := emu.Call("Main.f"); err != nil {
+				t.Fatal(err)
+			}
+			err := emu.Run(100)
+			if err == nil {
+				t.Fatal("Expected error")
+			}
+			if d := AsDiagnostic(err); d.Line != tc.line || d.Code != CodeVmRuntime {
+				t.Errorf("Got %v; want runtime error on line %d", d, tc.line)
+			}
+		})
+	}
+
+	emu := newTestEmulator(t, map[string]string{"Main": "function Main.f 0\nlabel L\npush constant 0\ngoto L"})
+	emu.Call("Main.f")
+	if err := emu.Run(1000); err != ErrCycleLimit {
+		t.Errorf("Got %v; want cycle limit", err)
+	}
+	if emu.Cycles != 1000 {
+		t.Errorf("Cycles %d; want 1000", emu.Cycles)
+	}
+}
+
+func TestEmulatorLoadErrors(t *testing.T) {
+	emu := NewVmEmulator()
+	if err := emu.Load("Main", "push constant 1"); err == nil {
+		t.Error("Expected error for a command outside of a function")
+	}
+	emu = NewVmEmulator()
+	if err := emu.Load("Main", "function Main.f 0\nreturn\nfunction Main.f 0"); err == nil {
+		t.Error("Expected error for a duplicated function")
+	}
+	emu = NewVmEmulator()
+	long := "function Main.f 0\n" + strings.Repeat("push constant 0\n", maxVmCode)
+	if err := emu.Load("Main", long); err == nil {
+		t.Error("Expected error for a program longer than the return addresses allow")
+	}
+}
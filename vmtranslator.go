@@ -0,0 +1,304 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Names of the routines shared by all call, return, gt and lt commands
+const (
+	asmCallRoutine   = "$CALL"
+	asmReturnRoutine = "$RETURN"
+	asmGtRoutine     = "$GT"
+	asmLtRoutine     = "$LT"
+)
+
+// Base RAM addresses of the segments that are not addressed through pointers
+const (
+	pointerBase = 3
+	tempBase    = 5
+)
+
+var segmPointers = map[MemSegment]string{
+	LocalSegm: "LCL",
+	ArgSegm:   "ARG",
+	ThisSegm:  "THIS",
+	ThatSegm:  "THAT",
+}
+
+var asmBinaryOps = map[VmOpcode]string{
+	VmAdd: "M=D+M",
+	VmSub: "M=M-D",
+	VmAnd: "M=D&M",
+	VmOr:  "M=D|M",
+}
+
+var asmUnaryOps = map[VmOpcode]string{
+	VmNeg: "M=-M",
+	VmNot: "M=!M",
+}
+
+// x - y can overflow, so gt and lt are done by routines that compare the signs first.
+// eq does not need it: x - y is 0 only if x = y even with overflow
+var asmCompareOps = map[VmOpcode]string{
+	VmEq: "JEQ",
+}
+
+var asmCompareRoutines = map[VmOpcode]string{
+	VmGt: asmGtRoutine,
+	VmLt: asmLtRoutine,
+}
+
+// VmTranslator translates VM code into Hack assembly. Call and return commands
+// jump to shared routines in order to keep the program small enough for the 32K ROM
+type VmTranslator struct {
+	sb        *strings.Builder
+	bootstrap bool
+	fileName  string // prefix of static variables
+	function  string // prefix of labels
+	count     int    // counter for unique labels
+}
+
+// NewVmTranslator creates a translator. With bootstrap the program sets SP to 256 and calls Sys.init
+func NewVmTranslator(bootstrap bool) *VmTranslator {
+	return &VmTranslator{sb: &strings.Builder{}, bootstrap: bootstrap}
+}
+
+func (vt *VmTranslator) errorf(line int, format string, args ...interface{}) {
+	d := errorDiag(CodeVmTranslate, format, args...).AtPos(line, 1)
+	d.File = vt.fileName + ".vm"
+	panic(d)
+}
+
+func (vt *VmTranslator) recover(errp *error) {
+	e := recover()
+	if e != nil {
+		d, ok := e.(*Diagnostic)
+		if !ok {
+			panic(e)
+		}
+		*errp = d
+	}
+}
+
+// Translate appends the code of one vm file. The fileName is the name of
+// the file without extension, e.g. Main, and is used for static variables.
+// The translation stops at the first error
+func (vt *VmTranslator) Translate(fileName string, vmCode string) error {
+	code, err := ParseVm(fileName, vmCode)
+	if err != nil {
+		return translateErrors(err)[0]
+	}
+	return vt.TranslateInstrs(fileName, code)
+}
+
+// translateErrors returns the errors of ParseVm as the errors of the translation
+func translateErrors(err error) DiagnosticList {
+	errs, ok := err.(DiagnosticList)
+	if !ok {
+		return DiagnosticList{AsDiagnostic(err)}
+	}
+	for _, d := range errs {
+		d.Code = CodeVmTranslate
+	}
+	return errs
+}
+
+// TranslateInstrs appends the code of the file built in memory, e.g. by the compiler
+func (vt *VmTranslator) TranslateInstrs(fileName string, code []VmInstr) (err error) {
+	defer vt.recover(&err)
+	vt.fileName = fileName
+	vt.function = ""
+	for _, vi := range code {
+		vt.command(vi)
+	}
+	return nil
+}
+
+// String returns the whole program with bootstrap and the shared routines
+func (vt *VmTranslator) String() string {
+	out := &strings.Builder{}
+	if vt.bootstrap {
+		out.WriteString("// Bootstrap\n@256\nD=A\n@SP\nM=D\n")
+		boot := &VmTranslator{sb: out, function: "$BOOT"}
+		boot.writeCall("Sys.init", 0)
+		out.WriteString("($HALT)\n@$HALT\n0;JMP\n")
+	}
+	out.WriteString(vt.sb.String())
+	writeSharedRoutines(out)
+	return out.String()
+}
+
+func (vt *VmTranslator) write(lines ...string) {
+	for _, l := range lines {
+		vt.sb.WriteString(l)
+		vt.sb.WriteByte('\n')
+	}
+}
+
+func (vt *VmTranslator) command(vi VmInstr) {
+	vt.write("// " + vi.String())
+	if vi.Index < 0 || vi.Index > 32767 {
+		vt.errorf(vi.Line, "Wrong index %d", vi.Index)
+	}
+
+	switch vi.Op {
+	case VmPush:
+		vt.writePush(vi.Line, vi.Segm, vi.Index)
+	case VmPop:
+		vt.writePop(vi.Line, vi.Segm, vi.Index)
+	case VmLabel:
+		vt.write("(" + vt.label(vi.Name) + ")")
+	case VmGoto:
+		vt.write("@"+vt.label(vi.Name), "0;JMP")
+	case VmIfGoto:
+		vt.write("@SP", "AM=M-1", "D=M", "@"+vt.label(vi.Name), "D;JNE")
+	case VmFunction:
+		vt.function = vi.Name
+		vt.write("(" + vi.Name + ")")
+		for i := vi.Index; i > 0; i-- {
+			vt.write("@SP", "AM=M+1", "A=A-1", "M=0")
+		}
+	case VmCall:
+		vt.writeCall(vi.Name, vi.Index)
+	case VmReturn:
+		vt.write("@"+asmReturnRoutine, "0;JMP")
+	default:
+		vt.writeArithmetic(vi.Line, vi.Op)
+	}
+}
+
+// label makes the label local to the current function
+func (vt *VmTranslator) label(name string) string {
+	return vt.function + "$" + name
+}
+
+// uniqueLabel creates a label that cannot clash with labels of the vm code
+func (vt *VmTranslator) uniqueLabel(kind string) string {
+	vt.count++
+	return vt.function + ":" + kind + "." + strconv.Itoa(vt.count)
+}
+
+// address returns the A-instruction of the cell of a fixed segment
+func (vt *VmTranslator) address(line int, segm MemSegment, idx int) string {
+	switch segm {
+	case TempSegm:
+		if idx > 7 {
+			vt.errorf(line, "Index %d is out of the temp segment", idx)
+		}
+		return "@R" + strconv.Itoa(tempBase+idx)
+	case PointerSegm:
+		if idx > 1 {
+			vt.errorf(line, "Index %d is out of the pointer segment", idx)
+		}
+		return "@R" + strconv.Itoa(pointerBase+idx)
+	case StaticSegm:
+		return "@" + vt.fileName + "." + strconv.Itoa(idx)
+	}
+	vt.errorf(line, "Unknown segment %s", segm)
+	return ""
+}
+
+func (vt *VmTranslator) pushD() {
+	vt.write("@SP", "AM=M+1", "A=A-1", "M=D")
+}
+
+func (vt *VmTranslator) writePush(line int, segm MemSegment, idx int) {
+	if segm == ConstSegm {
+		vt.write("@"+strconv.Itoa(idx), "D=A")
+	} else if ptr, ok := segmPointers[segm]; ok {
+		vt.write("@"+strconv.Itoa(idx), "D=A", "@"+ptr, "A=D+M", "D=M")
+	} else {
+		vt.write(vt.address(line, segm, idx), "D=M")
+	}
+	vt.pushD()
+}
+
+func (vt *VmTranslator) writePop(line int, segm MemSegment, idx int) {
+	if ptr, ok := segmPointers[segm]; ok {
+		vt.write("@"+strconv.Itoa(idx), "D=A", "@"+ptr, "D=D+M", "@R13", "M=D")
+		vt.write("@SP", "AM=M-1", "D=M", "@R13", "A=M", "M=D")
+		return
+	}
+	if segm == ConstSegm {
+		vt.errorf(line, "Cannot pop into the constant segment")
+	}
+	addr := vt.address(line, segm, idx)
+	vt.write("@SP", "AM=M-1", "D=M", addr, "M=D")
+}
+
+func (vt *VmTranslator) writeArithmetic(line int, cmd VmOpcode) {
+	if op, ok := asmBinaryOps[cmd]; ok {
+		vt.write("@SP", "AM=M-1", "D=M", "A=A-1", op)
+		return
+	}
+	if op, ok := asmUnaryOps[cmd]; ok {
+		vt.write("@SP", "A=M-1", op)
+		return
+	}
+	if jmp, ok := asmCompareOps[cmd]; ok {
+		l := vt.uniqueLabel("CMP")
+		vt.write("@SP", "AM=M-1", "D=M", "A=A-1", "D=M-D", "M=-1", "@"+l, "D;"+jmp)
+		vt.write("@SP", "A=M-1", "M=0", "("+l+")")
+		return
+	}
+	if routine, ok := asmCompareRoutines[cmd]; ok {
+		ret := vt.uniqueLabel("ret")
+		vt.write("@"+ret, "D=A", "@"+routine, "0;JMP", "("+ret+")")
+		return
+	}
+	vt.errorf(line, "Unknown command %d", cmd)
+}
+
+// writeCall passes the function address in R13 and the count of arguments in R14
+// to the shared call routine, D holds the return address
+func (vt *VmTranslator) writeCall(function string, argCount int) {
+	ret := vt.uniqueLabel("ret")
+	vt.write("@"+strconv.Itoa(argCount), "D=A", "@R14", "M=D")
+	vt.write("@"+function, "D=A", "@R13", "M=D")
+	vt.write("@"+ret, "D=A", "@"+asmCallRoutine, "0;JMP", "("+ret+")")
+}
+
+func writeSharedRoutines(sb *strings.Builder) {
+	vt := &VmTranslator{sb: sb}
+	vt.write("// Shared call routine", "("+asmCallRoutine+")")
+	vt.pushD() // return address
+	for _, ptr := range [...]string{"LCL", "ARG", "THIS", "THAT"} {
+		vt.write("@"+ptr, "D=M")
+		vt.pushD()
+	}
+	vt.write("@SP", "D=M", "@5", "D=D-A", "@R14", "D=D-M", "@ARG", "M=D") // ARG = SP - 5 - nArgs
+	vt.write("@SP", "D=M", "@LCL", "M=D")                                 // LCL = SP
+	vt.write("@R13", "A=M", "0;JMP")
+
+	vt.write("// Shared return routine", "("+asmReturnRoutine+")")
+	vt.write("@LCL", "D=M", "@R13", "M=D")                 // frame = LCL
+	vt.write("@5", "A=D-A", "D=M", "@R14", "M=D")          // ret = *(frame - 5)
+	vt.write("@SP", "AM=M-1", "D=M", "@ARG", "A=M", "M=D") // *ARG = pop()
+	vt.write("@ARG", "D=M+1", "@SP", "M=D")                // SP = ARG + 1
+	for _, ptr := range [...]string{"THAT", "THIS", "ARG", "LCL"} {
+		vt.write("@R13", "AM=M-1", "D=M", "@"+ptr, "M=D")
+	}
+	vt.write("@R14", "A=M", "0;JMP")
+
+	vt.writeCompareRoutine(asmGtRoutine, "JGT")
+	vt.writeCompareRoutine(asmLtRoutine, "JLT")
+}
+
+// writeCompareRoutine writes the routine that replaces x and y on the stack with x jmp y.
+// D holds the return address. Only numbers of the same sign are subtracted: for different
+// signs the sign of x - y is the sign of x
+func (vt *VmTranslator) writeCompareRoutine(name, jmp string) {
+	vt.write("// Shared "+strings.ToLower(jmp[1:])+" routine", "("+name+")")
+	vt.write("@R15", "M=D")                                    // return address
+	vt.write("@SP", "AM=M-1", "D=M", "@R13", "M=D")            // R13 = y
+	vt.write("@SP", "A=M-1", "D=M", "@"+name+".XNEG", "D;JLT") // D = x
+	vt.write("@R13", "D=M", "@"+name+".SAME", "D;JGE")         // x >= 0, y >= 0
+	vt.write("D=1", "@"+name+".SET", "0;JMP")                  // x >= 0, y < 0
+	vt.write("("+name+".XNEG)", "@R13", "D=M", "@"+name+".SAME", "D;JLT")
+	vt.write("D=-1", "@"+name+".SET", "0;JMP") // x < 0, y >= 0
+	vt.write("("+name+".SAME)", "@SP", "A=M-1", "D=M", "@R13", "D=D-M")
+	vt.write("("+name+".SET)", "@SP", "A=M-1", "M=-1", "@"+name+".TRUE", "D;"+jmp)
+	vt.write("@SP", "A=M-1", "M=0")
+	vt.write("("+name+".TRUE)", "@R15", "A=M", "0;JMP")
+}
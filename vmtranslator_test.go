@@ -0,0 +1,253 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func stripAsmComments(asm string) string {
+	sb := strings.Builder{}
+	for _, l := range strings.Split(asm, "\n") {
+		if l != "" && !strings.HasPrefix(l, "//") {
+			sb.WriteString(l + "\n")
+		}
+	}
+	return sb.String()
+}
+
+func TestTranslateCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		vm   string
+		want []string
+	}{
+		{"Push constant", "push constant 7", []string{"@7", "D=A", "@SP", "AM=M+1", "A=A-1", "M=D"}},
+		{"Push local", "push local 2", []string{"@2", "D=A", "@LCL", "A=D+M", "D=M"}},
+		{"Pop temp", "pop temp 3", []string{"@SP", "AM=M-1", "D=M", "@R8", "M=D"}},
+		{"Pop pointer", "pop pointer 1", []string{"@R4", "M=D"}},
+		{"Static", "push static 4", []string{"@Main.4", "D=M"}},
+		{"Add", "add", []string{"@SP", "AM=M-1", "D=M", "A=A-1", "M=D+M"}},
+		{"Not", "not", []string{"@SP", "A=M-1", "M=!M"}},
+		{"Label in function", "function Main.f 0\nlabel L\ngoto L", []string{"(Main.f$L)", "@Main.f$L", "0;JMP"}},
+		{"Locals", "function Main.f 1", []string{"(Main.f)", "@SP", "AM=M+1", "A=A-1", "M=0"}},
+		{"Call", "call Math.abs 1", []string{"@1", "D=A", "@R14", "M=D", "@Math.abs", "D=A", "@R13", "M=D"}},
+		{"Return", "return", []string{"@$RETURN", "0;JMP"}},
+		{"Comment", "push constant 1 // one", []string{"@1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vt := NewVmTranslator(false)
+			if err := vt.Translate("Main", tc.vm); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			got := stripAsmComments(vt.sb.String())
+			if !strings.Contains(got, strings.Join(tc.want, "\n")+"\n") {
+				t.Errorf("Got:\n%s\nwant to contain:\n%s", got, strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestTranslateErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		vm   string
+	}{
+		{"Unknown command", "push constant 1\nfoo"},
+		{"Unknown segment", "push heap 1"},
+		{"Pop constant", "pop constant 1"},
+		{"Temp overflow", "push temp 8"},
+		{"Wrong index", "push local x"},
+		{"Wrong args", "push local"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewVmTranslator(false).Translate("Main", tc.vm)
+			if err == nil {
+				t.Fatal("Expected error")
+			}
+			if d := AsDiagnostic(err); d.File != "Main.vm" || d.Code != CodeVmTranslate {
+				t.Errorf("Got %v; want a diagnostic for Main.vm", d)
+			}
+		})
+	}
+}
+
+func TestTranslateInstrsErrors(t *testing.T) {
+	for _, vi := range []VmInstr{
+		{Op: VmPush, Segm: "heap", Line: 3},
+		{Op: VmPop, Segm: ConstSegm, Line: 3},
+		{Op: VmPush, Segm: LocalSegm, Index: -1, Line: 3},
+		{Op: VmOpcode(100), Line: 3},
+	} {
+		err := NewVmTranslator(false).TranslateInstrs("Main", []VmInstr{vi})
+		if d := AsDiagnostic(err); err == nil || d.File != "Main.vm" || d.Line != 3 {
+			t.Errorf("Got %v for %+v; want a diagnostic for Main.vm:3", err, vi)
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	vt := NewVmTranslator(true)
+	got := vt.String()
+	if !strings.HasPrefix(got, "// Bootstrap\n@256\nD=A\n@SP\nM=D\n") {
+		t.Errorf("Program does not start with SP=256:\n%s", got)
+	}
+	if !strings.Contains(got, "@Sys.init\n") {
+		t.Error("Sys.init is not called")
+	}
+	for _, r := range [...]string{asmCallRoutine, asmReturnRoutine} {
+		if !strings.Contains(got, "("+r+")\n") {
+			t.Errorf("Routine %s is not defined", r)
+		}
+	}
+}
+
+// runAsm executes the Hack assembly on the RAM without the assembler. Labels and
+// variables are resolved by their names
+func runAsm(t *testing.T, asm string, ram []int16, maxSteps int) {
+	t.Helper()
+	symbols := map[string]int{"SP": 0, "LCL": 1, "ARG": 2, "THIS": 3, "THAT": 4}
+	for i := 0; i < 16; i++ {
+		symbols["R"+strconv.Itoa(i)] = i
+	}
+	var code []string
+	for _, l := range strings.Split(asm, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "//") {
+			continue
+		}
+		if l[0] == '(' {
+			symbols[l[1:len(l)-1]] = len(code)
+			continue
+		}
+		code = append(code, l)
+	}
+
+	nextVar := 16
+	var a, d int16
+	for pc, step := 0, 0; pc < len(code) && step < maxSteps; step++ {
+		ins := code[pc]
+		pc++
+		if ins[0] == '@' {
+			v, err := strconv.Atoi(ins[1:])
+			if err != nil {
+				var ok bool
+				if v, ok = symbols[ins[1:]]; !ok {
+					v = nextVar
+					symbols[ins[1:]] = v
+					nextVar++
+				}
+			}
+			a = int16(v)
+			continue
+		}
+
+		dest, comp, jump := "", ins, ""
+		if i := strings.Index(comp, "="); i >= 0 {
+			dest, comp = comp[:i], comp[i+1:]
+		}
+		if i := strings.Index(comp, ";"); i >= 0 {
+			comp, jump = comp[:i], comp[i+1:]
+		}
+		addr := int(a)
+		var m int16
+		if strings.Contains(comp+dest, "M") {
+			if addr < 0 || addr >= len(ram) {
+				t.Fatalf("Address %d is out of the RAM at %s", addr, ins)
+			}
+			m = ram[addr]
+		}
+		v := evalComp(t, comp, a, d, m)
+		if strings.Contains(dest, "M") {
+			ram[addr] = v
+		}
+		if strings.Contains(dest, "A") {
+			a = v
+		}
+		if strings.Contains(dest, "D") {
+			d = v
+		}
+		if jump == "JMP" || jump == "JEQ" && v == 0 || jump == "JNE" && v != 0 ||
+			jump == "JGT" && v > 0 || jump == "JGE" && v >= 0 || jump == "JLT" && v < 0 || jump == "JLE" && v <= 0 {
+			pc = addr
+		}
+	}
+}
+
+// evalComp computes the comp part of the C-instruction
+func evalComp(t *testing.T, comp string, a, d, m int16) int16 {
+	operand := func(s string) int16 {
+		switch s {
+		case "A":
+			return a
+		case "D":
+			return d
+		case "M":
+			return m
+		case "0":
+			return 0
+		case "1":
+			return 1
+		}
+		t.Fatalf("Unknown operand %s", s)
+		return 0
+	}
+	switch {
+	case len(comp) == 1:
+		return operand(comp)
+	case len(comp) == 2 && comp[0] == '-':
+		return -operand(comp[1:])
+	case len(comp) == 2 && comp[0] == '!':
+		return ^operand(comp[1:])
+	case len(comp) == 3:
+		x, y := operand(comp[:1]), operand(comp[2:])
+		switch comp[1] {
+		case '+':
+			return x + y
+		case '-':
+			return x - y
+		case '&':
+			return x & y
+		case '|':
+			return x | y
+		}
+	}
+	t.Fatalf("Unknown comp %s", comp)
+	return 0
+}
+
+func TestTranslateCompare(t *testing.T) {
+	testCases := []struct {
+		name string
+		vm   string
+		want int16
+	}{
+		{"32767 > -1", "push constant 32767\npush constant 1\nneg\ngt", -1},
+		{"32767 < -1", "push constant 32767\npush constant 1\nneg\nlt", 0},
+		{"-32768 < 1", "push constant 32767\nnot\npush constant 1\nlt", -1},
+		{"-32768 > 1", "push constant 32767\nnot\npush constant 1\ngt", 0},
+		{"-1 > -2", "push constant 1\nneg\npush constant 2\nneg\ngt", -1},
+		{"0 > 0", "push constant 0\npush constant 0\ngt", 0},
+		{"2 < 3", "push constant 2\npush constant 3\nlt", -1},
+		{"-32768 = 0", "push constant 32767\nnot\npush constant 0\neq", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vt := NewVmTranslator(false)
+			if err := vt.Translate("Main", tc.vm+"\nlabel END\ngoto END"); err != nil {
+				t.Fatal(err)
+			}
+			ram := make([]int16, 1024)
+			ram[0] = 256
+			runAsm(t, vt.String(), ram, 1000)
+			if ram[0] != 257 || ram[256] != tc.want {
+				t.Errorf("Got SP = %d, result %d; want SP = 257, result %d", ram[0], ram[256], tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// Inspect traverses the tree in depth-first order. It calls f for every node.
+// If f returns true, Inspect goes on with the children of the node.
+func Inspect(n Node, f func(Node) bool) {
+	if n == nil || !f(n) {
+		return
+	}
+	for _, ch := range children(n) {
+		Inspect(ch, f)
+	}
+}
+
+// children returns direct child nodes in the order they appear in the source
+func children(n Node) []Node {
+	var ch []Node
+	add := func(nodes ...Node) {
+		for _, nd := range nodes {
+			if !isNilNode(nd) {
+				ch = append(ch, nd)
+			}
+		}
+	}
+
+	switch nd := n.(type) {
+	case *ClassNode:
+		for _, vd := range nd.VarDec {
+			add(vd)
+		}
+		for _, sbr := range nd.SbrDec {
+			add(sbr)
+		}
+	case *SubroutineDecNode:
+		add(nd.ParamList, nd.Body)
+	case *SubroutineBodyNode:
+		for _, vd := range nd.VarDec {
+			add(vd)
+		}
+		add(nd.Statm)
+	case *StatementsNode:
+		add(nd.StList...)
+	case *LetStatementNode:
+		add(nd.ArrayExp, nd.ValueExp)
+	case *IfStatementNode:
+		add(nd.IfExpr, nd.IfStat, nd.ElseStat)
+	case *WhileStatementNode:
+		add(nd.Expr, nd.Stat)
+	case *DoStatementNode:
+		add(nd.Call)
+	case *ReturnStatementNode:
+		add(nd.Expr)
+	case *ExpressionNode:
+		add(nd.term)
+		for _, tn := range nd.opTerms {
+			add(tn)
+		}
+	case *ExpressionListNode:
+		for _, e := range nd.Exprs {
+			add(e)
+		}
+	case *SubroutineCallNode:
+		add(nd.Params)
+	case *TermNode:
+		add(nd.arrayIdx, nd.exp, nd.unaryTerm, nd.call)
+	}
+	return ch
+}
+
+// isNilNode checks typed nil pointers hidden in the Node interface
+func isNilNode(n Node) bool {
+	switch nd := n.(type) {
+	case nil:
+		return true
+	case *StatementsNode:
+		return nd == nil
+	case *ExpressionNode:
+		return nd == nil
+	case *ExpressionListNode:
+		return nd == nil
+	case *TermNode:
+		return nd == nil
+	case *SubroutineCallNode:
+		return nd == nil
+	case *ParameterListNode:
+		return nd == nil
+	case *SubroutineBodyNode:
+		return nd == nil
+	}
+	return false
+}